@@ -72,77 +72,70 @@ func afcLsAction(ctx *cli.Context) error {
 	}
 	defer afc.Close()
 
-	if p, err := afc.ReadDirectory(args[0]); err != nil {
+	dir, err := afc.OpenDirectory(args[0])
+	if err != nil {
 		return err
-	} else {
-		for _, v := range p {
-			if v != "." && v != ".." {
-				if i, err := afc.GetFileInfo(path.Join(args[0], v)); err != nil {
-					return err
-				} else if i.IsDir() {
-					fmt.Printf("%7s %s \x1B[1;34m%s\x1B[0m\n", byteCountDecimal(i.Size()), i.ModTime().Format("2006-01-02 15:04:05"), i.Name())
-				} else {
-					fmt.Printf("%7s %s %s\n", byteCountDecimal(i.Size()), i.ModTime().Format("2006-01-02 15:04:05"), i.Name())
-				}
-			}
+	}
+	defer dir.Close()
+
+	/* big directories print while the rest is still coming */
+	for {
+		i, err := dir.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if i.IsDir() {
+			fmt.Printf("%7s %s \x1B[1;34m%s\x1B[0m\n", byteCountDecimal(i.Size()), i.ModTime().Format("2006-01-02 15:04:05"), i.Name())
+		} else {
+			fmt.Printf("%7s %s %s\n", byteCountDecimal(i.Size()), i.ModTime().Format("2006-01-02 15:04:05"), i.Name())
 		}
 	}
 
-	return nil
+	return dir.Close()
 }
 
 func printTree(afc *services.AFCService, raw string, hasNexts []bool) error {
-	if p, err := afc.ReadDirectory(raw); err != nil {
+	infos, err := afc.ReadDirectoryInfo(raw)
+	if err != nil {
 		return err
-	} else {
-		for i, v := range p {
-			if v == "." || v == ".." {
-				continue
-			}
-			b := &bytes.Buffer{}
-			for _, hasNext := range hasNexts {
-				if hasNext {
-					b.WriteString("│   ")
-				} else {
-					b.WriteString("    ")
-				}
-			}
-			var name string
-			fullPath := path.Join(raw, v)
-			info, err := afc.GetFileInfo(fullPath)
-			if err != nil {
-				return err
-			} else if info.IsDir() {
-				name = fmt.Sprintf("\x1B[1;34m%s\x1B[0m", info.Name())
-				//printTree(afc, v)
+	}
+
+	lastIndex := len(infos) - 1
+	for i, info := range infos {
+		b := &bytes.Buffer{}
+		for _, hasNext := range hasNexts {
+			if hasNext {
+				b.WriteString("│   ")
 			} else {
-				name = fmt.Sprintf("%s", info.Name())
+				b.WriteString("    ")
 			}
+		}
+		var name string
+		if info.IsDir() {
+			name = fmt.Sprintf("\x1B[1;34m%s\x1B[0m", info.Name())
+		} else {
+			name = info.Name()
+		}
 
-			lastIndex := len(p) - 1
+		// print tree
+		if i == lastIndex {
+			b.WriteString("└──")
+			b.WriteString(name)
+		} else {
+			b.WriteString("├──")
+			b.WriteString(name)
+		}
 
-			// print tree
-			if i == lastIndex {
-				b.WriteString("└──")
-				b.WriteString(name)
-			} else {
-				b.WriteString("├──")
-				b.WriteString(name)
-			}
+		fmt.Println(string(b.Bytes()))
 
-			fmt.Println(string(b.Bytes()))
-
-			if info.IsDir() {
-				if i == lastIndex {
-					hasNexts = append(hasNexts, false)
-				} else {
-					hasNexts = append(hasNexts, true)
-				}
-				err := printTree(afc, fullPath, hasNexts)
-				hasNexts = hasNexts[:len(hasNexts)-1]
-				if err != nil {
-					return err
-				}
+		if info.IsDir() {
+			hasNexts = append(hasNexts, i != lastIndex)
+			err := printTree(afc, path.Join(raw, info.Name()), hasNexts)
+			hasNexts = hasNexts[:len(hasNexts)-1]
+			if err != nil {
+				return err
 			}
 		}
 	}
@@ -326,6 +319,34 @@ func initAFCCommand() cli.Command {
 				Action: afcDownloadAction,
 				Flags:  globalFlags,
 			},
+			{
+				Name:   "push",
+				Usage:  "push [--delete] <local dir> <device dir>",
+				Action: afcPushAction,
+				Flags:  afcSyncFlags,
+			},
+			{
+				Name:   "pull",
+				Usage:  "pull [--delete] <device dir> <local dir>",
+				Action: afcPullAction,
+				Flags:  afcSyncFlags,
+			},
+			{
+				Name:   "serve",
+				Usage:  "serve [--listen 127.0.0.1:8080] [--app <bundle id>]",
+				Action: afcServeAction,
+				Flags: append(globalFlags,
+					cli.StringFlag{
+						Name:  "listen, l",
+						Usage: "WebDAV `ADDRESS` to listen on",
+						Value: "127.0.0.1:8080",
+					},
+					cli.StringFlag{
+						Name:  "app, a",
+						Usage: "Serve the container of `BUNDLEID` instead of the media directory",
+					},
+				),
+			},
 			{
 				Name:   "remove",
 				Usage:  "remove <file>",
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"iconsole/frames"
+	"iconsole/services"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+// davHandler serves AFC as a WebDAV class 1 server: PROPFIND, GET and
+// HEAD with ranges, PUT, DELETE, MKCOL and MOVE
+type davHandler struct {
+	afc *services.AFCService
+	/* the host and port of the listen address */
+	host string
+	port string
+}
+
+func newDavHandler(afc *services.AFCService, listen string) (*davHandler, error) {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return nil, err
+	}
+	return &davHandler{afc: afc, host: host, port: port}, nil
+}
+
+// allowedHost takes a Host header naming the listen address, an IP or
+// localhost. A web page that rebinds its own name to this address still
+// sends that name and is turned away.
+func (this *davHandler) allowedHost(hostport string) bool {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host, port = hostport, "80"
+	}
+	if port != this.port {
+		return false
+	}
+	return net.ParseIP(strings.Trim(host, "[]")) != nil || strings.EqualFold(host, "localhost") ||
+		(this.host != "" && strings.EqualFold(host, this.host))
+}
+
+/* the device path of a request path, URL paths are decoded already */
+func davPath(p string) string {
+	return path.Clean("/" + p)
+}
+
+func davHref(p string, dir bool) string {
+	href := (&url.URL{Path: p}).EscapedPath()
+	if dir && !strings.HasSuffix(href, "/") {
+		href += "/"
+	}
+	return href
+}
+
+func davStatus(err error) int {
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return http.StatusNotFound
+	case errors.Is(err, os.ErrExist):
+		return http.StatusMethodNotAllowed
+	case errors.Is(err, os.ErrPermission):
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+func davError(w http.ResponseWriter, err error) {
+	status := davStatus(err)
+	http.Error(w, err.Error(), status)
+}
+
+func (this *davHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !this.allowedHost(r.Host) {
+		http.Error(w, "unknown host", http.StatusMisdirectedRequest)
+		return
+	}
+
+	p := davPath(r.URL.Path)
+
+	switch r.Method {
+	case "OPTIONS":
+		w.Header().Set("DAV", "1")
+		w.Header().Set("Allow", "OPTIONS, PROPFIND, GET, HEAD, PUT, DELETE, MKCOL, MOVE")
+		w.Header().Set("MS-Author-Via", "DAV")
+	case "PROPFIND":
+		this.propfind(w, r, p)
+	case "GET", "HEAD":
+		this.get(w, r, p)
+	case "PUT":
+		this.put(w, r, p)
+	case "DELETE":
+		this.delete(w, p)
+	case "MKCOL":
+		this.mkcol(w, r, p)
+	case "MOVE":
+		this.move(w, r, p)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+type davProp struct {
+	DisplayName   string        `xml:"D:displayname"`
+	ContentLength *int64        `xml:"D:getcontentlength,omitempty"`
+	ContentType   string        `xml:"D:getcontenttype,omitempty"`
+	LastModified  string        `xml:"D:getlastmodified"`
+	ResourceType  davCollection `xml:"D:resourcetype"`
+}
+
+type davCollection struct {
+	Collection *struct{} `xml:"D:collection,omitempty"`
+}
+
+type davResponse struct {
+	Href   string  `xml:"D:href"`
+	Prop   davProp `xml:"D:propstat>D:prop"`
+	Status string  `xml:"D:propstat>D:status"`
+}
+
+type davMultistatus struct {
+	XMLName   xml.Name      `xml:"D:multistatus"`
+	Namespace string        `xml:"xmlns:D,attr"`
+	Responses []davResponse `xml:"D:response"`
+}
+
+func davEntry(p string, info os.FileInfo) davResponse {
+	resp := davResponse{Href: davHref(p, info.IsDir()), Status: "HTTP/1.1 200 OK"}
+	resp.Prop.DisplayName = path.Base(p)
+	resp.Prop.LastModified = info.ModTime().UTC().Format(http.TimeFormat)
+	if info.IsDir() {
+		resp.Prop.ResourceType.Collection = &struct{}{}
+	} else {
+		size := info.Size()
+		resp.Prop.ContentLength = &size
+		resp.Prop.ContentType = mime.TypeByExtension(path.Ext(p))
+	}
+	return resp
+}
+
+/* every property is listed whatever the body asks for, clients cope with that */
+func (this *davHandler) propfind(w http.ResponseWriter, r *http.Request, p string) {
+	_, _ = io.Copy(ioutil.Discard, r.Body)
+
+	info, err := this.afc.GetFileInfo(p)
+	if err != nil {
+		davError(w, err)
+		return
+	}
+
+	ms := davMultistatus{Namespace: "DAV:", Responses: []davResponse{davEntry(p, info)}}
+
+	/* "infinity" is answered one level deep like "1" */
+	if info.IsDir() && r.Header.Get("Depth") != "0" {
+		infos, err := this.afc.ReadDirectoryInfo(p)
+		if err != nil {
+			davError(w, err)
+			return
+		}
+		for _, info := range infos {
+			ms.Responses = append(ms.Responses, davEntry(path.Join(p, info.Name()), info))
+		}
+	}
+
+	body, err := xml.Marshal(ms)
+	if err != nil {
+		davError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusMultiStatus)
+	_, _ = w.Write([]byte(xml.Header))
+	_, _ = w.Write(body)
+}
+
+func (this *davHandler) get(w http.ResponseWriter, r *http.Request, p string) {
+	info, err := this.afc.GetFileInfo(p)
+	if err != nil {
+		davError(w, err)
+		return
+	} else if info.IsDir() {
+		http.Error(w, "is a collection, use PROPFIND", http.StatusMethodNotAllowed)
+		return
+	}
+
+	f, err := this.afc.FileOpen(p, services.AFC_RDONLY)
+	if err != nil {
+		davError(w, err)
+		return
+	}
+	defer f.Close()
+
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
+
+// parentExists answers 409 for a missing parent like RFC 4918 wants
+func (this *davHandler) parentExists(w http.ResponseWriter, p string) bool {
+	info, err := this.afc.GetFileInfo(path.Dir(p))
+	if errors.Is(err, os.ErrNotExist) || (err == nil && !info.IsDir()) {
+		http.Error(w, "parent collection not found", http.StatusConflict)
+		return false
+	} else if err != nil {
+		davError(w, err)
+		return false
+	}
+	return true
+}
+
+func (this *davHandler) put(w http.ResponseWriter, r *http.Request, p string) {
+	if !this.parentExists(w, p) {
+		return
+	}
+
+	info, err := this.afc.GetFileInfo(p)
+	if err == nil && info.IsDir() {
+		http.Error(w, "is a collection", http.StatusMethodNotAllowed)
+		return
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		davError(w, err)
+		return
+	}
+	created := err != nil
+
+	f, err := this.afc.FileOpen(p, services.AFC_WR)
+	if err != nil {
+		davError(w, err)
+		return
+	}
+	_, err = io.Copy(f, r.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		davError(w, err)
+		return
+	}
+
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (this *davHandler) delete(w http.ResponseWriter, p string) {
+	if p == "/" {
+		http.Error(w, "can't delete the root", http.StatusForbidden)
+		return
+	}
+	if _, err := this.afc.GetFileInfo(p); err != nil {
+		davError(w, err)
+		return
+	}
+	if err := this.afc.RemoveAll(p); err != nil {
+		davError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (this *davHandler) mkcol(w http.ResponseWriter, r *http.Request, p string) {
+	if r.ContentLength > 0 {
+		http.Error(w, "MKCOL with a body", http.StatusUnsupportedMediaType)
+		return
+	}
+	if _, err := this.afc.GetFileInfo(p); err == nil {
+		http.Error(w, "already exists", http.StatusMethodNotAllowed)
+		return
+	} else if !errors.Is(err, os.ErrNotExist) {
+		davError(w, err)
+		return
+	}
+	if !this.parentExists(w, p) {
+		return
+	}
+	if err := this.afc.Mkdir(p); err != nil {
+		davError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (this *davHandler) move(w http.ResponseWriter, r *http.Request, p string) {
+	u, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil || u.Path == "" {
+		http.Error(w, "bad Destination", http.StatusBadRequest)
+		return
+	}
+	if u.Host != "" && u.Host != r.Host {
+		http.Error(w, "Destination on another server", http.StatusBadGateway)
+		return
+	}
+	dst := davPath(u.Path)
+	if dst == p {
+		http.Error(w, "source and Destination are the same", http.StatusForbidden)
+		return
+	}
+
+	if _, err := this.afc.GetFileInfo(p); err != nil {
+		davError(w, err)
+		return
+	}
+	if !this.parentExists(w, dst) {
+		return
+	}
+
+	_, err = this.afc.GetFileInfo(dst)
+	exists := err == nil
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		davError(w, err)
+		return
+	}
+	if exists {
+		if r.Header.Get("Overwrite") == "F" {
+			http.Error(w, "Destination exists", http.StatusPreconditionFailed)
+			return
+		}
+		if err := this.afc.RemoveAll(dst); err != nil {
+			davError(w, err)
+			return
+		}
+	}
+
+	if err := this.afc.Rename(p, dst); err != nil {
+		davError(w, err)
+		return
+	}
+	if exists {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// davArrest vends the container of app, or its Documents when the app
+// is not debuggable
+func davArrest(device frames.Device, app string) (*services.AFCService, error) {
+	a, err := services.NewHouseArrestService(device)
+	if err != nil {
+		return nil, err
+	}
+	afc, err := a.Container(app)
+	if err == nil {
+		return afc, nil
+	}
+
+	/* house arrest expects one command per connection, start over for the second */
+	_ = a.Close()
+	fmt.Printf("container of %s: %s, serving its Documents\n", app, err)
+
+	if a, err = services.NewHouseArrestService(device); err != nil {
+		return nil, err
+	}
+	if afc, err = a.Documents(app); err != nil {
+		_ = a.Close()
+		return nil, err
+	}
+	return afc, nil
+}
+
+func afcServeAction(ctx *cli.Context) error {
+	udid := ctx.String("UDID")
+
+	device, err := getDevice(udid)
+	if err != nil {
+		return err
+	}
+
+	var afc *services.AFCService
+	if app := ctx.String("app"); app != "" {
+		afc, err = davArrest(device, app)
+	} else {
+		afc, err = services.NewAFCService(device)
+	}
+	if err != nil {
+		return err
+	}
+	defer afc.Close()
+
+	listen := ctx.String("listen")
+	handler, err := newDavHandler(afc, listen)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("WebDAV on http://%s/\n", listen)
+	return http.ListenAndServe(listen, handler)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"iconsole/services"
+	"iconsole/services/afctest"
+	"iconsole/tunnel"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startAFC runs an AFC client against server over a pipe
+func startAFC(t *testing.T, server *afctest.Server) *services.AFCService {
+	t.Helper()
+
+	client, device := net.Pipe()
+	go server.Serve(device)
+	return services.NewAFCServiceWith(tunnel.NewService(tunnel.MixConnectionClient(client), nil, services.AFCServiceName))
+}
+
+func startDav(t *testing.T, server *afctest.Server) (*httptest.Server, func()) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	afc := startAFC(t, server)
+	handler, err := newDavHandler(afc, ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dav := httptest.NewUnstartedServer(handler)
+	_ = dav.Listener.Close()
+	dav.Listener = ln
+	dav.Start()
+	return dav, func() {
+		dav.Close()
+		_ = afc.Close()
+	}
+}
+
+func davDo(t *testing.T, method, url, host, body string, header map[string]string) (*http.Response, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host != "" {
+		req.Host = host
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(data)
+}
+
+func TestDavMethods(t *testing.T) {
+	server := afctest.NewServer()
+	server.Mkdir("/DCIM")
+	if err := server.WriteFile("/DCIM/a.txt", []byte("hello webdav"), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	dav, done := startDav(t, server)
+	defer done()
+
+	resp, body := davDo(t, "PROPFIND", dav.URL+"/DCIM", "", "", map[string]string{"Depth": "1"})
+	if resp.StatusCode != http.StatusMultiStatus || !strings.Contains(body, "<D:href>/DCIM/a.txt</D:href>") ||
+		!strings.Contains(body, "<D:getcontentlength>12</D:getcontentlength>") {
+		t.Errorf("PROPFIND %d %s", resp.StatusCode, body)
+	}
+
+	resp, body = davDo(t, "GET", dav.URL+"/DCIM/a.txt", "", "", map[string]string{"Range": "bytes=6-"})
+	if resp.StatusCode != http.StatusPartialContent || body != "webdav" {
+		t.Errorf("GET range %d %q", resp.StatusCode, body)
+	}
+
+	if resp, _ = davDo(t, "MKCOL", dav.URL+"/DCIM/new", "", "", nil); resp.StatusCode != http.StatusCreated {
+		t.Errorf("MKCOL %d", resp.StatusCode)
+	}
+	if resp, _ = davDo(t, "MKCOL", dav.URL+"/missing/new", "", "", nil); resp.StatusCode != http.StatusConflict {
+		t.Errorf("MKCOL without parent %d", resp.StatusCode)
+	}
+
+	if resp, _ = davDo(t, "PUT", dav.URL+"/DCIM/new/b.txt", "", "put body", nil); resp.StatusCode != http.StatusCreated {
+		t.Errorf("PUT %d", resp.StatusCode)
+	}
+	if data, ok := server.ReadFile("/DCIM/new/b.txt"); !ok || string(data) != "put body" {
+		t.Errorf("PUT wrote %q", data)
+	}
+
+	resp, _ = davDo(t, "MOVE", dav.URL+"/DCIM/new/b.txt", "", "", map[string]string{"Destination": dav.URL + "/DCIM/c.txt"})
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("MOVE %d", resp.StatusCode)
+	}
+	if _, ok := server.ReadFile("/DCIM/c.txt"); !ok {
+		t.Error("MOVE left no destination")
+	}
+
+	if resp, _ = davDo(t, "DELETE", dav.URL+"/DCIM/new", "", "", nil); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("DELETE %d", resp.StatusCode)
+	}
+	if resp, _ = davDo(t, "GET", dav.URL+"/DCIM/new/b.txt", "", "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET after DELETE %d", resp.StatusCode)
+	}
+}
+
+func TestDavHost(t *testing.T) {
+	server := afctest.NewServer()
+	if err := server.WriteFile("/a.txt", []byte("a"), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	dav, done := startDav(t, server)
+	defer done()
+
+	_, port, _ := net.SplitHostPort(dav.Listener.Addr().String())
+	for host, allowed := range map[string]bool{
+		"127.0.0.1:" + port:        true,
+		"localhost:" + port:        true,
+		"LOCALHOST:" + port:        true,
+		"[::1]:" + port:            true,
+		"attacker.example:" + port: false,
+		"attacker.example":         false,
+		"127.0.0.1:1":              false,
+	} {
+		resp, _ := davDo(t, "GET", dav.URL+"/a.txt", host, "", nil)
+		if got := resp.StatusCode == http.StatusOK; got != allowed {
+			t.Errorf("Host %s: status %d", host, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"iconsole/services"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// afcSync copies a tree between the host and the device, files of the
+// same size and mtime, or the same sha1, are left alone
+type afcSync struct {
+	afc    *services.AFCService
+	delete bool
+
+	copied, skipped, deleted int
+	/* directories seen, parents first, their mtimes are set at the end */
+	dirs []syncDir
+}
+
+type syncDir struct {
+	path  string
+	mtime time.Time
+}
+
+/* mtimes only agree to the second across file systems */
+func sameTime(a, b time.Time) bool {
+	return a.Unix() == b.Unix()
+}
+
+func localHash(name string) ([]byte, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha1.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// unchanged compares the hashes when the sizes agree but the mtimes don't
+func (this *afcSync) unchanged(local os.FileInfo, localPath string, remote os.FileInfo, remotePath string) bool {
+	if local.Size() != remote.Size() {
+		return false
+	}
+	if sameTime(local.ModTime(), remote.ModTime()) {
+		return true
+	}
+
+	/* not every device answers hashes, copy then */
+	remoteSum, err := this.afc.Hash(remotePath)
+	if err != nil {
+		return false
+	}
+	localSum, err := localHash(localPath)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(localSum, remoteSum)
+}
+
+// walkDevice calls fn for root and everything below it, parents first.
+// fn returns `filepath.SkipDir` to leave out the directory's content.
+func walkDevice(afc *services.AFCService, root string, fn func(p string, info os.FileInfo) error) error {
+	info, err := afc.GetFileInfo(root)
+	if err != nil {
+		return err
+	}
+	return walkDeviceInfo(afc, root, info, fn)
+}
+
+func walkDeviceInfo(afc *services.AFCService, root string, info os.FileInfo, fn func(p string, info os.FileInfo) error) error {
+	if err := fn(root, info); err == filepath.SkipDir {
+		return nil
+	} else if err != nil || !info.IsDir() {
+		return err
+	}
+
+	infos, err := afc.ReadDirectoryInfo(root)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if err := walkDeviceInfo(afc, path.Join(root, info.Name()), info, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deviceRel is p below the device directory root, root may be `/` or
+// end in a slash while the walk joins clean paths
+func deviceRel(root, p string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(path.Clean(p), path.Clean(root)), "/")
+}
+
+func isDeviceLink(info os.FileInfo) bool {
+	m, _ := info.Sys().(map[string]string)
+	return m["st_ifmt"] == "S_IFLNK"
+}
+
+func (this *afcSync) push(localRoot, deviceRoot string) error {
+	err := filepath.Walk(localRoot, func(localPath string, local os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(localRoot, localPath)
+		if err != nil {
+			return err
+		}
+		devicePath := path.Join(deviceRoot, filepath.ToSlash(rel))
+
+		if local.Mode()&os.ModeSymlink != 0 {
+			fmt.Printf("skip link %s\n", localPath)
+			return nil
+		}
+
+		remote, err := this.afc.GetFileInfo(devicePath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		if local.IsDir() {
+			this.dirs = append(this.dirs, syncDir{path: devicePath, mtime: local.ModTime()})
+			if remote != nil && remote.IsDir() {
+				return nil
+			} else if remote != nil {
+				if err := this.afc.Remove(devicePath); err != nil {
+					return err
+				}
+			}
+			return this.afc.Mkdir(devicePath)
+		}
+
+		if remote != nil && remote.IsDir() {
+			if err := this.afc.RemoveAll(devicePath); err != nil {
+				return err
+			}
+			remote = nil
+		}
+
+		if remote != nil && this.unchanged(local, localPath, remote, devicePath) {
+			this.skipped++
+			if !sameTime(local.ModTime(), remote.ModTime()) {
+				return this.afc.SetFileTime(uint64(local.ModTime().UnixNano()), devicePath)
+			}
+			return nil
+		}
+
+		fmt.Printf("push %s\n", devicePath)
+		if err := this.upload(localPath, devicePath); err != nil {
+			return err
+		}
+		this.copied++
+		return this.afc.SetFileTime(uint64(local.ModTime().UnixNano()), devicePath)
+	})
+	if err == nil && this.delete {
+		err = this.deleteDevice(localRoot, deviceRoot)
+	}
+	if err != nil {
+		return err
+	}
+
+	/* copying into a directory moves its mtime, children go first */
+	for i := len(this.dirs) - 1; i >= 0; i-- {
+		dir := this.dirs[i]
+		if err := this.afc.SetFileTime(uint64(dir.mtime.UnixNano()), dir.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteDevice removes what is below deviceRoot but not below localRoot
+func (this *afcSync) deleteDevice(localRoot, deviceRoot string) error {
+	return walkDevice(this.afc, deviceRoot, func(devicePath string, remote os.FileInfo) error {
+		rel := deviceRel(deviceRoot, devicePath)
+		if _, err := os.Lstat(filepath.Join(localRoot, filepath.FromSlash(rel))); err == nil {
+			return nil
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+
+		fmt.Printf("delete %s\n", devicePath)
+		this.deleted++
+		if err := this.afc.RemoveAll(devicePath); err != nil {
+			return err
+		}
+		if remote.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
+func (this *afcSync) upload(localPath, devicePath string) error {
+	src, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	f, err := this.afc.FileOpen(devicePath, services.AFC_WR)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, src); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (this *afcSync) pull(deviceRoot, localRoot string) error {
+	err := walkDevice(this.afc, deviceRoot, func(devicePath string, remote os.FileInfo) error {
+		rel := deviceRel(deviceRoot, devicePath)
+		localPath := filepath.Join(localRoot, filepath.FromSlash(rel))
+
+		if isDeviceLink(remote) {
+			fmt.Printf("skip link %s\n", devicePath)
+			return nil
+		}
+
+		local, err := os.Lstat(localPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		if remote.IsDir() {
+			this.dirs = append(this.dirs, syncDir{path: localPath, mtime: remote.ModTime()})
+			if local != nil && local.IsDir() {
+				return nil
+			} else if local != nil {
+				if err := os.Remove(localPath); err != nil {
+					return err
+				}
+			}
+			return os.Mkdir(localPath, 0755)
+		}
+
+		if local != nil && local.IsDir() {
+			if err := os.RemoveAll(localPath); err != nil {
+				return err
+			}
+			local = nil
+		}
+
+		mtime := remote.ModTime()
+		if local != nil && this.unchanged(local, localPath, remote, devicePath) {
+			this.skipped++
+			if !sameTime(local.ModTime(), mtime) {
+				return os.Chtimes(localPath, mtime, mtime)
+			}
+			return nil
+		}
+
+		fmt.Printf("pull %s\n", devicePath)
+		if err := this.download(devicePath, localPath); err != nil {
+			return err
+		}
+		this.copied++
+		return os.Chtimes(localPath, mtime, mtime)
+	})
+	if err == nil && this.delete {
+		err = this.deleteLocal(deviceRoot, localRoot)
+	}
+	if err != nil {
+		return err
+	}
+
+	/* the same deepest first, after the deletes touched them too */
+	for i := len(this.dirs) - 1; i >= 0; i-- {
+		dir := this.dirs[i]
+		if err := os.Chtimes(dir.path, dir.mtime, dir.mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteLocal removes what is below localRoot but not below deviceRoot
+func (this *afcSync) deleteLocal(deviceRoot, localRoot string) error {
+	return filepath.Walk(localRoot, func(localPath string, local os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(localRoot, localPath)
+		if err != nil {
+			return err
+		}
+		if _, err := this.afc.GetFileInfo(path.Join(deviceRoot, filepath.ToSlash(rel))); err == nil {
+			return nil
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		fmt.Printf("delete %s\n", localPath)
+		this.deleted++
+		if err := os.RemoveAll(localPath); err != nil {
+			return err
+		}
+		if local.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
+func (this *afcSync) download(devicePath, localPath string) error {
+	f, err := this.afc.FileOpen(devicePath, services.AFC_RDONLY)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dst, err := os.Create(localPath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, f); err != nil {
+		_ = dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+func afcSyncAction(ctx *cli.Context, push bool) error {
+	udid := ctx.String("UDID")
+
+	args := ctx.Args()
+	if len(args) < 2 {
+		return cli.ShowSubcommandHelp(ctx)
+	}
+
+	device, err := getDevice(udid)
+	if err != nil {
+		return err
+	}
+
+	afc, err := services.NewAFCService(device)
+	if err != nil {
+		return err
+	}
+	defer afc.Close()
+
+	s := &afcSync{afc: afc, delete: ctx.Bool("delete")}
+	if push {
+		err = s.push(filepath.Clean(args[0]), path.Clean(args[1]))
+	} else {
+		err = s.pull(path.Clean(args[0]), filepath.Clean(args[1]))
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d copied, %d unchanged, %d deleted\n", s.copied, s.skipped, s.deleted)
+	return nil
+}
+
+func afcPushAction(ctx *cli.Context) error {
+	return afcSyncAction(ctx, true)
+}
+
+func afcPullAction(ctx *cli.Context) error {
+	return afcSyncAction(ctx, false)
+}
+
+var afcSyncFlags = append(globalFlags, cli.BoolFlag{
+	Name:  "delete",
+	Usage: "Delete files missing on the source",
+})
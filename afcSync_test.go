@@ -0,0 +1,205 @@
+package main
+
+import (
+	"iconsole/services/afctest"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var (
+	dirTime  = time.Date(2019, 3, 1, 8, 0, 0, 0, time.UTC)
+	fileTime = time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+)
+
+func TestAFCPush(t *testing.T) {
+	local, err := ioutil.TempDir("", "push")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(local)
+	for name, data := range map[string]string{"top.txt": "top", "a/b/deep.txt": "deep"} {
+		p := filepath.Join(local, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, fileTime, fileTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, dir := range []string{"a/b", "a", "."} {
+		if err := os.Chtimes(filepath.Join(local, dir), dirTime, dirTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	server := afctest.NewServer()
+	server.Mkdir("/Dst/a/old")
+	for _, name := range []string{"/Dst/stale.txt", "/Dst/a/old/x.txt"} {
+		if err := server.WriteFile(name, []byte("stale"), fileTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	afc := startAFC(t, server)
+	defer afc.Close()
+
+	s := &afcSync{afc: afc, delete: true}
+	if err := s.push(local, "/Dst"); err != nil {
+		t.Fatal(err)
+	}
+	if s.copied != 2 || s.deleted != 2 {
+		t.Errorf("%d copied, %d deleted", s.copied, s.deleted)
+	}
+	if data, ok := server.ReadFile("/Dst/a/b/deep.txt"); !ok || string(data) != "deep" {
+		t.Errorf("pushed %q", data)
+	}
+	for _, name := range []string{"/Dst/stale.txt", "/Dst/a/old"} {
+		if _, ok := server.ReadFile(name); ok {
+			t.Errorf("%s not deleted", name)
+		}
+	}
+	for name, want := range map[string]time.Time{"/Dst": dirTime, "/Dst/a": dirTime, "/Dst/a/b": dirTime, "/Dst/top.txt": fileTime} {
+		if info, err := afc.GetFileInfo(name); err != nil {
+			t.Error(err)
+		} else if !sameTime(info.ModTime(), want) {
+			t.Errorf("%s mtime %v, want %v", name, info.ModTime(), want)
+		}
+	}
+
+	s = &afcSync{afc: afc, delete: true}
+	if err := s.push(local, "/Dst"); err != nil {
+		t.Fatal(err)
+	}
+	if s.copied != 0 || s.skipped != 2 || s.deleted != 0 {
+		t.Errorf("again: %d copied, %d unchanged, %d deleted", s.copied, s.skipped, s.deleted)
+	}
+}
+
+func TestAFCPull(t *testing.T) {
+	server := afctest.NewServer()
+	server.Mkdir("/Src/a/b")
+	for name, data := range map[string]string{"/Src/top.txt": "top", "/Src/a/b/deep.txt": "deep"} {
+		if err := server.WriteFile(name, []byte(data), fileTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	afc := startAFC(t, server)
+	defer afc.Close()
+	for _, dir := range []string{"/Src", "/Src/a", "/Src/a/b"} {
+		if err := afc.SetFileTime(uint64(dirTime.UnixNano()), dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	local, err := ioutil.TempDir("", "pull")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(local)
+	if err := os.MkdirAll(filepath.Join(local, "a", "old"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(local, "stale.txt"), []byte("stale"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &afcSync{afc: afc, delete: true}
+	if err := s.pull("/Src", local); err != nil {
+		t.Fatal(err)
+	}
+	if s.copied != 2 || s.deleted != 2 {
+		t.Errorf("%d copied, %d deleted", s.copied, s.deleted)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(local, "a", "b", "deep.txt")); err != nil || string(data) != "deep" {
+		t.Errorf("pulled %q, %v", data, err)
+	}
+	for _, name := range []string{"stale.txt", filepath.Join("a", "old")} {
+		if _, err := os.Lstat(filepath.Join(local, name)); !os.IsNotExist(err) {
+			t.Errorf("%s not deleted: %v", name, err)
+		}
+	}
+	/* written into after they were made, the directories still carry the device's mtimes */
+	for name, want := range map[string]time.Time{".": dirTime, "a": dirTime, filepath.Join("a", "b"): dirTime, "top.txt": fileTime} {
+		if info, err := os.Stat(filepath.Join(local, name)); err != nil {
+			t.Error(err)
+		} else if !sameTime(info.ModTime(), want) {
+			t.Errorf("%s mtime %v, want %v", name, info.ModTime(), want)
+		}
+	}
+
+	s = &afcSync{afc: afc, delete: true}
+	if err := s.pull("/Src", local); err != nil {
+		t.Fatal(err)
+	}
+	if s.copied != 0 || s.skipped != 2 || s.deleted != 0 {
+		t.Errorf("again: %d copied, %d unchanged, %d deleted", s.copied, s.skipped, s.deleted)
+	}
+}
+
+func TestAFCSyncDeleteRoots(t *testing.T) {
+	local, err := ioutil.TempDir("", "roots")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(local)
+	if err := os.MkdirAll(filepath.Join(local, "a"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"keep.txt", "a/keep.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(local, filepath.FromSlash(name)), []byte("keep"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, root := range []string{"/", "/Dst/", "/Dst//", "/Dst/."} {
+		dst := path.Clean(root)
+		server := afctest.NewServer()
+		server.Mkdir(path.Join(dst, "a"))
+		for _, name := range []string{"stale.txt", "a/stale.txt"} {
+			if err := server.WriteFile(path.Join(dst, name), []byte("stale"), fileTime); err != nil {
+				t.Fatal(err)
+			}
+		}
+		afc := startAFC(t, server)
+
+		s := &afcSync{afc: afc, delete: true}
+		if err := s.push(local, root); err != nil {
+			t.Fatalf("push to %s: %v", root, err)
+		}
+		if s.copied != 2 || s.deleted != 2 {
+			t.Errorf("push to %s: %d copied, %d deleted", root, s.copied, s.deleted)
+		}
+		for _, name := range []string{"keep.txt", "a/keep.txt"} {
+			if _, ok := server.ReadFile(path.Join(dst, name)); !ok {
+				t.Errorf("push to %s: %s missing", root, name)
+			}
+		}
+		for _, name := range []string{"stale.txt", "a/stale.txt"} {
+			if _, ok := server.ReadFile(path.Join(dst, name)); ok {
+				t.Errorf("push to %s: %s not deleted", root, name)
+			}
+		}
+
+		/* and back into a tree with a file the device lacks */
+		if err := ioutil.WriteFile(filepath.Join(local, "a", "local.txt"), []byte("local"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		s = &afcSync{afc: afc, delete: true}
+		if err := s.pull(root, local); err != nil {
+			t.Fatalf("pull from %s: %v", root, err)
+		}
+		if s.copied != 0 || s.deleted != 1 {
+			t.Errorf("pull from %s: %d copied, %d deleted", root, s.copied, s.deleted)
+		}
+		if _, err := os.Stat(filepath.Join(local, "a", "local.txt")); !os.IsNotExist(err) {
+			t.Errorf("pull from %s: local.txt not deleted, %v", root, err)
+		}
+		_ = afc.Close()
+	}
+}
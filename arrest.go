@@ -3,7 +3,6 @@ package main
 import (
 	"fmt"
 	"iconsole/services"
-	"path"
 
 	"github.com/urfave/cli"
 )
@@ -32,19 +31,15 @@ func arrestAction(ctx *cli.Context) error {
 
 	base := "Documents"
 
-	if p, err := afc.ReadDirectory(base); err != nil {
+	infos, err := afc.ReadDirectoryInfo(base)
+	if err != nil {
 		return err
-	} else {
-		for _, v := range p {
-			if v != "." && v != ".." {
-				if i, err := afc.GetFileInfo(path.Join(base, v)); err != nil {
-					return err
-				} else if i.IsDir() {
-					fmt.Printf("%7s %s \x1B[1;34m%s\x1B[0m\n", byteCountDecimal(i.Size()), i.ModTime().Format("2006-01-02 15:04:05"), i.Name())
-				} else {
-					fmt.Printf("%7s %s %s\n", byteCountDecimal(i.Size()), i.ModTime().Format("2006-01-02 15:04:05"), i.Name())
-				}
-			}
+	}
+	for _, i := range infos {
+		if i.IsDir() {
+			fmt.Printf("%7s %s \x1B[1;34m%s\x1B[0m\n", byteCountDecimal(i.Size()), i.ModTime().Format("2006-01-02 15:04:05"), i.Name())
+		} else {
+			fmt.Printf("%7s %s %s\n", byteCountDecimal(i.Size()), i.ModTime().Format("2006-01-02 15:04:05"), i.Name())
 		}
 	}
 
@@ -3,11 +3,50 @@ package main
 import (
 	"fmt"
 	"iconsole/tunnel"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/urfave/cli"
 )
 
+func devicesWatchAction() error {
+	monitor := tunnel.NewDeviceMonitor()
+
+	events, err := monitor.Start()
+	if err != nil {
+		return err
+	}
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigc
+		_ = monitor.Close()
+	}()
+
+	for event := range events {
+		now := time.Now().Format("2006-01-02 15:04:05")
+		switch event.Type {
+		case tunnel.MonitorDisconnected:
+			fmt.Printf("%s usbmuxd disconnected: %s\n", now, event.Err)
+		case tunnel.MonitorConnected:
+			fmt.Printf("%s usbmuxd connected %d device(s)\n", now, len(monitor.Devices()))
+		default:
+			fmt.Printf("%s %s\n\tConnectionType: %s\n\tDeviceID: %d\n\tUDID: %s\n", now, event.Type,
+				event.Device.GetConnectionType(), event.Device.GetDeviceID(), event.Device.GetSerialNumber())
+		}
+	}
+
+	return nil
+}
+
 func devicesAction(ctx *cli.Context) error {
+	if ctx.Bool("watch") {
+		return devicesWatchAction()
+	}
+
 	devices, err := tunnel.Devices()
 	if err != nil {
 		return err
@@ -18,7 +57,7 @@ func devicesAction(ctx *cli.Context) error {
 			return err
 		}
 
-		if err := conn.StartSession(); err != nil {
+		if err := conn.StartSession(tunnel.DefaultPairRecordStore); err != nil {
 			return err
 		}
 
@@ -52,5 +91,11 @@ func initDevices() cli.Command {
 		ShortName: "dev",
 		Usage:     "List all connect devices",
 		Action:    devicesAction,
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name:  "watch, w",
+				Usage: "Keep running and print devices as they attach and detach",
+			},
+		},
 	}
 }
@@ -0,0 +1,122 @@
+package frames
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// usbmuxd protocol versions, old daemons only speak binary
+const (
+	BinaryVersion = 0
+	PlistVersion  = 1
+)
+
+// message types of the usbmuxd header
+const (
+	BinaryResult       = 1
+	BinaryConnect      = 2
+	BinaryListen       = 3
+	BinaryDeviceAdd    = 4
+	BinaryDeviceRemove = 5
+	PlistMessage       = 8
+)
+
+const (
+	// id u32, product u16, serial [256]byte, padding u16, location u32
+	BinaryDeviceRecordSize = 268
+	binarySerialSize       = 256
+)
+
+var (
+	ErrBinaryBody = errors.New("binary usbmuxd message body too short")
+)
+
+// PackBinaryTo appends a binary frame with the raw body to buf
+func (this *Package) PackBinaryTo(buf *bytes.Buffer, body []byte) {
+	var header [PackageHeaderSize]byte
+	binary.LittleEndian.PutUint32(header[0:], uint32(PackageHeaderSize+len(body)))
+	binary.LittleEndian.PutUint32(header[4:], this.Version)
+	binary.LittleEndian.PutUint32(header[8:], this.Type)
+	binary.LittleEndian.PutUint32(header[12:], this.Tag)
+	buf.Write(header[:])
+	buf.Write(body)
+}
+
+// IsBinary reports a binary message, whatever version the header claims
+func (this *Package) IsBinary() bool {
+	return this.Type != PlistMessage
+}
+
+func PackBinaryResult(number int) []byte {
+	body := make([]byte, 4)
+	binary.LittleEndian.PutUint32(body, uint32(number))
+	return body
+}
+
+// PackBinaryConnect takes the port in host order, it goes on the wire big endian
+func PackBinaryConnect(deviceId int, port int) []byte {
+	body := make([]byte, 8)
+	binary.LittleEndian.PutUint32(body[0:], uint32(deviceId))
+	binary.BigEndian.PutUint16(body[4:], uint16(port))
+	return body
+}
+
+func PackBinaryDeviceRemove(deviceId int) []byte {
+	return PackBinaryResult(deviceId)
+}
+
+func PackBinaryDevice(device *USBDevice) []byte {
+	body := make([]byte, BinaryDeviceRecordSize)
+	binary.LittleEndian.PutUint32(body[0:], uint32(device.DeviceID))
+	binary.LittleEndian.PutUint16(body[4:], uint16(device.ProductID))
+	/* keep the terminating NUL */
+	copy(body[6:6+binarySerialSize-1], device.SerialNumber)
+	binary.LittleEndian.PutUint32(body[264:], uint32(device.LocationID))
+	return body
+}
+
+func UnpackBinaryResult(body []byte) (int, error) {
+	if len(body) < 4 {
+		return 0, ErrBinaryBody
+	}
+	return int(binary.LittleEndian.Uint32(body)), nil
+}
+
+// UnpackBinaryConnect returns the port in host order
+func UnpackBinaryConnect(body []byte) (deviceId int, port int, err error) {
+	if len(body) < 6 {
+		return 0, 0, ErrBinaryBody
+	}
+	return int(binary.LittleEndian.Uint32(body)), int(binary.BigEndian.Uint16(body[4:])), nil
+}
+
+func UnpackBinaryDeviceRemove(body []byte) (int, error) {
+	return UnpackBinaryResult(body)
+}
+
+// UnpackBinaryDevice decodes a DEVICE_ADD record, binary daemons only know USB
+func UnpackBinaryDevice(body []byte) (*USBDevice, error) {
+	if len(body) < BinaryDeviceRecordSize {
+		return nil, ErrBinaryBody
+	}
+
+	serial := body[6 : 6+binarySerialSize]
+	if i := bytes.IndexByte(serial, 0); i >= 0 {
+		serial = serial[:i]
+	}
+
+	device := &USBDevice{
+		DeviceModel: DeviceModel{
+			ConnectionType: "USB",
+			DeviceID:       int(binary.LittleEndian.Uint32(body[0:])),
+			SerialNumber:   string(serial),
+		},
+		ProductID:  int(binary.LittleEndian.Uint16(body[4:])),
+		LocationID: int(binary.LittleEndian.Uint32(body[264:])),
+	}
+	device.UDID = device.SerialNumber
+	device.USBSerialNumber = device.SerialNumber
+
+	return device, nil
+}
@@ -75,6 +75,11 @@ type (
 		DeviceID int `plist:"DeviceID"`
 	}
 
+	DevicePaired struct {
+		BaseResponse
+		DeviceID int `plist:"DeviceID"`
+	}
+
 	Result struct {
 		BaseResponse
 		Number int `plist:"Number"`
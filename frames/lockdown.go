@@ -67,7 +67,7 @@ type StartSessionResponse struct {
 type PairRequest struct {
 	LockdownRequest
 	PairRecord     *PairRecord            `plist:"PairRecord"`
-	PairingOptions map[string]interface{} `plist:"PairingOptions"`
+	PairingOptions map[string]interface{} `plist:"PairingOptions,omitempty"`
 }
 
 type PairResponse struct {
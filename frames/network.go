@@ -0,0 +1,75 @@
+package frames
+
+import (
+	"errors"
+	"net"
+)
+
+const (
+	afInet       = 0x02
+	afInet6      = 0x1E /* darwin AF_INET6 */
+	afInet6Linux = 0x0A
+)
+
+var (
+	ErrNetworkAddress = errors.New("unsupported network address")
+)
+
+// IP decodes `NetworkAddress`, a raw sockaddr_in or sockaddr_in6 as
+// reported by usbmuxd, in the BSD layout of Apple's daemon or the Linux
+// one without `sa_len`, AF_INET6 being 0x1E or 10 respectively
+func (this *NetworkDevice) IP() (net.IP, error) {
+	addr := this.NetworkAddress
+	if len(addr) < 2 {
+		return nil, ErrNetworkAddress
+	}
+
+	family := addr[1]
+	if family == 0 {
+		/* linux, the family is a little endian uint16 where BSD has len and family */
+		family = addr[0]
+	}
+
+	switch family {
+	case afInet:
+		/* len family port[2] addr[4] */
+		if len(addr) < 8 {
+			return nil, ErrNetworkAddress
+		}
+		return net.IPv4(addr[4], addr[5], addr[6], addr[7]), nil
+	case afInet6, afInet6Linux:
+		/* len family port[2] flowinfo[4] addr[16] scope[4] */
+		if len(addr) < 24 {
+			return nil, ErrNetworkAddress
+		}
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, addr[8:24])
+		return ip, nil
+	}
+
+	return nil, ErrNetworkAddress
+}
+
+// NewNetworkDevice describes a device reachable at ip without usbmuxd
+func NewNetworkDevice(udid string, ip net.IP) *NetworkDevice {
+	var addr []byte
+	if ip4 := ip.To4(); ip4 != nil {
+		addr = make([]byte, 16)
+		addr[0] = 16
+		addr[1] = afInet
+		copy(addr[4:], ip4)
+	} else {
+		addr = make([]byte, 28)
+		addr[0] = 28
+		addr[1] = afInet6
+		copy(addr[8:], ip.To16())
+	}
+
+	return &NetworkDevice{
+		DeviceModel: DeviceModel{
+			ConnectionType: "Network",
+			SerialNumber:   udid,
+		},
+		NetworkAddress: addr,
+	}
+}
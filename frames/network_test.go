@@ -0,0 +1,58 @@
+package frames
+
+import (
+	"net"
+	"testing"
+)
+
+func TestNetworkDeviceIP(t *testing.T) {
+	tests := []struct {
+		name string
+		addr []byte
+		ip   net.IP
+	}{
+		{"darwin inet", []byte{16, 0x02, 0xf2, 0x7e, 192, 168, 1, 20, 0, 0, 0, 0, 0, 0, 0, 0}, net.IPv4(192, 168, 1, 20)},
+		{"linux inet", []byte{0x02, 0x00, 0xf2, 0x7e, 10, 0, 0, 7, 0, 0, 0, 0, 0, 0, 0, 0}, net.IPv4(10, 0, 0, 7)},
+		{"darwin inet6", append([]byte{28, 0x1e, 0xf2, 0x7e, 0, 0, 0, 0,
+			0xfe, 0x80, 0, 0, 0, 0, 0, 0, 0x10, 0x2c, 0x3a, 0xff, 0xfe, 0x4b, 0x5c, 0x6d}, 4, 0, 0, 0), net.ParseIP("fe80::102c:3aff:fe4b:5c6d")},
+		{"linux inet6", append([]byte{0x0a, 0x00, 0xf2, 0x7e, 0, 0, 0, 0,
+			0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}, 0, 0, 0, 0), net.ParseIP("2001:db8::1")},
+		{"bsd len with linux family", append([]byte{28, 0x0a, 0xf2, 0x7e, 0, 0, 0, 0,
+			0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2}, 0, 0, 0, 0), net.ParseIP("2001:db8::2")},
+	}
+
+	for _, test := range tests {
+		d := &NetworkDevice{NetworkAddress: test.addr}
+		ip, err := d.IP()
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if !ip.Equal(test.ip) {
+			t.Errorf("%s: IP() = %s, want %s", test.name, ip, test.ip)
+		}
+	}
+}
+
+func TestNetworkDeviceIPInvalid(t *testing.T) {
+	for _, addr := range [][]byte{
+		nil,
+		{16},
+		{16, 0x02, 0, 0, 192, 168},
+		{28, 0x1e, 0, 0, 0, 0, 0, 0, 0xfe, 0x80},
+		{16, 0x07, 0, 0, 1, 2, 3, 4},
+	} {
+		d := &NetworkDevice{NetworkAddress: addr}
+		if ip, err := d.IP(); err != ErrNetworkAddress {
+			t.Errorf("IP(% x) = %v, %v, want ErrNetworkAddress", addr, ip, err)
+		}
+	}
+}
+
+func TestNewNetworkDevice(t *testing.T) {
+	for _, s := range []string{"192.168.1.20", "fe80::1", "2001:db8::1"} {
+		ip := net.ParseIP(s)
+		d := NewNetworkDevice("udid", ip)
+		if got, err := d.IP(); err != nil || !got.Equal(ip) {
+			t.Errorf("NewNetworkDevice(%s).IP() = %v, %v", s, got, err)
+		}
+	}
+}
@@ -9,24 +9,88 @@ import (
 	"howett.net/plist"
 )
 
+var (
+	ErrFrameTruncated = errors.New("frame shorter than its header")
+	ErrFrameLength    = errors.New("frame length does not match its header")
+	ErrFrameTooLarge  = errors.New("frame exceeds the maximum size")
+)
+
+const (
+	// usbmuxd header, length version type tag
+	PackageHeaderSize = 16
+	// lockdown service header, big endian length
+	ServicePackageHeaderSize = 4
+)
+
+var (
+	// MaxPackageSize bounds a usbmuxd frame, header included
+	MaxPackageSize uint32 = 16 << 20
+	// MaxServicePackageSize bounds a lockdown service plist, screenshots included
+	MaxServicePackageSize uint32 = 256 << 20
+)
+
+// FrameError tells which frame failed to decode and why, compare the
+// reason with `errors.Is` against the `ErrFrame` values
+type FrameError struct {
+	Frame  string
+	Length uint64
+	Err    error
+}
+
+func (this *FrameError) Error() string {
+	return fmt.Sprintf("%s frame of %d bytes: %s", this.Frame, this.Length, this.Err)
+}
+
+func (this *FrameError) Unwrap() error {
+	return this.Err
+}
+
+// CheckPackageLength validates the length field of a usbmuxd header
+func CheckPackageLength(length uint32) error {
+	if length < PackageHeaderSize {
+		return &FrameError{Frame: "usbmuxd", Length: uint64(length), Err: ErrFrameTruncated}
+	}
+	if length > MaxPackageSize {
+		return &FrameError{Frame: "usbmuxd", Length: uint64(length), Err: ErrFrameTooLarge}
+	}
+	return nil
+}
+
+// CheckServicePackageLength validates the body length of a lockdown service header
+func CheckServicePackageLength(length uint32) error {
+	if length > MaxServicePackageSize {
+		return &FrameError{Frame: "lockdown", Length: uint64(length), Err: ErrFrameTooLarge}
+	}
+	return nil
+}
+
 type ServicePackage struct {
 	Length uint32
 	Body   []byte
 }
 
 func (this *ServicePackage) Pack(body interface{}, format int) ([]byte, error) {
-	frameXml, err := plist.MarshalIndent(body, format, "\t")
-	if err != nil {
+	var buf bytes.Buffer
+	if err := this.PackTo(&buf, body, format); err != nil {
 		return nil, err
 	}
+	return buf.Bytes(), nil
+}
 
-	var buf bytes.Buffer
-	l := make([]byte, 4)
-	binary.BigEndian.PutUint32(l, uint32(len(frameXml)))
-	buf.Write(l)
-	buf.Write(frameXml)
+// PackTo appends the frame to buf, so callers can reuse their buffers
+func (this *ServicePackage) PackTo(buf *bytes.Buffer, body interface{}, format int) error {
+	start := buf.Len()
+	buf.Write(make([]byte, ServicePackageHeaderSize))
 
-	return buf.Bytes(), nil
+	encoder := plist.NewEncoderForFormat(buf, format)
+	encoder.Indent("\t")
+	if err := encoder.Encode(body); err != nil {
+		buf.Truncate(start)
+		return err
+	}
+
+	binary.BigEndian.PutUint32(buf.Bytes()[start:], uint32(buf.Len()-start-ServicePackageHeaderSize))
+	return nil
 }
 
 func (this *ServicePackage) UnmarshalBody(pkg interface{}) error {
@@ -39,10 +103,17 @@ func (this *ServicePackage) String() string {
 }
 
 func UnpackLockdown(rawBytes []byte) (*ServicePackage, error) {
+	if len(rawBytes) < ServicePackageHeaderSize {
+		return nil, &FrameError{Frame: "lockdown", Length: uint64(len(rawBytes)), Err: ErrFrameTruncated}
+	}
+
 	pkg := &ServicePackage{}
 	pkg.Length = binary.BigEndian.Uint32(rawBytes[:4])
+	if err := CheckServicePackageLength(pkg.Length); err != nil {
+		return nil, err
+	}
 	if len(rawBytes[4:]) != int(pkg.Length) {
-		return nil, errors.New("buffer not enough")
+		return nil, &FrameError{Frame: "lockdown", Length: uint64(len(rawBytes)), Err: ErrFrameLength}
 	}
 	pkg.Body = rawBytes[4:]
 	return pkg, nil
@@ -57,25 +128,31 @@ type Package struct {
 }
 
 func (this *Package) Pack(body interface{}) ([]byte, error) {
-	frameXml, err := plist.MarshalIndent(body, plist.XMLFormat, "\t")
-	if err != nil {
+	var buf bytes.Buffer
+	if err := this.PackTo(&buf, body); err != nil {
 		return nil, err
 	}
+	return buf.Bytes(), nil
+}
 
-	var buf bytes.Buffer
+// PackTo appends the frame to buf, so callers can reuse their buffers
+func (this *Package) PackTo(buf *bytes.Buffer, body interface{}) error {
+	start := buf.Len()
+	buf.Write(make([]byte, PackageHeaderSize))
 
-	l := make([]byte, 4)
-	binary.LittleEndian.PutUint32(l, uint32(len(frameXml)+16))
-	buf.Write(l)
-	binary.LittleEndian.PutUint32(l, this.Version)
-	buf.Write(l)
-	binary.LittleEndian.PutUint32(l, this.Type) // xml plist
-	buf.Write(l)
-	binary.LittleEndian.PutUint32(l, this.Tag) // pkg len
-	buf.Write(l)
-	buf.Write(frameXml)
+	encoder := plist.NewEncoderForFormat(buf, plist.XMLFormat)
+	encoder.Indent("\t")
+	if err := encoder.Encode(body); err != nil {
+		buf.Truncate(start)
+		return err
+	}
 
-	return buf.Bytes(), nil
+	header := buf.Bytes()[start:]
+	binary.LittleEndian.PutUint32(header[0:], uint32(buf.Len()-start))
+	binary.LittleEndian.PutUint32(header[4:], this.Version)
+	binary.LittleEndian.PutUint32(header[8:], this.Type) // xml plist
+	binary.LittleEndian.PutUint32(header[12:], this.Tag)
+	return nil
 }
 
 func (this *Package) String() string {
@@ -90,10 +167,17 @@ func (this *Package) UnmarshalBody(pkg interface{}) error {
 }
 
 func Unpack(rawBytes []byte) (*Package, error) {
+	if len(rawBytes) < PackageHeaderSize {
+		return nil, &FrameError{Frame: "usbmuxd", Length: uint64(len(rawBytes)), Err: ErrFrameTruncated}
+	}
+
 	pkg := &Package{}
 	pkg.Length = binary.LittleEndian.Uint32(rawBytes[:4])
+	if err := CheckPackageLength(pkg.Length); err != nil {
+		return nil, err
+	}
 	if len(rawBytes) != int(pkg.Length) {
-		return nil, errors.New("buffer not enough")
+		return nil, &FrameError{Frame: "usbmuxd", Length: uint64(len(rawBytes)), Err: ErrFrameLength}
 	}
 	pkg.Version = binary.LittleEndian.Uint32(rawBytes[4:8])
 	pkg.Type = binary.LittleEndian.Uint32(rawBytes[8:12])
@@ -0,0 +1,119 @@
+//go:build go1.18
+// +build go1.18
+
+package frames
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// seedBodies are plist messages as usbmuxd and lockdown send them
+func seedBodies(f *testing.F) [][]byte {
+	files, err := filepath.Glob(filepath.Join("testdata", "*.plist"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	var bodies [][]byte
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			f.Fatal(err)
+		}
+		bodies = append(bodies, b)
+	}
+	return bodies
+}
+
+func usbmuxdFrame(version, message, tag uint32, body []byte) []byte {
+	var buf bytes.Buffer
+	pkg := &Package{Version: version, Type: message, Tag: tag}
+	pkg.PackBinaryTo(&buf, body)
+	return buf.Bytes()
+}
+
+func FuzzUnpack(f *testing.F) {
+	for _, body := range seedBodies(f) {
+		raw := usbmuxdFrame(1, PlistMessage, 0, body)
+		f.Add(raw)
+		f.Add(raw[:len(raw)-1])
+	}
+	f.Add(usbmuxdFrame(BinaryVersion, BinaryResult, 3, PackBinaryResult(0)))
+	f.Add(usbmuxdFrame(BinaryVersion, BinaryDeviceAdd, 0, PackBinaryDevice(&USBDevice{
+		DeviceModel: DeviceModel{DeviceID: 3, SerialNumber: "00008030001A2D3C0E62802E"},
+		ProductID:   0x12a8,
+		LocationID:  0x14100000,
+	})))
+	f.Add(usbmuxdFrame(BinaryVersion, BinaryDeviceRemove, 0, PackBinaryDeviceRemove(3)))
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 1, 0, 0, 0, 8, 0, 0, 0, 0, 0, 0, 0})
+
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		pkg, err := Unpack(raw)
+		if err != nil {
+			if pkg != nil {
+				t.Fatal("package with an error")
+			}
+			return
+		}
+		if int(pkg.Length) != len(raw) || !bytes.Equal(pkg.Body, raw[PackageHeaderSize:]) {
+			t.Fatalf("length %d body %d of a %d byte frame", pkg.Length, len(pkg.Body), len(raw))
+		}
+
+		if !pkg.IsBinary() {
+			var m map[string]interface{}
+			if pkg.UnmarshalBody(&m) != nil {
+				return
+			}
+			/* what decodes packs again into a frame that decodes */
+			again, err := pkg.Pack(m)
+			if err != nil {
+				return
+			}
+			if _, err := Unpack(again); err != nil {
+				t.Fatalf("repacked frame: %v", err)
+			}
+			return
+		}
+
+		switch pkg.Type {
+		case BinaryResult:
+			_, _ = UnpackBinaryResult(pkg.Body)
+		case BinaryConnect:
+			_, _, _ = UnpackBinaryConnect(pkg.Body)
+		case BinaryDeviceAdd:
+			if d, err := UnpackBinaryDevice(pkg.Body); err == nil && d == nil {
+				t.Fatal("nil device without an error")
+			}
+		case BinaryDeviceRemove:
+			_, _ = UnpackBinaryDeviceRemove(pkg.Body)
+		}
+	})
+}
+
+func FuzzUnpackLockdown(f *testing.F) {
+	for _, body := range seedBodies(f) {
+		raw := make([]byte, ServicePackageHeaderSize, ServicePackageHeaderSize+len(body))
+		binary.BigEndian.PutUint32(raw, uint32(len(body)))
+		raw = append(raw, body...)
+		f.Add(raw)
+		f.Add(raw[:len(raw)/2])
+	}
+	f.Add([]byte{0, 0, 0, 0})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		pkg, err := UnpackLockdown(raw)
+		if err != nil {
+			return
+		}
+		if int(pkg.Length) != len(pkg.Body) || len(pkg.Body)+ServicePackageHeaderSize != len(raw) {
+			t.Fatalf("length %d body %d of a %d byte frame", pkg.Length, len(pkg.Body), len(raw))
+		}
+		if CheckServicePackageLength(pkg.Length) != nil {
+			t.Fatalf("accepted length %d", pkg.Length)
+		}
+	})
+}
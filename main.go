@@ -1,10 +1,14 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"iconsole/frames"
+	"iconsole/services"
 	"iconsole/tunnel"
+	"net"
 	"os"
+	"time"
 
 	"github.com/urfave/cli"
 )
@@ -18,20 +22,118 @@ var globalFlags = []cli.Flag{
 	},
 }
 
+var appFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:   "socket",
+		Usage:  "usbmuxd `ADDRESS` as UNIX:/path or host:port",
+		EnvVar: tunnel.SocketAddressEnv,
+		Value:  "",
+	},
+	cli.StringFlag{
+		Name:   "pair-records",
+		Usage:  "Keep pair records as <UDID>.plist in `DIR` instead of usbmuxd",
+		EnvVar: "PAIR_RECORD_DIR",
+		Value:  "",
+	},
+	cli.StringFlag{
+		Name:   "address",
+		Usage:  "Reach the device given by --UDID at `IP` over Wi-Fi, without usbmuxd",
+		EnvVar: "DEVICE_ADDRESS",
+		Value:  "",
+	},
+	cli.StringFlag{
+		Name:  "trace",
+		Usage: "Record every frame on the wire to `FILE` as JSON lines",
+		Value: "",
+	},
+	cli.BoolFlag{
+		Name:  "verbose, v",
+		Usage: "Log every usbmuxd, lockdown, TLS and service step to stderr",
+	},
+}
+
+var traceFile *os.File
+
+/* set by --address */
+var deviceAddress net.IP
+
+func beforeAction(ctx *cli.Context) error {
+	if ctx.GlobalBool("verbose") {
+		tunnel.DefaultLogger = tunnel.NewWriterLogger(os.Stderr, tunnel.LogDebug)
+	}
+	if s := ctx.GlobalString("socket"); s != "" {
+		if err := tunnel.SetSocketAddress(s); err != nil {
+			return err
+		}
+	}
+	if dir := ctx.GlobalString("pair-records"); dir != "" {
+		tunnel.DefaultPairRecordStore = tunnel.NewDirectoryPairRecordStore(dir)
+	}
+	services.DefaultSessionPool.PairOptions = trustDialogOptions(time.Minute)
+	if s := ctx.GlobalString("address"); s != "" {
+		if deviceAddress = net.ParseIP(s); deviceAddress == nil {
+			return fmt.Errorf("invalid device address %s", s)
+		}
+		services.DefaultSessionPool.Dial = tunnel.NetworkLockdownDialer(nil)
+	}
+	if name := ctx.GlobalString("trace"); name != "" {
+		/* the trace may hold device secrets */
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		traceFile = f
+		tunnel.DefaultTracer = tunnel.NewJSONTracer(f)
+	}
+	return nil
+}
+
+func afterAction(ctx *cli.Context) error {
+	/* stop the lockdown sessions while the trace is still open */
+	_ = services.DefaultSessionPool.Close()
+
+	if traceFile != nil {
+		tunnel.DefaultTracer = nil
+		return traceFile.Close()
+	}
+	return nil
+}
+
+// trustDialogOptions tells the user what the device is waiting for
+func trustDialogOptions(timeout time.Duration) *tunnel.PairOptions {
+	var last error
+	return &tunnel.PairOptions{
+		Timeout: timeout,
+		Progress: func(err error, remaining time.Duration) {
+			if errors.Is(err, last) {
+				return
+			}
+			last = err
+			if errors.Is(err, tunnel.ErrPasswordProtected) {
+				fmt.Println("Please unlock the device with its passcode")
+			} else {
+				fmt.Printf("Please tap `Trust` on the device, waiting %s\n", remaining.Round(time.Second))
+			}
+		},
+	}
+}
+
 func session(udid string, cb func(*tunnel.LockdownConnection) error) error {
 	device, err := getDevice(udid)
 	if err != nil {
 		return err
 	}
 
-	conn, err := tunnel.LockdownDial(device)
+	conn, err := lockdownDial(device)
 	if err != nil {
 		return err
 	}
 
 	defer conn.Close()
 
-	if err := conn.StartSession(); err != nil {
+	conn.PairOptions = trustDialogOptions(time.Minute)
+
+	if err := conn.StartSession(tunnel.DefaultPairRecordStore); err != nil {
 		return err
 	}
 
@@ -40,7 +142,22 @@ func session(udid string, cb func(*tunnel.LockdownConnection) error) error {
 	return cb(conn)
 }
 
+// lockdownDial connects to lockdown the way services are reached
+func lockdownDial(device frames.Device) (*tunnel.LockdownConnection, error) {
+	if dial := services.DefaultSessionPool.Dial; dial != nil {
+		return dial(device)
+	}
+	return tunnel.LockdownDial(device)
+}
+
 func getDevice(udid string) (frames.Device, error) {
+	if deviceAddress != nil {
+		if udid == "" {
+			return nil, errors.New("--address needs the device --UDID")
+		}
+		return frames.NewNetworkDevice(udid, deviceAddress), nil
+	}
+
 	devices, err := tunnel.Devices()
 	if err != nil {
 		return nil, err
@@ -66,20 +183,28 @@ func getDevice(udid string) (frames.Device, error) {
 		return ds[0], nil
 	}
 
-	return nil, fmt.Errorf("device %s was not found", udid)
+	return nil, &tunnel.UsbmuxdError{Code: tunnel.ResultBadDev, Device: udid}
 }
 
-func main() {
+func newApp() *cli.App {
 	app := cli.NewApp()
 	app.Name = "iConsole"
 	app.Usage = "iOS device tools"
 	app.Version = "1.0.0"
+	/* -v is verbose */
+	cli.VersionFlag = cli.BoolFlag{
+		Name:  "version, V",
+		Usage: "print the version",
+	}
 	app.Authors = []cli.Author{
 		{
 			Name:  "anonymous5l",
 			Email: "wxdxfg@hotmail.com",
 		},
 	}
+	app.Flags = appFlags
+	app.Before = beforeAction
+	app.After = afterAction
 	app.Commands = []cli.Command{
 		initDevices(),
 		initSyslogCommond(),
@@ -92,9 +217,14 @@ func main() {
 		initAFCCommand(),
 		initArrest(),
 		initProcessCommond(),
+		initPairCommand(),
+		initReplayCommand(),
 	}
+	return app
+}
 
-	if err := app.Run(os.Args); err != nil {
+func main() {
+	if err := newApp().Run(os.Args); err != nil {
 		fmt.Println(err.Error())
 		return
 	}
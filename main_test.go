@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"iconsole/frames"
+	"iconsole/tunnel"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestGetDeviceAddress(t *testing.T) {
+	deviceAddress = net.IPv4(192, 168, 1, 20)
+	defer func() { deviceAddress = nil }()
+
+	if _, err := getDevice(""); err == nil {
+		t.Error("--address without a UDID accepted")
+	}
+
+	device, err := getDevice("fedcba9876543210")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, ok := device.(*frames.NetworkDevice)
+	if !ok || d.SerialNumber != "fedcba9876543210" {
+		t.Fatalf("device %#v, want a network device", device)
+	}
+	if ip, err := d.IP(); err != nil || !ip.Equal(deviceAddress) {
+		t.Errorf("device IP %v, %v", ip, err)
+	}
+}
+
+func TestVerboseFlag(t *testing.T) {
+	defer func() { tunnel.DefaultLogger = nil }()
+
+	var out bytes.Buffer
+	app := newApp()
+	app.Writer = &out
+	if err := app.Run([]string{"iconsole", "-V"}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "1.0.0") || tunnel.DefaultLogger != nil {
+		t.Errorf("-V printed %q, logger %v", out.String(), tunnel.DefaultLogger)
+	}
+
+	out.Reset()
+	app = newApp()
+	app.Writer = &out
+	if err := app.Run([]string{"iconsole", "-v", "help"}); err != nil {
+		t.Fatal(err)
+	}
+	if tunnel.DefaultLogger == nil {
+		t.Error("-v did not turn on logging")
+	}
+	for _, flag := range []string{"--verbose, -v", "--version, -V"} {
+		if !strings.Contains(out.String(), flag) {
+			t.Errorf("help lacks %s:\n%s", flag, out.String())
+		}
+	}
+}
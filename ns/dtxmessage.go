@@ -7,6 +7,12 @@ import (
 	"fmt"
 )
 
+var (
+	// ErrUnknownAuxiliaryType is an entry no length is known of, the
+	// rest of the message can't be read
+	ErrUnknownAuxiliaryType = errors.New("unknown DTX auxiliary type")
+)
+
 type DTXMessage struct {
 	msgbuf *bytes.Buffer
 }
@@ -124,13 +130,10 @@ func UnmarshalDTXMessage(b []byte) ([]interface{}, error) {
 			}
 			ret = append(ret, i)
 		case 10:
-			// debug
-			fmt.Println("Dictionary key!")
+			/* dictionary key marker, the value follows as its own entry */
 			continue
 		default:
-			// debug
-			fmt.Printf("Unknow type %d\n", typ)
-			break
+			return nil, fmt.Errorf("%w %d", ErrUnknownAuxiliaryType, typ)
 		}
 	}
 
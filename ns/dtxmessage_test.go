@@ -0,0 +1,61 @@
+package ns
+
+import (
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// auxiliary wraps a message body in the header the device answers with
+func auxiliary(m *DTXMessage) []byte {
+	b := m.ToBytes()
+	binary.LittleEndian.PutUint64(b, 0x1df0)
+	return b
+}
+
+func TestUnmarshalDTXMessage(t *testing.T) {
+	m := NewDTXMessage()
+	m.AppendInt32(-7)
+	m.AppendInt64(1 << 40)
+	if err := m.AppendObject("com.apple.instruments.server.services.deviceinfo"); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := UnmarshalDTXMessage(auxiliary(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []interface{}{int32(-7), int64(1 << 40), "com.apple.instruments.server.services.deviceinfo"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("UnmarshalDTXMessage = %#v, want %#v", got, want)
+	}
+}
+
+func TestUnmarshalDTXMessageUnknownType(t *testing.T) {
+	m := NewDTXMessage()
+	m.AppendInt32(1)
+	/* an entry of a type nobody knows the length of */
+	m.AppendUInt32(10)
+	m.AppendUInt32(99)
+	m.AppendUInt64(0xdeadbeef)
+	m.AppendInt32(2)
+
+	if got, err := UnmarshalDTXMessage(auxiliary(m)); !errors.Is(err, ErrUnknownAuxiliaryType) {
+		t.Errorf("UnmarshalDTXMessage = %#v, %v, want ErrUnknownAuxiliaryType", got, err)
+	}
+}
+
+func TestUnmarshalDTXMessageShort(t *testing.T) {
+	m := NewDTXMessage()
+	m.AppendInt64(5)
+	b := auxiliary(m)
+
+	if _, err := UnmarshalDTXMessage(b[:len(b)-3]); err == nil {
+		t.Error("truncated message decoded")
+	}
+	binary.LittleEndian.PutUint64(b, 0x1f0)
+	if _, err := UnmarshalDTXMessage(b); err == nil {
+		t.Error("bad magic decoded")
+	}
+}
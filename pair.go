@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"iconsole/frames"
+	"iconsole/tunnel"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/urfave/cli"
+	"howett.net/plist"
+)
+
+func pairAction(ctx *cli.Context) error {
+	udid := ctx.String("UDID")
+	timeout := ctx.Duration("timeout")
+
+	device, err := getDevice(udid)
+	if err != nil {
+		return err
+	}
+
+	conn, err := lockdownDial(device)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.PairOptions = trustDialogOptions(timeout)
+
+	record, err := conn.Pair()
+	if err != nil {
+		return err
+	}
+
+	if err := tunnel.DefaultPairRecordStore.SavePairRecord(device, record); err != nil {
+		return err
+	}
+
+	fmt.Printf("Paired with device %s\n", device.GetSerialNumber())
+	return nil
+}
+
+func unpairAction(ctx *cli.Context) error {
+	udid := ctx.String("UDID")
+
+	device, err := getDevice(udid)
+	if err != nil {
+		return err
+	}
+
+	record, err := tunnel.DefaultPairRecordStore.ReadPairRecord(device)
+	if err != nil {
+		return err
+	}
+
+	conn, err := lockdownDial(device)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.Unpair(record); err != nil {
+		return err
+	}
+
+	if err := tunnel.DefaultPairRecordStore.DeletePairRecord(device); err != nil {
+		return err
+	}
+
+	fmt.Printf("Unpaired device %s\n", device.GetSerialNumber())
+	return nil
+}
+
+func validatePairAction(ctx *cli.Context) error {
+	udid := ctx.String("UDID")
+
+	device, err := getDevice(udid)
+	if err != nil {
+		return err
+	}
+
+	record, err := tunnel.DefaultPairRecordStore.ReadPairRecord(device)
+	if err != nil {
+		return err
+	}
+
+	conn, err := lockdownDial(device)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.ValidatePair(record); err != nil {
+		return err
+	}
+
+	fmt.Printf("Device %s pairing is valid\n", device.GetSerialNumber())
+	return nil
+}
+
+func listPairAction(ctx *cli.Context) error {
+	devices, err := tunnel.Devices()
+	if err != nil {
+		/* records on disk are listed without usbmuxd */
+		if _, ok := tunnel.DefaultPairRecordStore.(tunnel.PairRecordLister); !ok {
+			return err
+		}
+		devices = nil
+	}
+
+	return listPairs(os.Stdout, tunnel.DefaultPairRecordStore, devices)
+}
+
+// listPairs prints the records of the connected devices, then the other
+// records the store holds
+func listPairs(w io.Writer, store tunnel.PairRecordStore, devices []frames.Device) error {
+	listed := make(map[string]bool)
+	for _, d := range devices {
+		listed[d.GetSerialNumber()] = true
+		record, err := store.ReadPairRecord(d)
+		if err != nil {
+			fmt.Fprintf(w, "%s\n\tConnectionType: %s\n\tNot paired: %s\n", d.GetSerialNumber(), d.GetConnectionType(), err)
+			continue
+		}
+		fmt.Fprintf(w, "%s\n\tConnectionType: %s\n\tHostID: %s\n\tSystemBUID: %s\n", d.GetSerialNumber(), d.GetConnectionType(), record.HostID, record.SystemBUID)
+	}
+
+	lister, ok := store.(tunnel.PairRecordLister)
+	if !ok {
+		return nil
+	}
+	udids, err := lister.PairRecordUDIDs()
+	if err != nil {
+		return err
+	}
+	for _, udid := range udids {
+		if listed[udid] {
+			continue
+		}
+		record, err := store.ReadPairRecord(&frames.USBDevice{DeviceModel: frames.DeviceModel{SerialNumber: udid}})
+		if err != nil {
+			fmt.Fprintf(w, "%s\n\tConnectionType: offline\n\tUnreadable: %s\n", udid, err)
+			continue
+		}
+		fmt.Fprintf(w, "%s\n\tConnectionType: offline\n\tHostID: %s\n\tSystemBUID: %s\n", udid, record.HostID, record.SystemBUID)
+	}
+	return nil
+}
+
+func exportPairAction(ctx *cli.Context) error {
+	udid := ctx.String("UDID")
+
+	args := ctx.Args()
+	if len(args) != 1 {
+		return cli.ShowSubcommandHelp(ctx)
+	}
+
+	device, err := getDevice(udid)
+	if err != nil {
+		return err
+	}
+
+	record, err := tunnel.DefaultPairRecordStore.ReadPairRecord(device)
+	if err != nil {
+		return err
+	}
+
+	data, err := plist.MarshalIndent(record, plist.XMLFormat, "\t")
+	if err != nil {
+		return err
+	}
+
+	/* contains the host private keys */
+	return ioutil.WriteFile(args[0], data, 0600)
+}
+
+func importPairAction(ctx *cli.Context) error {
+	udid := ctx.String("UDID")
+
+	args := ctx.Args()
+	if len(args) != 1 {
+		return cli.ShowSubcommandHelp(ctx)
+	}
+
+	record, err := tunnel.ReadPairRecordFile(args[0])
+	if err != nil {
+		return err
+	}
+
+	device, err := getDevice(udid)
+	if err != nil {
+		return err
+	}
+
+	return tunnel.DefaultPairRecordStore.SavePairRecord(device, record)
+}
+
+func initPairCommand() cli.Command {
+	return cli.Command{
+		Name:      "pair",
+		Usage:     "Manage host pairing with a device",
+		UsageText: "iconsole pair [-u serial_number|udid] [--timeout 1m]",
+		Action:    pairAction,
+		Flags: append(globalFlags, cli.DurationFlag{
+			Name:  "timeout, t",
+			Usage: "How long to wait for the trust dialog",
+			Value: time.Minute,
+		}),
+		Subcommands: []cli.Command{
+			{
+				Name:   "unpair",
+				Usage:  "Remove this host from the device and delete the pair record",
+				Action: unpairAction,
+				Flags:  globalFlags,
+			},
+			{
+				Name:   "validate",
+				Usage:  "Check the pair record is still trusted by the device",
+				Action: validatePairAction,
+				Flags:  globalFlags,
+			},
+			{
+				Name:      "list",
+				ShortName: "l",
+				Usage:     "List pair records of the connected devices and the others in --pair-records",
+				Action:    listPairAction,
+			},
+			{
+				Name:   "export",
+				Usage:  "export <pair record file>",
+				Action: exportPairAction,
+				Flags:  globalFlags,
+			},
+			{
+				Name:   "import",
+				Usage:  "import <pair record file>",
+				Action: importPairAction,
+				Flags:  globalFlags,
+			},
+		},
+	}
+}
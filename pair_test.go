@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"iconsole/frames"
+	"iconsole/tunnel"
+	"iconsole/tunnel/muxtest"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// startDevice points the commands at a muxtest usbmuxd with one device
+// whose lockdown is served by the returned stand-in
+func startDevice(t *testing.T) (*frames.USBDevice, *muxtest.Lockdown, func()) {
+	t.Helper()
+
+	server, err := muxtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	device := &frames.USBDevice{DeviceModel: frames.DeviceModel{ConnectionType: "USB", DeviceID: 1, SerialNumber: "0123456789abcdef"}}
+	server.Attach(device)
+	lockdown := muxtest.NewLockdown()
+	_ = server.Handle(device.DeviceID, tunnel.LockdownPort, lockdown.Serve)
+
+	old := tunnel.SocketAddress()
+	store := tunnel.DefaultPairRecordStore
+	if err := tunnel.SetSocketAddress(server.Address()); err != nil {
+		t.Fatal(err)
+	}
+	return device, lockdown, func() {
+		tunnel.DefaultPairRecordStore = store
+		_ = tunnel.SetSocketAddress(old)
+		_ = server.Close()
+	}
+}
+
+func run(args ...string) error {
+	return newApp().Run(append([]string{"iconsole"}, args...))
+}
+
+func TestPairCommands(t *testing.T) {
+	device, lockdown, done := startDevice(t)
+	defer done()
+
+	dir, err := ioutil.TempDir("", "pair")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	records := filepath.Join(dir, "lockdown")
+	recordFile := filepath.Join(records, device.SerialNumber+".plist")
+
+	/* the first attempt waits for the trust dialog */
+	lockdown.FailPair("PairingDialogResponsePending")
+	if err := run("--pair-records", records, "pair", "-u", device.SerialNumber, "--timeout", "10s"); err != nil {
+		t.Fatal(err)
+	}
+	record, err := tunnel.ReadPairRecordFile(recordFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !lockdown.Trusted(record.HostID) {
+		t.Errorf("device does not trust the saved host id %s", record.HostID)
+	}
+
+	if err := run("--pair-records", records, "pair", "validate", "-u", device.SerialNumber); err != nil {
+		t.Errorf("validate: %v", err)
+	}
+
+	exported := filepath.Join(dir, "exported.plist")
+	if err := run("--pair-records", records, "pair", "export", "-u", device.SerialNumber, exported); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(exported); err != nil || info.Mode().Perm()&0077 != 0 {
+		t.Errorf("exported record %v, %v", info, err)
+	}
+
+	if err := run("--pair-records", records, "pair", "unpair", "-u", device.SerialNumber); err != nil {
+		t.Fatal(err)
+	}
+	if lockdown.Trusted(record.HostID) {
+		t.Error("device still trusts the host after unpair")
+	}
+	if _, err := os.Stat(recordFile); !os.IsNotExist(err) {
+		t.Errorf("record left after unpair: %v", err)
+	}
+	if err := run("--pair-records", records, "pair", "validate", "-u", device.SerialNumber); !errors.Is(err, tunnel.ErrPairRecordNotFound) {
+		t.Errorf("validate without a record = %v", err)
+	}
+
+	if err := run("--pair-records", records, "pair", "import", "-u", device.SerialNumber, exported); err != nil {
+		t.Fatal(err)
+	}
+	if imported, err := tunnel.ReadPairRecordFile(recordFile); err != nil || imported.HostID != record.HostID {
+		t.Errorf("imported record %+v, %v", imported, err)
+	}
+	/* the device forgot the host on unpair */
+	if err := run("--pair-records", records, "pair", "validate", "-u", device.SerialNumber); !errors.Is(err, tunnel.ErrInvalidHostID) {
+		t.Errorf("validate of an unpaired host = %v, want ErrInvalidHostID", err)
+	}
+
+	if lockdown.LeakedKeys() {
+		t.Error("a private key of the host was sent to the device")
+	}
+}
+
+func TestListPairs(t *testing.T) {
+	store := tunnel.NewMemoryPairRecordStore()
+	connected := &frames.USBDevice{DeviceModel: frames.DeviceModel{ConnectionType: "USB", DeviceID: 1, SerialNumber: "connected"}}
+	unpaired := &frames.USBDevice{DeviceModel: frames.DeviceModel{ConnectionType: "USB", DeviceID: 2, SerialNumber: "unpaired"}}
+	offline := &frames.USBDevice{DeviceModel: frames.DeviceModel{SerialNumber: "offline"}}
+	for _, d := range []frames.Device{connected, offline} {
+		if err := store.SavePairRecord(d, &frames.PairRecord{HostID: "HOST-" + d.GetSerialNumber(), SystemBUID: "BUID"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out := &bytes.Buffer{}
+	if err := listPairs(out, store, []frames.Device{connected, unpaired}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"connected\n\tConnectionType: USB\n\tHostID: HOST-connected\n",
+		"unpaired\n\tConnectionType: USB\n\tNot paired: ",
+		"offline\n\tConnectionType: offline\n\tHostID: HOST-offline\n",
+	}
+	for _, w := range want {
+		if !strings.Contains(out.String(), w) {
+			t.Errorf("listing lacks %q:\n%s", w, out)
+		}
+	}
+	if strings.Count(out.String(), "HostID: HOST-connected") != 1 {
+		t.Errorf("connected device listed twice:\n%s", out)
+	}
+}
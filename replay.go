@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"iconsole/tunnel/muxtest"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/urfave/cli"
+)
+
+func replayAction(ctx *cli.Context) error {
+	args := ctx.Args()
+	if len(args) != 1 {
+		return cli.ShowSubcommandHelp(ctx)
+	}
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	records, err := muxtest.ReadTrace(f)
+	_ = f.Close()
+	if err != nil {
+		return err
+	}
+
+	replay, err := muxtest.NewReplay(records)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Replaying %s, run commands with\n\t--socket %s\n", args[0], replay.Address())
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	<-sigc
+
+	_ = replay.Close()
+
+	divergences := replay.Divergences()
+	for _, d := range divergences {
+		fmt.Println(d)
+	}
+	fmt.Printf("%d divergence(s), %d recorded connection(s) not played\n", len(divergences), replay.Unplayed())
+
+	if len(divergences) > 0 {
+		return errors.New("replay diverged from the recording")
+	}
+	return nil
+}
+
+func initReplayCommand() cli.Command {
+	return cli.Command{
+		Name:      "replay",
+		Usage:     "Serve a `--trace` recording as a fake usbmuxd until interrupted",
+		UsageText: "iconsole replay <trace file>",
+		Action:    replayAction,
+	}
+}
@@ -2,6 +2,7 @@ package services
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -11,6 +12,7 @@ import (
 	"os"
 	"path"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -18,6 +20,13 @@ var (
 	afcHeader = []byte{0x43, 0x46, 0x41, 0x36, 0x4C, 0x50, 0x41, 0x41}
 )
 
+const (
+	// magic, entire length, this length, packet number, operation
+	afcHeaderSize = 40
+	// bounds what a broken reply can make us allocate
+	afcMaxPacketSize = 1 << 30
+)
+
 const (
 	AFCOperationInvalid              = 0x00000000 /* Invalid */
 	AFCOperationStatus               = 0x00000001 /* Status */
@@ -130,66 +139,6 @@ func getCStr(strs ...string) []byte {
 	return b.Bytes()
 }
 
-func getError(status uint64) error {
-	switch status {
-	case AFCErrUnknownError:
-		return errors.New("UnknownError")
-	case AFCErrOperationHeaderInvalid:
-		return errors.New("OperationHeaderInvalid")
-	case AFCErrNoResources:
-		return errors.New("NoResources")
-	case AFCErrReadError:
-		return errors.New("ReadError")
-	case AFCErrWriteError:
-		return errors.New("WriteError")
-	case AFCErrUnknownPacketType:
-		return errors.New("UnknownPacketType")
-	case AFCErrInvalidArgument:
-		return errors.New("InvalidArgument")
-	case AFCErrObjectNotFound:
-		return errors.New("ObjectNotFound")
-	case AFCErrObjectIsDir:
-		return errors.New("ObjectIsDir")
-	case AFCErrPermDenied:
-		return errors.New("PermDenied")
-	case AFCErrServiceNotConnected:
-		return errors.New("ServiceNotConnected")
-	case AFCErrOperationTimeout:
-		return errors.New("OperationTimeout")
-	case AFCErrTooMuchData:
-		return errors.New("TooMuchData")
-	case AFCErrEndOfData:
-		return errors.New("EndOfData")
-	case AFCErrOperationNotSupported:
-		return errors.New("OperationNotSupported")
-	case AFCErrObjectExists:
-		return errors.New("ObjectExists")
-	case AFCErrObjectBusy:
-		return errors.New("ObjectBusy")
-	case AFCErrNoSpaceLeft:
-		return errors.New("NoSpaceLeft")
-	case AFCErrOperationWouldBlock:
-		return errors.New("OperationWouldBlock")
-	case AFCErrIoError:
-		return errors.New("IoError")
-	case AFCErrOperationInterrupted:
-		return errors.New("OperationInterrupted")
-	case AFCErrOperationInProgress:
-		return errors.New("OperationInProgress")
-	case AFCErrInternalError:
-		return errors.New("InternalError")
-	case AFCErrMuxError:
-		return errors.New("MuxError")
-	case AFCErrNoMemory:
-		return errors.New("NoMemory")
-	case AFCErrNotEnoughData:
-		return errors.New("NotEnoughData")
-	case AFCErrDirNotEmpty:
-		return errors.New("DirNotEmpty")
-	}
-	return nil
-}
-
 type AFCPacket struct {
 	EntireLen uint64
 	ThisLen   uint64
@@ -230,15 +179,51 @@ func (this *AFCPacket) Error() error {
 	if this.Operation == AFCOperationStatus {
 		status := this.Uint64()
 		if status != AFCErrSuccess {
-			return getError(status)
+			return &AFCError{Code: status}
 		}
 	}
 	return nil
 }
 
+// AFCService is safe for concurrent use. Requests are pipelined, a
+// reader goroutine hands every reply to the request with the same packet
+// number, so callers never wait for each other's replies. `Close` may be
+// called any time, pending operations fail with `tunnel.ErrServiceClosed`.
 type AFCService struct {
-	service   *tunnel.Service
+	// Window is how many chunks `AFCFile.ReadFrom` and `AFCFile.WriteTo`
+	// keep in flight, `AFCDefaultWindow` when zero
+	Window int
+	// ChunkSize is the size of those chunks, `AFCDefaultChunkSize` when zero
+	ChunkSize int
+
+	service *tunnel.Service
+
+	/* held while a request goes on the wire, packet numbers are in wire order */
+	writeMutex sync.Mutex
+	packetNum  uint64
+
+	mutex   sync.Mutex
+	pending map[uint64]chan afcReply
+	/* set once the connection broke, every later request fails with it */
+	err        error
+	readerOnce sync.Once
+}
+
+const (
+	AFCDefaultWindow    = 8
+	AFCDefaultChunkSize = 256 << 10
+)
+
+type afcReply struct {
+	packet *AFCPacket
+	err    error
+}
+
+// afcCall is a request on the wire waiting for its reply
+type afcCall struct {
+	operation uint64
 	packetNum uint64
+	reply     chan afcReply
 }
 
 func NewAFCService(device frames.Device) (*AFCService, error) {
@@ -247,87 +232,161 @@ func NewAFCService(device frames.Device) (*AFCService, error) {
 		return nil, err
 	}
 
-	return &AFCService{service: serv}, nil
+	return newAFCService(serv), nil
 }
 
-func (this *AFCService) send(operation uint64, data, payload []byte) error {
-	this.packetNum++
+// NewAFCServiceWith speaks AFC over a service already started, like the
+// one house arrest vends or a stand-in server
+func NewAFCServiceWith(service *tunnel.Service) *AFCService {
+	return newAFCService(service)
+}
 
-	entireLen := uint64(40)
+func newAFCService(service *tunnel.Service) *AFCService {
+	return &AFCService{service: service, pending: make(map[uint64]chan afcReply)}
+}
 
-	if data != nil {
-		entireLen += uint64(len(data))
+// request sends an operation and waits for its reply
+func (this *AFCService) request(operation uint64, data, payload []byte) (*AFCPacket, error) {
+	call, err := this.start(operation, data, payload)
+	if err != nil {
+		return nil, err
 	}
+	return this.wait(call)
+}
 
-	if payload != nil {
-		entireLen += uint64(len(payload))
-	}
+// start puts a request on the wire, `wait` takes its reply
+func (this *AFCService) start(operation uint64, data, payload []byte) (*afcCall, error) {
+	/* the reader must not run before the first request, house arrest
+	   answers its vend command on the same connection */
+	this.readerOnce.Do(func() {
+		go this.reader()
+	})
 
-	tLen := uint64(40)
-	if data != nil {
-		tLen += uint64(len(data))
+	this.writeMutex.Lock()
+	defer this.writeMutex.Unlock()
+
+	this.packetNum++
+	call := &afcCall{operation: operation, packetNum: this.packetNum, reply: make(chan afcReply, 1)}
+
+	this.mutex.Lock()
+	if this.err != nil {
+		this.mutex.Unlock()
+		return nil, this.err
+	}
+	this.pending[call.packetNum] = call.reply
+	this.mutex.Unlock()
+
+	if err := this.send(call.packetNum, operation, data, payload); err != nil {
+		/* a partly written packet leaves the stream out of step */
+		this.fail(err)
+		_ = this.service.Close()
+		this.mutex.Lock()
+		err = this.err
+		this.mutex.Unlock()
+		return nil, err
 	}
+	return call, nil
+}
 
-	buf := bytes.NewBuffer([]byte{})
-	buf.Write(afcHeader)
-	if err := binary.Write(buf, binary.LittleEndian, entireLen); err != nil {
-		return err
+func (this *AFCService) wait(call *afcCall) (*AFCPacket, error) {
+	reply := <-call.reply
+	packet, err := reply.packet, reply.err
+	if err == nil {
+		err = packet.Error()
 	}
-	if err := binary.Write(buf, binary.LittleEndian, tLen); err != nil {
-		return err
+
+	var afcErr *AFCError
+	if errors.As(err, &afcErr) {
+		afcErr.Operation = call.operation
+		afcErr.Service = this.service.Name()
+		afcErr.Device = this.service.UDID()
 	}
-	if err := binary.Write(buf, binary.LittleEndian, this.packetNum); err != nil {
-		return err
+	if err != nil {
+		tunnel.Logf(tunnel.LogDebug, AFCServiceName, "operation %#x packet %d: %s", call.operation, call.packetNum, err)
+		return nil, err
 	}
-	if err := binary.Write(buf, binary.LittleEndian, operation); err != nil {
-		return err
+	tunnel.Logf(tunnel.LogDebug, AFCServiceName, "operation %#x packet %d: reply %#x", call.operation, call.packetNum, packet.Operation)
+	return packet, nil
+}
+
+// reader hands the replies out until the connection breaks
+func (this *AFCService) reader() {
+	for {
+		packet, err := this.recv()
+		if err != nil {
+			this.fail(err)
+			return
+		}
+
+		this.mutex.Lock()
+		reply, ok := this.pending[packet.PacketNum]
+		delete(this.pending, packet.PacketNum)
+		this.mutex.Unlock()
+
+		if !ok {
+			tunnel.Logf(tunnel.LogWarn, AFCServiceName, "reply %#x to unknown packet %d", packet.Operation, packet.PacketNum)
+			continue
+		}
+		reply <- afcReply{packet: packet}
 	}
+}
 
-	if data != nil {
-		buf.Write(data)
+// fail ends every pending request, the first error sticks
+func (this *AFCService) fail(err error) {
+	if this.service.Closed() {
+		err = tunnel.ErrServiceClosed
 	}
 
-	sB := buf.Bytes()
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
 
-	conn := this.service.GetConnection()
+	if this.err == nil {
+		this.err = err
+	}
+	for num, reply := range this.pending {
+		reply <- afcReply{err: this.err}
+		delete(this.pending, num)
+	}
+}
+
+// send must be called with the write mutex held
+func (this *AFCService) send(packetNum uint64, operation uint64, data, payload []byte) error {
+	thisLen := uint64(afcHeaderSize + len(data))
 
-	sent := 0
-	for sent < len(sB) {
-		if n, err := conn.Write(sB[sent:]); err != nil {
+	buf := bytes.NewBuffer(make([]byte, 0, int(thisLen)))
+	buf.Write(afcHeader)
+	for _, v := range []uint64{thisLen + uint64(len(payload)), thisLen, packetNum, operation} {
+		if err := binary.Write(buf, binary.LittleEndian, v); err != nil {
 			return err
-		} else {
-			sent += n
 		}
 	}
+	buf.Write(data)
 
-	sent = 0
-	if payload != nil {
-		for sent < len(payload) {
-			if n, err := conn.Write(payload[sent:]); err != nil {
-				return err
-			} else {
-				sent += n
-			}
+	conn := this.service.GetConnection()
+
+	/* Write returns an error for any short write */
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if len(payload) > 0 {
+		if _, err := conn.Write(payload); err != nil {
+			return err
 		}
 	}
+	this.service.TraceFrame(tunnel.TraceSend, buf.Bytes(), payload)
 
 	return nil
 }
 
+// recv is only called by the reader, a status reply is no error here
 func (this *AFCService) recv() (*AFCPacket, error) {
-	offset := uint64(0x28)
-
 	conn := this.service.GetConnection()
 
-	header := make([]byte, offset)
-	n, err := conn.Read(header)
-	if err != nil && n == 0 {
+	header := make([]byte, afcHeaderSize)
+	if _, err := io.ReadFull(conn, header); err != nil {
 		return nil, err
 	}
-	if n < 0x28 {
-		return nil, errors.New("recv: header")
-	}
-	if bytes.Compare(header[:8], afcHeader) != 0 {
+	if !bytes.Equal(header[:8], afcHeader) {
 		return nil, errors.New("recv: header not match")
 	}
 
@@ -338,27 +397,20 @@ func (this *AFCService) recv() (*AFCPacket, error) {
 	packet.PacketNum = binary.LittleEndian.Uint64(header[24:32])
 	packet.Operation = binary.LittleEndian.Uint64(header[32:])
 
-	buf := &bytes.Buffer{}
-	pkgBuf := make([]byte, 0xffff)
-
-	for offset < packet.EntireLen {
-		if n, err := conn.Read(pkgBuf); err != nil && n <= 0 {
-			return nil, err
-		} else {
-			buf.Write(pkgBuf[:n])
-			offset += uint64(n)
-		}
+	if packet.ThisLen < afcHeaderSize || packet.EntireLen < packet.ThisLen || packet.EntireLen > afcMaxPacketSize {
+		return nil, fmt.Errorf("recv: bad packet length %d/%d", packet.ThisLen, packet.EntireLen)
 	}
 
-	dataAndPayload := buf.Bytes()
-
-	packet.Data = dataAndPayload[:int(packet.ThisLen-40)]
-	packet.Payload = dataAndPayload[int(packet.ThisLen-40):]
-
-	if err := packet.Error(); err != nil {
+	dataAndPayload := make([]byte, packet.EntireLen-afcHeaderSize)
+	if _, err := io.ReadFull(conn, dataAndPayload); err != nil {
 		return nil, err
 	}
 
+	this.service.TraceFrame(tunnel.TraceRecv, header, dataAndPayload)
+
+	packet.Data = dataAndPayload[:int(packet.ThisLen-afcHeaderSize)]
+	packet.Payload = dataAndPayload[int(packet.ThisLen-afcHeaderSize):]
+
 	return packet, nil
 }
 
@@ -370,11 +422,7 @@ type AFCDeviceInfo struct {
 }
 
 func (this *AFCService) GetDeviceInfo() (*AFCDeviceInfo, error) {
-	if err := this.send(AFCOperationGetDeviceInfo, nil, nil); err != nil {
-		return nil, err
-	}
-
-	if b, err := this.recv(); err != nil {
+	if b, err := this.request(AFCOperationGetDeviceInfo, nil, nil); err != nil {
 		return nil, err
 	} else {
 		m := b.Map()
@@ -401,12 +449,8 @@ func (this *AFCService) GetDeviceInfo() (*AFCDeviceInfo, error) {
 }
 
 func (this *AFCService) ReadDirectory(p string) ([]string, error) {
-	if err := this.send(AFCOperationReadDir, getCStr(p), nil); err != nil {
-		return nil, err
-	}
-
-	if b, err := this.recv(); err != nil {
-		return nil, err
+	if b, err := this.request(AFCOperationReadDir, getCStr(p), nil); err != nil {
+		return nil, afcPathError(err, p)
 	} else {
 		return b.Array(), nil
 	}
@@ -432,7 +476,21 @@ func (this *afcFileInfo) Size() int64 {
 	return int64(this.size)
 }
 func (this *afcFileInfo) Mode() os.FileMode {
-	return os.ModeType
+	switch this.ifmt {
+	case "S_IFDIR":
+		return os.ModeDir | 0755
+	case "S_IFLNK":
+		return os.ModeSymlink | 0777
+	case "S_IFCHR":
+		return os.ModeDevice | os.ModeCharDevice | 0644
+	case "S_IFBLK":
+		return os.ModeDevice | 0644
+	case "S_IFIFO":
+		return os.ModeNamedPipe | 0644
+	case "S_IFSOCK":
+		return os.ModeSocket | 0644
+	}
+	return 0644
 }
 func (this *afcFileInfo) ModTime() time.Time {
 	return time.Unix(0, int64(this.mtime))
@@ -445,34 +503,34 @@ func (this *afcFileInfo) Sys() interface{} {
 }
 
 func (this *AFCService) GetFileInfo(filename string) (os.FileInfo, error) {
-	if err := this.send(AFCOperationGetFileInfo, getCStr(filename), nil); err != nil {
+	if b, err := this.request(AFCOperationGetFileInfo, getCStr(filename), nil); err != nil {
+		return nil, afcPathError(err, filename)
+	} else if info, err := newAFCFileInfo(path.Base(filename), b.Map()); err != nil {
 		return nil, err
+	} else {
+		return info, nil
 	}
+}
 
-	if b, err := this.recv(); err != nil {
+func newAFCFileInfo(name string, m map[string]string) (*afcFileInfo, error) {
+	st_size, err := strconv.ParseUint(m["st_size"], 10, 64)
+	if err != nil {
 		return nil, err
-	} else {
-		m := b.Map()
-
-		st_size, err := strconv.ParseUint(m["st_size"], 10, 64)
-		if err != nil {
-			return nil, err
-		}
-		st_mtime, err := strconv.ParseUint(m["st_mtime"], 10, 64)
-		if err != nil {
-			return nil, err
-		}
-
-		info := &afcFileInfo{
-			name:   path.Base(filename),
-			size:   st_size,
-			mtime:  st_mtime,
-			ifmt:   m["st_ifmt"],
-			source: m,
-		}
+	}
+	st_mtime, err := strconv.ParseUint(m["st_mtime"], 10, 64)
+	if err != nil {
+		return nil, err
+	}
 
-		return info, nil
+	info := &afcFileInfo{
+		name:   name,
+		size:   st_size,
+		mtime:  st_mtime,
+		ifmt:   m["st_ifmt"],
+		source: m,
 	}
+
+	return info, nil
 }
 
 type AFCFile struct {
@@ -486,12 +544,8 @@ func (this *AFCService) FileOpen(filename string, filemode AFCFileMode) (*AFCFil
 	copy(buf[8:], b)
 	binary.LittleEndian.PutUint64(buf[:8], uint64(filemode))
 
-	if err := this.send(AFCOperationFileOpen, buf, nil); err != nil {
-		return nil, err
-	}
-
-	if b, err := this.recv(); err != nil {
-		return nil, err
+	if b, err := this.request(AFCOperationFileOpen, buf, nil); err != nil {
+		return nil, afcPathError(err, filename)
 	} else if b.Operation == AFCOperationFileOpenResult {
 		return &AFCFile{service: this, fd: b.Uint64()}, nil
 	} else {
@@ -513,11 +567,7 @@ func (this *AFCFile) op(o ...uint64) []byte {
 }
 
 func (this *AFCFile) Lock(mode AFCLockType) error {
-	if err := this.service.send(AFCOperationFileRefLock, this.op(uint64(mode)), nil); err != nil {
-		return err
-	}
-
-	if b, err := this.service.recv(); err != nil {
+	if b, err := this.service.request(AFCOperationFileRefLock, this.op(uint64(mode)), nil); err != nil {
 		return err
 	} else if err := b.Error(); err != nil {
 		return err
@@ -531,16 +581,12 @@ func (this *AFCFile) Unlock() error {
 }
 
 func (this *AFCFile) Read(p []byte) (int, error) {
-	if err := this.service.send(AFCOperationFileRead, this.op(uint64(len(p))), nil); err != nil {
-		return -1, err
-	}
-
-	if b, err := this.service.recv(); err != nil {
-		return -1, err
+	if b, err := this.service.request(AFCOperationFileRead, this.op(uint64(len(p))), nil); err != nil {
+		return 0, err
 	} else if err := b.Error(); err != nil {
-		return -1, err
+		return 0, err
 	} else {
-		if b.Payload == nil {
+		if len(b.Payload) == 0 {
 			return 0, io.EOF
 		}
 		copy(p, b.Payload)
@@ -549,23 +595,17 @@ func (this *AFCFile) Read(p []byte) (int, error) {
 }
 
 func (this *AFCFile) Write(p []byte) (int, error) {
-	if err := this.service.send(AFCOperationFileWrite, this.op(), p); err != nil {
-		return -1, err
-	}
-
-	if b, err := this.service.recv(); err != nil {
-		return -1, err
+	if b, err := this.service.request(AFCOperationFileWrite, this.op(), p); err != nil {
+		return 0, err
 	} else if err := b.Error(); err != nil {
-		return -1, err
+		return 0, err
 	} else {
 		return len(p), nil
 	}
 }
 
 func (this *AFCFile) Tell() (uint64, error) {
-	if err := this.service.send(AFCOperationFileTell, this.op(), nil); err != nil {
-		return 0, err
-	} else if b, err := this.service.recv(); err != nil {
+	if b, err := this.service.request(AFCOperationFileTell, this.op(), nil); err != nil {
 		return 0, err
 	} else if err := b.Error(); err != nil {
 		return 0, err
@@ -577,9 +617,7 @@ func (this *AFCFile) Tell() (uint64, error) {
 }
 
 func (this *AFCFile) Seek(offset int64, whence int) (int64, error) {
-	if err := this.service.send(AFCOperationFileSeek, this.op(uint64(whence), uint64(offset)), nil); err != nil {
-		return -1, err
-	} else if b, err := this.service.recv(); err != nil {
+	if b, err := this.service.request(AFCOperationFileSeek, this.op(uint64(whence), uint64(offset)), nil); err != nil {
 		return -1, err
 	} else if err := b.Error(); err != nil {
 		return -1, err
@@ -590,10 +628,102 @@ func (this *AFCFile) Seek(offset int64, whence int) (int64, error) {
 	}
 }
 
+func (this *AFCService) window() int {
+	if this.Window > 0 {
+		return this.Window
+	}
+	return AFCDefaultWindow
+}
+
+func (this *AFCService) chunkSize() int {
+	if this.ChunkSize > 0 {
+		return this.ChunkSize
+	}
+	return AFCDefaultChunkSize
+}
+
+// WriteTo copies the rest of the file to w, keeping `Window` reads in flight
+func (this *AFCFile) WriteTo(w io.Writer) (int64, error) {
+	var calls []*afcCall
+	var n int64
+	var err error
+	eof := false
+	chunk := uint64(this.service.chunkSize())
+
+	for {
+		for !eof && err == nil && len(calls) < this.service.window() {
+			call, e := this.service.start(AFCOperationFileRead, this.op(chunk), nil)
+			if e != nil {
+				err = e
+				break
+			}
+			calls = append(calls, call)
+		}
+		if len(calls) == 0 {
+			return n, err
+		}
+
+		/* the device answers in order, after an error only drain */
+		b, e := this.service.wait(calls[0])
+		calls = calls[1:]
+		if err != nil || eof {
+			continue
+		} else if e != nil {
+			err = e
+		} else if len(b.Payload) == 0 {
+			eof = true
+		} else {
+			m, e := w.Write(b.Payload)
+			n += int64(m)
+			err = e
+		}
+	}
+}
+
+// ReadFrom copies r into the file until EOF, keeping `Window` writes in flight
+func (this *AFCFile) ReadFrom(r io.Reader) (int64, error) {
+	var calls []*afcCall
+	var sizes []int
+	var n int64
+	var err error
+	eof := false
+	/* the payload is on the wire once `start` returns, so one buffer will do */
+	buf := make([]byte, this.service.chunkSize())
+
+	for {
+		for !eof && err == nil && len(calls) < this.service.window() {
+			m, e := io.ReadFull(r, buf)
+			if m > 0 {
+				call, e := this.service.start(AFCOperationFileWrite, this.op(), buf[:m])
+				if e != nil {
+					err = e
+					break
+				}
+				calls = append(calls, call)
+				sizes = append(sizes, m)
+			}
+			if e == io.EOF || e == io.ErrUnexpectedEOF {
+				eof = true
+			} else if e != nil {
+				err = e
+			}
+		}
+		if len(calls) == 0 {
+			return n, err
+		}
+
+		_, e := this.service.wait(calls[0])
+		if err == nil && e != nil {
+			err = e
+		} else if err == nil {
+			n += int64(sizes[0])
+		}
+		calls, sizes = calls[1:], sizes[1:]
+	}
+}
+
 func (this *AFCFile) Truncate(size int64) error {
-	if err := this.service.send(AFCOperationFileSetSize, this.op(uint64(size)), nil); err != nil {
-		return err
-	} else if b, err := this.service.recv(); err != nil {
+	if b, err := this.service.request(AFCOperationFileSetSize, this.op(uint64(size)), nil); err != nil {
 		return err
 	} else if err := b.Error(); err != nil {
 		return err
@@ -604,19 +734,15 @@ func (this *AFCFile) Truncate(size int64) error {
 func (this *AFCFile) Close() error {
 	b := make([]byte, 8)
 	binary.LittleEndian.PutUint64(b, this.fd)
-	if err := this.service.send(AFCOperationFileClose, b, nil); err != nil {
-		return err
-	} else if _, err := this.service.recv(); err != nil {
+	if _, err := this.service.request(AFCOperationFileClose, b, nil); err != nil {
 		return err
 	}
 	return nil
 }
 
 func (this *AFCService) Remove(path string) error {
-	if err := this.send(AFCOperationRemovePath, getCStr(path), nil); err != nil {
-		return err
-	} else if b, err := this.recv(); err != nil {
-		return err
+	if b, err := this.request(AFCOperationRemovePath, getCStr(path), nil); err != nil {
+		return afcPathError(err, path)
 	} else if err := b.Error(); err != nil {
 		return err
 	}
@@ -624,10 +750,8 @@ func (this *AFCService) Remove(path string) error {
 }
 
 func (this *AFCService) Rename(oldpath, newpath string) error {
-	if err := this.send(AFCOperationRenamePath, getCStr(oldpath, newpath), nil); err != nil {
-		return err
-	} else if b, err := this.recv(); err != nil {
-		return err
+	if b, err := this.request(AFCOperationRenamePath, getCStr(oldpath, newpath), nil); err != nil {
+		return afcPathError(err, oldpath)
 	} else if err := b.Error(); err != nil {
 		return err
 	}
@@ -635,10 +759,8 @@ func (this *AFCService) Rename(oldpath, newpath string) error {
 }
 
 func (this *AFCService) Mkdir(path string) error {
-	if err := this.send(AFCOperationMakeDir, getCStr(path), nil); err != nil {
-		return err
-	} else if b, err := this.recv(); err != nil {
-		return err
+	if b, err := this.request(AFCOperationMakeDir, getCStr(path), nil); err != nil {
+		return afcPathError(err, path)
 	} else if err := b.Error(); err != nil {
 		return err
 	}
@@ -649,10 +771,8 @@ func (this *AFCService) Link(linkType AFCLinkType, oldname, newname string) erro
 	b := make([]byte, 8)
 	binary.LittleEndian.PutUint64(b, uint64(linkType))
 	b = append(b, getCStr(oldname, newname)...)
-	if err := this.send(AFCOperationMakeLink, b, nil); err != nil {
-		return err
-	} else if b, err := this.recv(); err != nil {
-		return err
+	if b, err := this.request(AFCOperationMakeLink, b, nil); err != nil {
+		return afcPathError(err, newname)
 	} else if err := b.Error(); err != nil {
 		return err
 	}
@@ -663,10 +783,8 @@ func (this *AFCService) Truncate(path string, newsize uint64) error {
 	b := make([]byte, 8)
 	binary.LittleEndian.PutUint64(b, newsize)
 	b = append(b, getCStr(path)...)
-	if err := this.send(AFCOperationTruncateFile, b, nil); err != nil {
-		return err
-	} else if b, err := this.recv(); err != nil {
-		return err
+	if b, err := this.request(AFCOperationTruncateFile, b, nil); err != nil {
+		return afcPathError(err, path)
 	} else if err := b.Error(); err != nil {
 		return err
 	}
@@ -677,10 +795,8 @@ func (this *AFCService) SetFileTime(mtime uint64, path string) error {
 	b := make([]byte, 8)
 	binary.LittleEndian.PutUint64(b, mtime)
 	b = append(b, getCStr(path)...)
-	if err := this.send(AFCOperationSetFileModTime, b, nil); err != nil {
-		return err
-	} else if b, err := this.recv(); err != nil {
-		return err
+	if b, err := this.request(AFCOperationSetFileModTime, b, nil); err != nil {
+		return afcPathError(err, path)
 	} else if err := b.Error(); err != nil {
 		return err
 	}
@@ -689,10 +805,8 @@ func (this *AFCService) SetFileTime(mtime uint64, path string) error {
 
 /* sha1 algorithm */
 func (this *AFCService) Hash(path string) ([]byte, error) {
-	if err := this.send(AFCOperationGetFileHash, getCStr(path), nil); err != nil {
-		return nil, err
-	} else if b, err := this.recv(); err != nil {
-		return nil, err
+	if b, err := this.request(AFCOperationGetFileHash, getCStr(path), nil); err != nil {
+		return nil, afcPathError(err, path)
 	} else if err := b.Error(); err != nil {
 		return nil, err
 	} else {
@@ -707,10 +821,8 @@ func (this *AFCService) HashWithRange(start, end uint64, path string) ([]byte, e
 	binary.LittleEndian.PutUint64(b[8:], end)
 	b = append(b, getCStr(path)...)
 
-	if err := this.send(AFCOperationGetFileHashRange, b, nil); err != nil {
-		return nil, err
-	} else if b, err := this.recv(); err != nil {
-		return nil, err
+	if b, err := this.request(AFCOperationGetFileHashRange, b, nil); err != nil {
+		return nil, afcPathError(err, path)
 	} else if err := b.Error(); err != nil {
 		return nil, err
 	} else {
@@ -720,16 +832,20 @@ func (this *AFCService) HashWithRange(start, end uint64, path string) ([]byte, e
 
 /* since iOS6+ */
 func (this *AFCService) RemoveAll(path string) error {
-	if err := this.send(AFCOperationRemovePathAndContents, getCStr(path), nil); err != nil {
-		return err
-	} else if b, err := this.recv(); err != nil {
-		return err
+	if b, err := this.request(AFCOperationRemovePathAndContents, getCStr(path), nil); err != nil {
+		return afcPathError(err, path)
 	} else if err := b.Error(); err != nil {
 		return err
 	}
 	return nil
 }
 
+// WithContext runs fn, any AFC operations on this service, until ctx is
+// done. Its end, cancel or deadline, closes the service for every caller.
+func (this *AFCService) WithContext(ctx context.Context, fn func() error) error {
+	return this.service.WithContext(ctx, fn)
+}
+
 func (this *AFCService) Close() error {
-	return this.service.GetConnection().Close()
+	return this.service.Close()
 }
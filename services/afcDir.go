@@ -0,0 +1,128 @@
+package services
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+)
+
+const (
+	// stats are small, more of them are kept in flight than file chunks
+	afcStatWindow = 32
+	// names stat'ed per `Next` batch
+	afcDirBatch = 128
+)
+
+// AFCDirEnumerator streams the entries of a directory with their
+// attributes, "." and ".." left out. The names come from one
+// `ReadDirectory` listing, the attributes from `GetFileInfo` requests
+// pipelined a batch at a time. Entries removed while enumerating are
+// skipped.
+type AFCDirEnumerator struct {
+	service *AFCService
+	dir     string
+
+	/* what is left of the listing */
+	names []string
+	batch []os.FileInfo
+}
+
+// OpenDirectory starts enumerating dir, `Close` it when done
+func (this *AFCService) OpenDirectory(dir string) (*AFCDirEnumerator, error) {
+	names, err := this.ReadDirectory(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &AFCDirEnumerator{service: this, dir: dir, names: names}, nil
+}
+
+// Next returns the next entry, io.EOF after the last
+func (this *AFCDirEnumerator) Next() (os.FileInfo, error) {
+	for len(this.batch) == 0 {
+		if len(this.names) == 0 {
+			return nil, io.EOF
+		}
+		names := this.names
+		if len(names) > afcDirBatch {
+			names = names[:afcDirBatch]
+		}
+		this.names = this.names[len(names):]
+
+		var err error
+		if this.batch, err = this.service.statNames(this.dir, names); err != nil {
+			return nil, err
+		}
+	}
+
+	info := this.batch[0]
+	this.batch = this.batch[1:]
+	return info, nil
+}
+
+func (this *AFCDirEnumerator) Close() error {
+	this.names, this.batch = nil, nil
+	return nil
+}
+
+// ReadDirectoryInfo lists dir with the attributes of every entry
+func (this *AFCService) ReadDirectoryInfo(dir string) ([]os.FileInfo, error) {
+	e, err := this.OpenDirectory(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []os.FileInfo
+	for {
+		info, err := e.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			_ = e.Close()
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, e.Close()
+}
+
+// statNames stats the names in dir with `afcStatWindow` requests in flight
+func (this *AFCService) statNames(dir string, names []string) ([]os.FileInfo, error) {
+	var calls []*afcCall
+	var pending []string
+	var err error
+	infos := make([]os.FileInfo, 0, len(names))
+
+	for {
+		for err == nil && len(names) > 0 && len(calls) < afcStatWindow {
+			name := names[0]
+			names = names[1:]
+			if name == "." || name == ".." {
+				continue
+			}
+			call, e := this.start(AFCOperationGetFileInfo, getCStr(path.Join(dir, name)), nil)
+			if e != nil {
+				err = e
+				break
+			}
+			calls = append(calls, call)
+			pending = append(pending, name)
+		}
+		if len(calls) == 0 {
+			return infos, err
+		}
+
+		b, e := this.wait(calls[0])
+		name := pending[0]
+		calls, pending = calls[1:], pending[1:]
+		if err != nil || errors.Is(e, os.ErrNotExist) {
+			continue
+		} else if e != nil {
+			err = afcPathError(e, path.Join(dir, name))
+		} else if info, e := newAFCFileInfo(name, b.Map()); e != nil {
+			err = e
+		} else {
+			infos = append(infos, info)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package services_test
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"iconsole/services"
+	"iconsole/services/afctest"
+	"iconsole/tunnel"
+	"io"
+	"os"
+	"sort"
+	"testing"
+	"time"
+)
+
+// operations counts the requests of each operation the tracer saw
+func (this *recordTracer) operations() map[uint64]int {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	ops := make(map[uint64]int)
+	for _, record := range this.records {
+		if b, err := hex.DecodeString(record.Hex); err == nil && len(b) >= 40 && record.Direction == tunnel.TraceSend {
+			ops[binary.LittleEndian.Uint64(b[32:])]++
+		}
+	}
+	return ops
+}
+
+func listDirectory(afc *services.AFCService, dir string) ([]string, error) {
+	e, err := afc.OpenDirectory(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer e.Close()
+
+	var names []string
+	for {
+		info, err := e.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if info.IsDir() != (info.Name() == "sub") {
+			return nil, fmt.Errorf("%s: IsDir %v", info.Name(), info.IsDir())
+		}
+		names = append(names, info.Name())
+	}
+	sort.Strings(names)
+	return names, e.Close()
+}
+
+func TestOpenDirectory(t *testing.T) {
+	/* more entries than one batch of stats */
+	var want []string
+	for i := 0; i < 300; i++ {
+		want = append(want, fmt.Sprintf("IMG_%04d.JPG", i))
+	}
+	want = append(want, "sub")
+	sort.Strings(want)
+
+	server := afctest.NewServer()
+	server.Mkdir("/DCIM/sub")
+	for _, name := range want {
+		if name != "sub" {
+			if err := server.WriteFile("/DCIM/"+name, []byte(name), time.Now()); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	/* one stat after another would take three seconds */
+	server.Latency = 10 * time.Millisecond
+
+	tracer := &recordTracer{}
+	afc, done := startAFC(t, server, tracer)
+	defer done()
+
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		names, err := listDirectory(afc, "/DCIM")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(names) != fmt.Sprint(want) {
+			t.Errorf("%d names, want %d", len(names), len(want))
+		}
+	}
+	if d := time.Since(start); d > 3*time.Second {
+		t.Errorf("two listings took %s, the stats are not pipelined", d)
+	}
+
+	if _, err := afc.OpenDirectory("/missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing dir = %v", err)
+	}
+
+	ops := tracer.operations()
+	if ops[services.AFCOperationReadDir] != 3 || ops[services.AFCOperationGetFileInfo] != 2*len(want) {
+		t.Errorf("%d listings and %d stats, want 3 and %d", ops[services.AFCOperationReadDir], ops[services.AFCOperationGetFileInfo], 2*len(want))
+	}
+}
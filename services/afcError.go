@@ -0,0 +1,97 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// AFCError is a status code an AFC operation failed with. `Path` is the
+// path the operation was about, if any, `Device` the serial number of
+// the device. Compare against the sentinels below with `errors.Is`,
+// not-found, exists and permission codes also match `os.ErrNotExist`,
+// `os.ErrExist` and `os.ErrPermission`.
+type AFCError struct {
+	Code      uint64
+	Operation uint64
+	Path      string
+	Service   string
+	Device    string
+}
+
+var afcErrorNames = map[uint64]string{
+	AFCErrUnknownError:           "UnknownError",
+	AFCErrOperationHeaderInvalid: "OperationHeaderInvalid",
+	AFCErrNoResources:            "NoResources",
+	AFCErrReadError:              "ReadError",
+	AFCErrWriteError:             "WriteError",
+	AFCErrUnknownPacketType:      "UnknownPacketType",
+	AFCErrInvalidArgument:        "InvalidArgument",
+	AFCErrObjectNotFound:         "ObjectNotFound",
+	AFCErrObjectIsDir:            "ObjectIsDir",
+	AFCErrPermDenied:             "PermDenied",
+	AFCErrServiceNotConnected:    "ServiceNotConnected",
+	AFCErrOperationTimeout:       "OperationTimeout",
+	AFCErrTooMuchData:            "TooMuchData",
+	AFCErrEndOfData:              "EndOfData",
+	AFCErrOperationNotSupported:  "OperationNotSupported",
+	AFCErrObjectExists:           "ObjectExists",
+	AFCErrObjectBusy:             "ObjectBusy",
+	AFCErrNoSpaceLeft:            "NoSpaceLeft",
+	AFCErrOperationWouldBlock:    "OperationWouldBlock",
+	AFCErrIoError:                "IoError",
+	AFCErrOperationInterrupted:   "OperationInterrupted",
+	AFCErrOperationInProgress:    "OperationInProgress",
+	AFCErrInternalError:          "InternalError",
+	AFCErrMuxError:               "MuxError",
+	AFCErrNoMemory:               "NoMemory",
+	AFCErrNotEnoughData:          "NotEnoughData",
+	AFCErrDirNotEmpty:            "DirNotEmpty",
+}
+
+func (this *AFCError) Error() string {
+	msg, ok := afcErrorNames[this.Code]
+	if !ok {
+		msg = fmt.Sprintf("status %d", this.Code)
+	}
+	if this.Path != "" {
+		msg = this.Path + ": " + msg
+	}
+	if this.Device != "" {
+		msg += " (" + this.Device + ")"
+	}
+	return msg
+}
+
+func (this *AFCError) Is(target error) bool {
+	switch target {
+	case os.ErrNotExist:
+		return this.Code == AFCErrObjectNotFound
+	case os.ErrExist:
+		return this.Code == AFCErrObjectExists
+	case os.ErrPermission:
+		return this.Code == AFCErrPermDenied
+	}
+	t, ok := target.(*AFCError)
+	return ok && t.Code == this.Code && (t.Device == "" || t.Device == this.Device)
+}
+
+var (
+	ErrAFCObjectNotFound        = &AFCError{Code: AFCErrObjectNotFound}
+	ErrAFCObjectExists          = &AFCError{Code: AFCErrObjectExists}
+	ErrAFCObjectIsDir           = &AFCError{Code: AFCErrObjectIsDir}
+	ErrAFCPermDenied            = &AFCError{Code: AFCErrPermDenied}
+	ErrAFCInvalidArgument       = &AFCError{Code: AFCErrInvalidArgument}
+	ErrAFCOperationNotSupported = &AFCError{Code: AFCErrOperationNotSupported}
+	ErrAFCNoSpaceLeft           = &AFCError{Code: AFCErrNoSpaceLeft}
+	ErrAFCDirNotEmpty           = &AFCError{Code: AFCErrDirNotEmpty}
+)
+
+// afcPathError records the path an operation failed on
+func afcPathError(err error, p string) error {
+	var afcErr *AFCError
+	if errors.As(err, &afcErr) && afcErr.Path == "" {
+		afcErr.Path = p
+	}
+	return err
+}
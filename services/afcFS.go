@@ -0,0 +1,206 @@
+package services
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+var (
+	errIsDirectory  = errors.New("is a directory")
+	errNotDirectory = errors.New("not a directory")
+)
+
+// AFCFS reads device storage through the `io/fs` interfaces, names are
+// slash separated and relative to `root`. It works on any `AFCService`,
+// house arrest containers included. Before Go 1.16 the same methods take
+// `os.FileInfo` in place of `fs.DirEntry`.
+type AFCFS struct {
+	afc  *AFCService
+	root string
+}
+
+// NewAFCFS serves the device directory root, "/" when empty
+func NewAFCFS(afc *AFCService, root string) *AFCFS {
+	if root == "" {
+		root = "/"
+	}
+	return &AFCFS{afc: afc, root: path.Clean("/" + root)}
+}
+
+// validPath is `fs.ValidPath`, that is missing before Go 1.16
+func validPath(name string) bool {
+	if name == "." {
+		return true
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if elem == "" || elem == "." || elem == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// devicePath checks name and returns where it is on the device
+func (this *AFCFS) devicePath(op, name string) (string, error) {
+	if !validPath(name) {
+		return "", &os.PathError{Op: op, Path: name, Err: os.ErrInvalid}
+	}
+	return path.Join(this.root, name), nil
+}
+
+// fsPathError reports err against the name given to `AFCFS`, unwrapping
+// the device path a path error or `AFCError` already carries
+func fsPathError(op, name string, err error) error {
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		err = pathErr.Err
+	}
+	if afcErr, ok := err.(*AFCError); ok && afcErr.Path != "" {
+		e := *afcErr
+		e.Path = ""
+		err = &e
+	}
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+// stat labels the info with the last element of the name, "." for the root
+func (this *AFCFS) stat(op, name string) (string, os.FileInfo, error) {
+	p, err := this.devicePath(op, name)
+	if err != nil {
+		return "", nil, err
+	}
+	info, err := this.afc.GetFileInfo(p)
+	if err != nil {
+		return "", nil, fsPathError(op, name, err)
+	}
+	if i, ok := info.(*afcFileInfo); ok {
+		i.name = path.Base(name)
+	}
+	return p, info, nil
+}
+
+func (this *AFCFS) Stat(name string) (os.FileInfo, error) {
+	_, info, err := this.stat("stat", name)
+	return info, err
+}
+
+func (this *AFCFS) open(name string) (*AFCFSFile, error) {
+	p, info, err := this.stat("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &AFCFSFile{fs: this, name: name, path: p, info: info}
+	if !info.IsDir() {
+		if f.file, err = this.afc.FileOpen(p, AFC_RDONLY); err != nil {
+			return nil, fsPathError("open", name, err)
+		}
+	}
+	return f, nil
+}
+
+// readDir lists a directory sorted by name
+func (this *AFCFS) readDir(name string) ([]os.FileInfo, error) {
+	f, err := this.open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	infos, err := f.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name() < infos[j].Name()
+	})
+	return infos, nil
+}
+
+// AFCFSFile is a file or directory opened from `AFCFS`. It also meets
+// `http.File`, directories are listed with `Readdir` or `ReadDir`.
+type AFCFSFile struct {
+	fs   *AFCFS
+	name string
+	path string
+	info os.FileInfo
+	/* nil for directories */
+	file *AFCFile
+
+	entries []os.FileInfo
+	listed  bool
+}
+
+func (this *AFCFSFile) Stat() (os.FileInfo, error) {
+	return this.info, nil
+}
+
+func (this *AFCFSFile) Read(p []byte) (int, error) {
+	if this.file == nil {
+		return 0, &os.PathError{Op: "read", Path: this.name, Err: errIsDirectory}
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	n, err := this.file.Read(p)
+	if err != nil && err != io.EOF {
+		err = fsPathError("read", this.name, err)
+	}
+	return n, err
+}
+
+func (this *AFCFSFile) Seek(offset int64, whence int) (int64, error) {
+	if this.file == nil {
+		return 0, &os.PathError{Op: "seek", Path: this.name, Err: errIsDirectory}
+	}
+	n, err := this.file.Seek(offset, whence)
+	if err != nil {
+		return 0, fsPathError("seek", this.name, err)
+	}
+	return n, nil
+}
+
+// Readdir returns up to count entries, all that are left when count <= 0
+func (this *AFCFSFile) Readdir(count int) ([]os.FileInfo, error) {
+	if this.file != nil {
+		return nil, &os.PathError{Op: "readdir", Path: this.name, Err: errNotDirectory}
+	}
+
+	if !this.listed {
+		infos, err := this.fs.afc.ReadDirectoryInfo(this.path)
+		if err != nil {
+			return nil, fsPathError("readdir", this.name, err)
+		}
+		this.entries = infos
+		this.listed = true
+	}
+
+	if count <= 0 {
+		entries := this.entries
+		this.entries = nil
+		return entries, nil
+	}
+	if len(this.entries) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(this.entries) {
+		count = len(this.entries)
+	}
+	entries := this.entries[:count]
+	this.entries = this.entries[count:]
+	return entries, nil
+}
+
+func (this *AFCFSFile) Close() error {
+	if this.file == nil {
+		return nil
+	}
+	if err := this.file.Close(); err != nil {
+		return fsPathError("close", this.name, err)
+	}
+	return nil
+}
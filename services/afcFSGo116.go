@@ -0,0 +1,53 @@
+//go:build go1.16
+// +build go1.16
+
+package services
+
+import (
+	"io/fs"
+)
+
+var (
+	_ fs.ReadDirFS   = (*AFCFS)(nil)
+	_ fs.StatFS      = (*AFCFS)(nil)
+	_ fs.ReadDirFile = (*AFCFSFile)(nil)
+	_ fs.DirEntry    = afcDirEntry{}
+)
+
+type afcDirEntry struct {
+	info fs.FileInfo
+}
+
+func (this afcDirEntry) Name() string               { return this.info.Name() }
+func (this afcDirEntry) IsDir() bool                { return this.info.IsDir() }
+func (this afcDirEntry) Type() fs.FileMode          { return this.info.Mode().Type() }
+func (this afcDirEntry) Info() (fs.FileInfo, error) { return this.info, nil }
+
+func dirEntries(infos []fs.FileInfo) []fs.DirEntry {
+	entries := make([]fs.DirEntry, len(infos))
+	for i, info := range infos {
+		entries[i] = afcDirEntry{info: info}
+	}
+	return entries
+}
+
+func (this *AFCFS) Open(name string) (fs.File, error) {
+	f, err := this.open(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (this *AFCFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	infos, err := this.readDir(name)
+	if err != nil {
+		return nil, err
+	}
+	return dirEntries(infos), nil
+}
+
+func (this *AFCFSFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	infos, err := this.Readdir(n)
+	return dirEntries(infos), err
+}
@@ -0,0 +1,22 @@
+//go:build !go1.16
+// +build !go1.16
+
+package services
+
+import (
+	"os"
+)
+
+/* `io/fs` is missing, the adapter keeps its shape with `os.FileInfo` */
+
+func (this *AFCFS) Open(name string) (*AFCFSFile, error) {
+	return this.open(name)
+}
+
+func (this *AFCFS) ReadDir(name string) ([]os.FileInfo, error) {
+	return this.readDir(name)
+}
+
+func (this *AFCFSFile) ReadDir(n int) ([]os.FileInfo, error) {
+	return this.Readdir(n)
+}
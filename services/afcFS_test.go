@@ -0,0 +1,49 @@
+//go:build go1.16
+// +build go1.16
+
+package services_test
+
+import (
+	"errors"
+	"iconsole/services"
+	"iconsole/services/afctest"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestAFCFS(t *testing.T) {
+	server := afctest.NewServer()
+	server.Mkdir("/Media/DCIM/100APPLE")
+	server.Mkdir("/Media/Empty")
+	mtime := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	for name, data := range map[string]string{
+		"/Media/DCIM/100APPLE/IMG_0001.JPG": "first photo",
+		"/Media/DCIM/100APPLE/IMG_0002.JPG": "",
+		"/Media/notes.txt":                  "notes",
+	} {
+		if err := server.WriteFile(name, []byte(data), mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	afc, done := startAFC(t, server, nil)
+	defer done()
+
+	fsys := services.NewAFCFS(afc, "/Media")
+	if err := fstest.TestFS(fsys, "notes.txt", "DCIM/100APPLE/IMG_0001.JPG", "DCIM/100APPLE/IMG_0002.JPG", "Empty"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := fs.Stat(fsys, "DCIM/missing")
+	var pathErr *fs.PathError
+	if !errors.As(err, &pathErr) || !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("stat of a missing file = %v", err)
+	}
+	if want := "stat DCIM/missing: ObjectNotFound"; err.Error() != want {
+		t.Errorf("stat of a missing file = %q, want %q", err, want)
+	}
+	if _, err := fsys.Open("../etc"); !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("open outside the root = %v", err)
+	}
+}
@@ -0,0 +1,470 @@
+package services_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"iconsole/services"
+	"iconsole/services/afctest"
+	"iconsole/tunnel"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startAFC runs an AFC client against server over a pipe
+func startAFC(t testing.TB, server *afctest.Server, tracer tunnel.Tracer) (*services.AFCService, func()) {
+	t.Helper()
+
+	client, device := net.Pipe()
+	go server.Serve(device)
+
+	service := tunnel.NewService(tunnel.MixConnectionClient(client), nil, services.AFCServiceName)
+	if tracer != nil {
+		service.SetTracer(tracer)
+	}
+	afc := services.NewAFCServiceWith(service)
+	return afc, func() { _ = afc.Close() }
+}
+
+type recordTracer struct {
+	mutex   sync.Mutex
+	records []*tunnel.TraceRecord
+}
+
+func (this *recordTracer) Trace(record *tunnel.TraceRecord) {
+	this.mutex.Lock()
+	this.records = append(this.records, record)
+	this.mutex.Unlock()
+}
+
+func TestAFCTraceWholePackets(t *testing.T) {
+	tracer := &recordTracer{}
+	afc, done := startAFC(t, afctest.NewServer(), tracer)
+	defer done()
+
+	if _, err := afc.GetDeviceInfo(); err != nil {
+		t.Fatal(err)
+	}
+	/* header, path and payload go out in separate writes */
+	f, err := afc.FileOpen("/a.txt", services.AFC_WR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(bytes.Repeat([]byte("x"), 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tracer.mutex.Lock()
+	defer tracer.mutex.Unlock()
+
+	sent, received := 0, 0
+	for i, record := range tracer.records {
+		b, err := hex.DecodeString(record.Hex)
+		if err != nil || len(b) < 40 {
+			t.Fatalf("record %d: %d bytes, %v", i, len(b), err)
+		}
+		if entire := binary.LittleEndian.Uint64(b[8:]); entire != uint64(len(b)) {
+			t.Errorf("record %d %s holds %d bytes of a %d byte packet", i, record.Direction, len(b), entire)
+		}
+		if record.Service != services.AFCServiceName {
+			t.Errorf("record %d service %q", i, record.Service)
+		}
+		switch record.Direction {
+		case tunnel.TraceSend:
+			sent++
+		case tunnel.TraceRecv:
+			received++
+		}
+	}
+	if sent == 0 || sent != received {
+		t.Errorf("%d packets sent, %d received", sent, received)
+	}
+}
+
+func TestAFCConcurrentCallers(t *testing.T) {
+	afc, done := startAFC(t, afctest.NewServer(), nil)
+	defer done()
+	/* small chunks keep several requests of each caller in flight */
+	afc.ChunkSize = 512
+
+	const callers = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("/file%d", i)
+			data := bytes.Repeat([]byte{byte(i)}, 4096+i)
+
+			f, err := afc.FileOpen(name, services.AFC_WR)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if _, err := f.ReadFrom(bytes.NewReader(data)); err != nil {
+				errs <- err
+				return
+			}
+			if err := f.Close(); err != nil {
+				errs <- err
+				return
+			}
+
+			if info, err := afc.GetFileInfo(name); err != nil {
+				errs <- err
+				return
+			} else if info.Size() != int64(len(data)) {
+				errs <- fmt.Errorf("%s: size %d, want %d", name, info.Size(), len(data))
+				return
+			}
+
+			f, err = afc.FileOpen(name, services.AFC_RDONLY)
+			if err != nil {
+				errs <- err
+				return
+			}
+			got := &bytes.Buffer{}
+			if _, err := f.WriteTo(got); err != nil {
+				errs <- err
+				return
+			}
+			if err := f.Close(); err != nil {
+				errs <- err
+				return
+			}
+			if !bytes.Equal(got.Bytes(), data) {
+				errs <- fmt.Errorf("%s: read back %d bytes that differ", name, got.Len())
+			}
+		}(i)
+	}
+	waitGroup(t, &wg)
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestAFCCloseWhilePending(t *testing.T) {
+	server := afctest.NewServer()
+	server.Latency = time.Second
+	afc, _ := startAFC(t, server, nil)
+
+	const callers = 4
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		go func() {
+			_, err := afc.GetDeviceInfo()
+			errs <- err
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if err := afc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := time.After(5 * time.Second)
+	for i := 0; i < callers; i++ {
+		select {
+		case err := <-errs:
+			if !errors.Is(err, tunnel.ErrServiceClosed) {
+				t.Errorf("request cut off by Close = %v, want ErrServiceClosed", err)
+			}
+		case <-timeout:
+			t.Fatal("request still pending after Close")
+		}
+	}
+
+	if _, err := afc.GetDeviceInfo(); !errors.Is(err, tunnel.ErrServiceClosed) {
+		t.Errorf("request after Close = %v, want ErrServiceClosed", err)
+	}
+	/* closing twice is fine */
+	_ = afc.Close()
+}
+
+func afcPacket(packetNum, operation uint64, data, payload []byte) []byte {
+	b := make([]byte, 40, 40+len(data)+len(payload))
+	copy(b, "CFA6LPAA")
+	binary.LittleEndian.PutUint64(b[8:], uint64(40+len(data)+len(payload)))
+	binary.LittleEndian.PutUint64(b[16:], uint64(40+len(data)))
+	binary.LittleEndian.PutUint64(b[24:], packetNum)
+	binary.LittleEndian.PutUint64(b[32:], operation)
+	b = append(b, data...)
+	return append(b, payload...)
+}
+
+func TestAFCReplyToUnknownPacket(t *testing.T) {
+	client, device := net.Pipe()
+	go func() {
+		defer device.Close()
+		header := make([]byte, 40)
+		for {
+			if _, err := io.ReadFull(device, header); err != nil {
+				return
+			}
+			if _, err := io.CopyN(ioutil.Discard, device, int64(binary.LittleEndian.Uint64(header[8:])-40)); err != nil {
+				return
+			}
+			num := binary.LittleEndian.Uint64(header[24:])
+			/* a stray reply first, then the real one */
+			status := make([]byte, 8)
+			if _, err := device.Write(afcPacket(num+100, services.AFCOperationStatus, status, nil)); err != nil {
+				return
+			}
+			info := []byte("Model\x00iPhone\x00FSTotalBytes\x002\x00FSFreeBytes\x001\x00FSBlockSize\x004096\x00")
+			if _, err := device.Write(afcPacket(num, services.AFCOperationData, nil, info)); err != nil {
+				return
+			}
+		}
+	}()
+
+	afc := services.NewAFCServiceWith(tunnel.NewService(tunnel.MixConnectionClient(client), nil, services.AFCServiceName))
+	defer afc.Close()
+
+	for i := 0; i < 2; i++ {
+		info, err := afc.GetDeviceInfo()
+		if err != nil {
+			t.Fatalf("request %d after a stray reply: %v", i, err)
+		}
+		if info.Model != "iPhone" || info.BlockSize != 4096 {
+			t.Errorf("device info %+v", info)
+		}
+	}
+}
+
+func TestAFCFailWhilePending(t *testing.T) {
+	server := afctest.NewServer()
+	server.Latency = time.Second
+	client, device := net.Pipe()
+	go server.Serve(device)
+
+	afc := services.NewAFCServiceWith(tunnel.NewService(tunnel.MixConnectionClient(client), nil, services.AFCServiceName))
+	defer afc.Close()
+
+	const callers = 4
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		go func() {
+			_, err := afc.GetDeviceInfo()
+			errs <- err
+		}()
+	}
+
+	/* the device goes away with every request unanswered */
+	time.Sleep(50 * time.Millisecond)
+	_ = device.Close()
+
+	timeout := time.After(5 * time.Second)
+	for i := 0; i < callers; i++ {
+		select {
+		case err := <-errs:
+			if err == nil || errors.Is(err, tunnel.ErrServiceClosed) {
+				t.Errorf("pending request = %v, want the connection error", err)
+			}
+		case <-timeout:
+			t.Fatal("request still pending after the connection broke")
+		}
+	}
+
+	/* the first error sticks for later requests */
+	if _, err := afc.GetDeviceInfo(); err == nil || errors.Is(err, tunnel.ErrServiceClosed) {
+		t.Errorf("request after failure = %v", err)
+	}
+}
+
+// withContextEnds runs a slow request under ctx next to a plain one,
+// both must be cut off once ctx ends
+func withContextEnds(t *testing.T, ctx context.Context, want error) {
+	t.Helper()
+
+	server := afctest.NewServer()
+	server.Latency = time.Second
+	afc, done := startAFC(t, server, nil)
+	defer done()
+
+	other := make(chan error, 1)
+	go func() {
+		_, err := afc.GetDeviceInfo()
+		other <- err
+	}()
+
+	start := time.Now()
+	err := afc.WithContext(ctx, func() error {
+		_, err := afc.GetDeviceInfo()
+		return err
+	})
+	if err != want {
+		t.Errorf("WithContext = %v, want %v", err, want)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("WithContext returned after %s", d)
+	}
+
+	select {
+	case err := <-other:
+		if !errors.Is(err, tunnel.ErrServiceClosed) {
+			t.Errorf("request of another caller = %v, want ErrServiceClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request of another caller still pending")
+	}
+	if _, err := afc.GetDeviceInfo(); !errors.Is(err, tunnel.ErrServiceClosed) {
+		t.Errorf("request afterwards = %v, want ErrServiceClosed", err)
+	}
+}
+
+func TestAFCWithContextCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	withContextEnds(t, ctx, context.Canceled)
+}
+
+func TestAFCWithContextDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	withContextEnds(t, ctx, context.DeadlineExceeded)
+}
+
+func TestAFCWithContextConcurrent(t *testing.T) {
+	server := afctest.NewServer()
+	server.Latency = 100 * time.Millisecond
+	afc, done := startAFC(t, server, nil)
+	defer done()
+
+	/* a short deadline must neither cut off nor outlive the other caller */
+	short, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	long, cancelLong := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelLong()
+
+	errs := make(chan error, 2)
+	for _, ctx := range []context.Context{short, long} {
+		go func(ctx context.Context) {
+			errs <- afc.WithContext(ctx, func() error {
+				for i := 0; i < 2; i++ {
+					if _, err := afc.GetDeviceInfo(); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		}(ctx)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("WithContext = %v", err)
+		}
+	}
+
+	/* the pipelined reader outlives the deadline of a finished call,
+	   also of one that failed */
+	failed, cancelFailed := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancelFailed()
+	if err := afc.WithContext(failed, func() error {
+		_, err := afc.GetFileInfo("/missing")
+		return err
+	}); err == nil {
+		t.Error("stat of a missing file succeeded")
+	}
+	<-short.Done()
+	<-failed.Done()
+	if _, err := afc.GetDeviceInfo(); err != nil {
+		t.Errorf("request after the deadline of a finished call = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ran := false
+	if err := afc.WithContext(ctx, func() error { ran = true; return nil }); err != context.Canceled || ran {
+		t.Errorf("WithContext of a cancelled ctx = %v, ran %v", err, ran)
+	}
+	if _, err := afc.GetDeviceInfo(); err != nil {
+		t.Errorf("request after a cancelled ctx that never ran = %v", err)
+	}
+}
+
+// benchmarkAFC copies size bytes through a stand-in server that answers
+// every packet after latency, once per window
+func benchmarkAFC(b *testing.B, write bool) {
+	const size = 1 << 20
+	data := bytes.Repeat([]byte("afc!"), size/4)
+
+	for _, window := range []int{1, 4, 8, 16} {
+		b.Run(fmt.Sprintf("window%d", window), func(b *testing.B) {
+			server := afctest.NewServer()
+			server.Latency = time.Millisecond
+			if err := server.WriteFile("/bench", data, time.Now()); err != nil {
+				b.Fatal(err)
+			}
+			afc, done := startAFC(b, server, nil)
+			defer done()
+			afc.Window = window
+			afc.ChunkSize = 64 << 10
+
+			b.SetBytes(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if write {
+					f, err := afc.FileOpen("/bench", services.AFC_WR)
+					if err != nil {
+						b.Fatal(err)
+					}
+					if _, err := f.ReadFrom(bytes.NewReader(data)); err != nil {
+						b.Fatal(err)
+					}
+					_ = f.Close()
+				} else {
+					f, err := afc.FileOpen("/bench", services.AFC_RDONLY)
+					if err != nil {
+						b.Fatal(err)
+					}
+					if n, err := f.WriteTo(ioutil.Discard); err != nil || n != size {
+						b.Fatal(n, err)
+					}
+					_ = f.Close()
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkAFCRead(b *testing.B) {
+	benchmarkAFC(b, false)
+}
+
+func BenchmarkAFCWrite(b *testing.B) {
+	benchmarkAFC(b, true)
+}
+
+func TestAFCFileErrorCounts(t *testing.T) {
+	server := afctest.NewServer()
+	if err := server.WriteFile("/a.txt", []byte("abc"), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	afc, done := startAFC(t, server, nil)
+	f, err := afc.FileOpen("/a.txt", services.AFC_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done()
+
+	/* io.Reader and io.Writer never return a negative count */
+	if n, err := f.Read(make([]byte, 8)); n != 0 || err == nil {
+		t.Errorf("Read on a closed service = %d, %v", n, err)
+	}
+	if n, err := f.Write([]byte("x")); n != 0 || err == nil {
+		t.Errorf("Write on a closed service = %d, %v", n, err)
+	}
+}
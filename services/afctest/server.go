@@ -0,0 +1,413 @@
+package afctest
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"iconsole/services"
+	"io"
+	"net"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var afcMagic = []byte{0x43, 0x46, 0x41, 0x36, 0x4C, 0x50, 0x41, 0x41}
+
+const afcHeaderSize = 40
+
+type node struct {
+	dir   bool
+	data  []byte
+	mtime time.Time
+}
+
+type handle struct {
+	path string
+	pos  int
+}
+
+// Server is a stand-in AFC service keeping its files in memory. Hand
+// `Serve` to `muxtest.Server.Handle`, or to one end of a `net.Pipe`, to
+// run `services.AFCService` without a device.
+type Server struct {
+	// Latency delays every reply like a slow link would, replies still
+	// leave in order and later requests are read meanwhile
+	Latency time.Duration
+
+	mutex   sync.Mutex
+	nodes   map[string]*node
+	handles map[uint64]*handle
+	nextFd  uint64
+}
+
+func NewServer() *Server {
+	return &Server{
+		nodes:   map[string]*node{"/": {dir: true, mtime: time.Now()}},
+		handles: make(map[uint64]*handle),
+		nextFd:  1,
+	}
+}
+
+// WriteFile creates or replaces a file, its parent must exist
+func (this *Server) WriteFile(name string, data []byte, mtime time.Time) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	name = clean(name)
+	if parent, ok := this.nodes[path.Dir(name)]; !ok || !parent.dir {
+		return errors.New("parent not found")
+	}
+	this.nodes[name] = &node{data: append([]byte(nil), data...), mtime: mtime}
+	return nil
+}
+
+// Mkdir creates a directory and its parents
+func (this *Server) Mkdir(name string) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.mkdirAll(clean(name))
+}
+
+// ReadFile returns a copy of a file
+func (this *Server) ReadFile(name string) ([]byte, bool) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	n, ok := this.nodes[clean(name)]
+	if !ok || n.dir {
+		return nil, false
+	}
+	return append([]byte(nil), n.data...), true
+}
+
+type reply struct {
+	due  time.Time
+	data []byte
+}
+
+// Serve answers AFC requests on conn until it is closed, conn is closed on return
+func (this *Server) Serve(conn net.Conn) {
+	defer conn.Close()
+
+	replies := make(chan reply, 1024)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for r := range replies {
+			if d := time.Until(r.due); d > 0 {
+				time.Sleep(d)
+			}
+			if _, err := conn.Write(r.data); err != nil {
+				_ = conn.Close()
+				return
+			}
+		}
+	}()
+	defer func() {
+		close(replies)
+		<-done
+	}()
+
+	for {
+		header := make([]byte, afcHeaderSize)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		if !bytes.Equal(header[:8], afcMagic) {
+			return
+		}
+		entireLen := binary.LittleEndian.Uint64(header[8:])
+		thisLen := binary.LittleEndian.Uint64(header[16:])
+		packetNum := binary.LittleEndian.Uint64(header[24:])
+		operation := binary.LittleEndian.Uint64(header[32:])
+		if thisLen < afcHeaderSize || entireLen < thisLen {
+			return
+		}
+
+		body := make([]byte, entireLen-afcHeaderSize)
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return
+		}
+		data, payload := body[:thisLen-afcHeaderSize], body[thisLen-afcHeaderSize:]
+
+		op, rdata, rpayload := this.handle(operation, data, payload)
+		replies <- reply{due: time.Now().Add(this.Latency), data: packet(packetNum, op, rdata, rpayload)}
+	}
+}
+
+func packet(packetNum, operation uint64, data, payload []byte) []byte {
+	thisLen := uint64(afcHeaderSize + len(data))
+	b := make([]byte, afcHeaderSize, int(thisLen)+len(payload))
+	copy(b, afcMagic)
+	binary.LittleEndian.PutUint64(b[8:], thisLen+uint64(len(payload)))
+	binary.LittleEndian.PutUint64(b[16:], thisLen)
+	binary.LittleEndian.PutUint64(b[24:], packetNum)
+	binary.LittleEndian.PutUint64(b[32:], operation)
+	b = append(b, data...)
+	return append(b, payload...)
+}
+
+func status(code uint64) (uint64, []byte, []byte) {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, code)
+	return services.AFCOperationStatus, b, nil
+}
+
+func strs(v ...string) (uint64, []byte, []byte) {
+	b := &bytes.Buffer{}
+	for _, s := range v {
+		b.WriteString(s)
+		b.WriteByte(0)
+	}
+	return services.AFCOperationData, nil, b.Bytes()
+}
+
+func clean(name string) string {
+	return path.Clean("/" + name)
+}
+
+func cstrs(b []byte) []string {
+	return strings.Split(strings.TrimRight(string(b), "\x00"), "\x00")
+}
+
+func (this *Server) mkdirAll(name string) {
+	for p := name; ; p = path.Dir(p) {
+		if _, ok := this.nodes[p]; !ok {
+			this.nodes[p] = &node{dir: true, mtime: time.Now()}
+		}
+		if p == "/" {
+			return
+		}
+	}
+}
+
+func (this *Server) children(name string) []string {
+	var names []string
+	prefix := strings.TrimSuffix(name, "/") + "/"
+	for p := range this.nodes {
+		if p != "/" && path.Dir(p) == name {
+			names = append(names, strings.TrimPrefix(p, prefix))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (this *Server) handle(operation uint64, data, payload []byte) (uint64, []byte, []byte) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	u64 := func(i int) uint64 {
+		if len(data) < (i+1)*8 {
+			return 0
+		}
+		return binary.LittleEndian.Uint64(data[i*8:])
+	}
+
+	switch operation {
+	case services.AFCOperationGetDeviceInfo:
+		return strs("Model", "iPhone10,3", "FSTotalBytes", "64000000000", "FSFreeBytes", "32000000000", "FSBlockSize", "4096")
+
+	case services.AFCOperationReadDir:
+		name := clean(cstrs(data)[0])
+		if n, ok := this.nodes[name]; !ok {
+			return status(services.AFCErrObjectNotFound)
+		} else if !n.dir {
+			return status(services.AFCErrInvalidArgument)
+		}
+		return strs(append([]string{".", ".."}, this.children(name)...)...)
+
+	case services.AFCOperationGetFileInfo:
+		n, ok := this.nodes[clean(cstrs(data)[0])]
+		if !ok {
+			return status(services.AFCErrObjectNotFound)
+		}
+		ifmt := "S_IFREG"
+		if n.dir {
+			ifmt = "S_IFDIR"
+		}
+		mtime := fmt.Sprint(n.mtime.UnixNano())
+		return strs("st_size", fmt.Sprint(len(n.data)), "st_blocks", fmt.Sprint((len(n.data)+511)/512),
+			"st_nlink", "1", "st_ifmt", ifmt, "st_mtime", mtime, "st_birthtime", mtime)
+
+	case services.AFCOperationMakeDir:
+		name := clean(cstrs(data)[0])
+		if n, ok := this.nodes[name]; ok && !n.dir {
+			return status(services.AFCErrObjectExists)
+		}
+		this.mkdirAll(name)
+		return status(services.AFCErrSuccess)
+
+	case services.AFCOperationRemovePath, services.AFCOperationRemovePathAndContents:
+		name := clean(cstrs(data)[0])
+		n, ok := this.nodes[name]
+		if !ok {
+			return status(services.AFCErrObjectNotFound)
+		}
+		if n.dir && len(this.children(name)) > 0 {
+			if operation == services.AFCOperationRemovePath {
+				return status(services.AFCErrDirNotEmpty)
+			}
+			for p := range this.nodes {
+				if strings.HasPrefix(p, name+"/") {
+					delete(this.nodes, p)
+				}
+			}
+		}
+		if name != "/" {
+			delete(this.nodes, name)
+		}
+		return status(services.AFCErrSuccess)
+
+	case services.AFCOperationRenamePath:
+		names := cstrs(data)
+		if len(names) < 2 {
+			return status(services.AFCErrInvalidArgument)
+		}
+		from, to := clean(names[0]), clean(names[1])
+		n, ok := this.nodes[from]
+		if !ok {
+			return status(services.AFCErrObjectNotFound)
+		}
+		if parent, ok := this.nodes[path.Dir(to)]; !ok || !parent.dir {
+			return status(services.AFCErrObjectNotFound)
+		}
+		for p, c := range this.nodes {
+			if strings.HasPrefix(p, from+"/") {
+				delete(this.nodes, p)
+				this.nodes[to+strings.TrimPrefix(p, from)] = c
+			}
+		}
+		delete(this.nodes, from)
+		this.nodes[to] = n
+		return status(services.AFCErrSuccess)
+
+	case services.AFCOperationTruncateFile:
+		n, ok := this.nodes[clean(cstrs(data[8:])[0])]
+		if !ok || n.dir {
+			return status(services.AFCErrObjectNotFound)
+		}
+		n.data = resize(n.data, int(u64(0)))
+		return status(services.AFCErrSuccess)
+
+	case services.AFCOperationSetFileModTime:
+		n, ok := this.nodes[clean(cstrs(data[8:])[0])]
+		if !ok {
+			return status(services.AFCErrObjectNotFound)
+		}
+		n.mtime = time.Unix(0, int64(u64(0)))
+		return status(services.AFCErrSuccess)
+
+	case services.AFCOperationGetFileHash:
+		n, ok := this.nodes[clean(cstrs(data)[0])]
+		if !ok || n.dir {
+			return status(services.AFCErrObjectNotFound)
+		}
+		sum := sha1.Sum(n.data)
+		return services.AFCOperationData, nil, sum[:]
+
+	case services.AFCOperationFileOpen:
+		name := clean(cstrs(data[8:])[0])
+		mode := services.AFCFileMode(u64(0))
+		n, ok := this.nodes[name]
+		if ok && n.dir {
+			return status(services.AFCErrObjectIsDir)
+		}
+		if !ok {
+			if mode == services.AFC_RDONLY || mode == services.AFC_RW {
+				return status(services.AFCErrObjectNotFound)
+			}
+			if parent, ok := this.nodes[path.Dir(name)]; !ok || !parent.dir {
+				return status(services.AFCErrObjectNotFound)
+			}
+			n = &node{mtime: time.Now()}
+			this.nodes[name] = n
+		}
+		h := &handle{path: name}
+		switch mode {
+		case services.AFC_WRONLY, services.AFC_WR:
+			n.data = nil
+		case services.AFC_APPEND, services.AFC_RDAPPEND:
+			h.pos = len(n.data)
+		}
+		fd := this.nextFd
+		this.nextFd++
+		this.handles[fd] = h
+		b := make([]byte, 8)
+		binary.LittleEndian.PutUint64(b, fd)
+		return services.AFCOperationFileOpenResult, b, nil
+
+	case services.AFCOperationFileClose:
+		if _, ok := this.handles[u64(0)]; !ok {
+			return status(services.AFCErrInvalidArgument)
+		}
+		delete(this.handles, u64(0))
+		return status(services.AFCErrSuccess)
+	}
+
+	if h, ok := this.handles[u64(0)]; ok {
+		n, ok := this.nodes[h.path]
+		if !ok {
+			return status(services.AFCErrObjectNotFound)
+		}
+		switch operation {
+		case services.AFCOperationFileRead:
+			end := h.pos + int(u64(1))
+			if end > len(n.data) {
+				end = len(n.data)
+			}
+			if h.pos >= end {
+				return services.AFCOperationData, nil, nil
+			}
+			b := append([]byte(nil), n.data[h.pos:end]...)
+			h.pos = end
+			return services.AFCOperationData, nil, b
+
+		case services.AFCOperationFileWrite:
+			if end := h.pos + len(payload); end > len(n.data) {
+				n.data = resize(n.data, end)
+			}
+			copy(n.data[h.pos:], payload)
+			h.pos += len(payload)
+			n.mtime = time.Now()
+			return status(services.AFCErrSuccess)
+
+		case services.AFCOperationFileSeek:
+			offset := int(int64(u64(2)))
+			switch u64(1) {
+			case io.SeekCurrent:
+				offset += h.pos
+			case io.SeekEnd:
+				offset += len(n.data)
+			}
+			if offset < 0 {
+				return status(services.AFCErrInvalidArgument)
+			}
+			h.pos = offset
+			return status(services.AFCErrSuccess)
+
+		case services.AFCOperationFileTell:
+			b := make([]byte, 8)
+			binary.LittleEndian.PutUint64(b, uint64(h.pos))
+			return services.AFCOperationFileTellResult, b, nil
+
+		case services.AFCOperationFileSetSize:
+			n.data = resize(n.data, int(u64(1)))
+			return status(services.AFCErrSuccess)
+		}
+	}
+
+	return status(services.AFCErrOperationNotSupported)
+}
+
+func resize(b []byte, size int) []byte {
+	if size <= len(b) {
+		return b[:size]
+	}
+	return append(b, make([]byte, size-len(b))...)
+}
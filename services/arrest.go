@@ -56,7 +56,7 @@ func (this *HouseArrestService) Documents(id string) (*AFCService, error) {
 		return nil, err
 	} else {
 		this.afc = true
-		return &AFCService{service: this.service}, nil
+		return newAFCService(this.service), nil
 	}
 }
 
@@ -69,6 +69,11 @@ func (this *HouseArrestService) Container(id string) (*AFCService, error) {
 		return nil, err
 	} else {
 		this.afc = true
-		return &AFCService{service: this.service}, nil
+		return newAFCService(this.service), nil
 	}
 }
+
+// Close closes the connection, an `AFCService` it vended goes with it
+func (this *HouseArrestService) Close() error {
+	return this.service.Close()
+}
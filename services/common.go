@@ -16,33 +16,9 @@ const (
 	InstrumentsServiceName       = "com.apple.instruments.remoteserver"
 )
 
-// the LockdownConnection must start session
+// startService goes through the device session of `DefaultSessionPool`
 func startService(name string, device frames.Device) (*tunnel.Service, error) {
-	lockdown, err := tunnel.LockdownDial(device)
-	if err != nil {
-		return nil, err
-	}
-	defer lockdown.Close()
-
-	if err := lockdown.StartSession(); err != nil {
-		return nil, err
-	}
-
-	dynamicPort, err := lockdown.StartService(name)
-	if err != nil {
-		return nil, err
-	}
-
-	if err := lockdown.StopSession(); err != nil {
-		return nil, err
-	}
-
-	baseConn, err := lockdown.GenerateConnection(dynamicPort.Port, dynamicPort.EnableServiceSSL)
-	if err != nil {
-		return nil, err
-	}
-
-	return tunnel.GenerateService(baseConn), nil
+	return DefaultSessionPool.StartService(device, name)
 }
 
 func syncServiceAndCheckError(service *tunnel.Service, resp interface{}) error {
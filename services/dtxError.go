@@ -0,0 +1,59 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"iconsole/ns"
+)
+
+var (
+	// ErrUnexpectedReply is a DTX reply object of a type the request
+	// does not answer with
+	ErrUnexpectedReply = errors.New("unexpected reply")
+)
+
+// DTXError is an `NSError` a DTX request was answered with, `Selector`
+// is the method that failed and `Device` the serial number of the device
+type DTXError struct {
+	Domain      string
+	Code        int
+	Description string
+	Selector    string
+	Device      string
+}
+
+func (this *DTXError) Error() string {
+	msg := this.Description
+	if msg == "" {
+		msg = fmt.Sprintf("%s error %d", this.Domain, this.Code)
+	}
+	if this.Selector != "" {
+		msg = this.Selector + " " + msg
+	}
+	if this.Device != "" {
+		msg += " (" + this.Device + ")"
+	}
+	return msg
+}
+
+func (this *DTXError) Is(target error) bool {
+	t, ok := target.(*DTXError)
+	return ok && t.Code == this.Code && t.Domain == this.Domain && (t.Device == "" || t.Device == this.Device)
+}
+
+// dtxError returns the reply object as a `DTXError` when it is an `NSError`
+func dtxError(obj interface{}, selector, device string) error {
+	nsErr, ok := obj.(ns.GoNSError)
+	if !ok {
+		return nil
+	}
+	err := &DTXError{Domain: nsErr.NSDomain, Code: nsErr.NSCode, Selector: selector, Device: device}
+	if info, ok := nsErr.NSUserInfo.(map[string]interface{}); ok {
+		err.Description, _ = info["NSLocalizedDescription"].(string)
+	}
+	return err
+}
+
+func unexpectedReply(selector string, obj interface{}) error {
+	return fmt.Errorf("%s %w %T", selector, ErrUnexpectedReply, obj)
+}
@@ -0,0 +1,4 @@
+package services
+
+// NewInstrumentServiceWith speaks DTX over a service already started
+var NewInstrumentServiceWith = newInstrumentService
@@ -2,11 +2,14 @@ package services
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"iconsole/frames"
 	"iconsole/ns"
 	"iconsole/tunnel"
+	"io"
+	"sync"
 	"time"
 	"unsafe"
 )
@@ -92,8 +95,13 @@ func (this DTXMessageHeader) Marshal() []byte {
 	return buf.Bytes()
 }
 
+// InstrumentService is safe for concurrent use, every call holds the
+// connection until its reply arrived. `Close` may be called any time,
+// pending calls fail with `tunnel.ErrServiceClosed`.
 type InstrumentService struct {
-	service     *tunnel.Service
+	service *tunnel.Service
+
+	mutex       sync.Mutex
 	hs          bool
 	msgId       uint32
 	channels    map[string]int32
@@ -106,23 +114,37 @@ func NewInstrumentService(device frames.Device) (*InstrumentService, error) {
 		return nil, err
 	}
 
-	if err := service.DismissSSL(); err != nil {
+	/* instruments speaks plain DTX right after the handshake */
+	if err := service.DismissSSLBypass(); err != nil {
 		return nil, err
 	}
 
+	return newInstrumentService(service), nil
+}
+
+func newInstrumentService(service *tunnel.Service) *InstrumentService {
 	return &InstrumentService{
 		service:     service,
 		channels:    make(map[string]int32),
 		openChannel: make(map[string]uint32),
-	}, nil
+	}
 }
 
+// recvPrivateMessage and sendPrivateMessage must be called with the mutex held
 func (this *InstrumentService) recvPrivateMessage() (*PrivateResponseMessage, error) {
+	msg, err := this.recvMessage()
+	if err != nil && this.service.Closed() {
+		return nil, tunnel.ErrServiceClosed
+	}
+	return msg, err
+}
+
+func (this *InstrumentService) recvMessage() (*PrivateResponseMessage, error) {
 	payloadBuf := &bytes.Buffer{}
 	for {
 		header := &DTXMessageHeader{}
 		headerBuf := make([]byte, unsafe.Sizeof(*header))
-		if _, err := this.service.GetConnection().Read(headerBuf); err != nil {
+		if _, err := io.ReadFull(this.service.GetConnection(), headerBuf); err != nil {
 			return nil, err
 		}
 
@@ -150,25 +172,17 @@ func (this *InstrumentService) recvPrivateMessage() (*PrivateResponseMessage, er
 
 		if header.FragmentId == 0 {
 			if header.FragmentCount > 1 {
+				/* the first of several fragments is a bare header */
+				this.service.TraceFrame(tunnel.TraceRecv, headerBuf)
 				continue
 			}
 		}
 
-		nRecv := 0
-		for nRecv < int(header.Length) {
-			_cap := 2048
-			left := int(header.Length) - nRecv
-			if left < _cap {
-				_cap = left
-			}
-			recvBuf := make([]byte, _cap)
-			n, err := this.service.GetConnection().Read(recvBuf)
-			if err != nil {
-				return nil, err
-			}
-			payloadBuf.Write(recvBuf[:n])
-			nRecv += n
+		start := payloadBuf.Len()
+		if _, err := io.CopyN(payloadBuf, this.service.GetConnection(), int64(header.Length)); err != nil {
+			return nil, err
 		}
+		this.service.TraceFrame(tunnel.TraceRecv, headerBuf, payloadBuf.Bytes()[start:])
 
 		if header.FragmentId == header.FragmentCount-1 {
 			break
@@ -250,16 +264,29 @@ func (this *InstrumentService) sendPrivateMessage(selector string, args *ns.DTXM
 	header.ConversationIndex = 0
 	header.ChannelCode = channel
 
+	tunnel.Logf(tunnel.LogDebug, InstrumentsServiceName, "send %s on channel %d, message %d", selector, channel, header.Identifier)
+
 	msgBuf := &bytes.Buffer{}
 	msgBuf.Write(header.Marshal())
 	msgBuf.Write(payload.Marshal())
 	msgBuf.Write(aux)
 	msgBuf.Write(sel)
 
-	_, err = this.service.GetConnection().Write(msgBuf.Bytes())
-	return err
+	if this.service.Closed() {
+		return tunnel.ErrServiceClosed
+	}
+	if _, err = this.service.GetConnection().Write(msgBuf.Bytes()); err != nil {
+		if this.service.Closed() {
+			return tunnel.ErrServiceClosed
+		}
+		return err
+	}
+	this.service.TraceFrame(tunnel.TraceSend, msgBuf.Bytes())
+	return nil
 }
 
+// makeChannel opens a channel once, later calls reuse its code for as
+// long as the connection lives
 func (this *InstrumentService) makeChannel(channel string) (uint32, error) {
 	if _, ok := this.channels[channel]; !ok {
 		return 0, fmt.Errorf("not support %s", channel)
@@ -281,6 +308,7 @@ func (this *InstrumentService) makeChannel(channel string) (uint32, error) {
 			return 0, err
 		}
 
+		this.openChannel[channel] = c
 		return c, nil
 	}
 }
@@ -302,6 +330,9 @@ type Application struct {
 }
 
 func (this *InstrumentService) AppList() ([]Application, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
 	c, err := this.makeChannel("com.apple.instruments.server.services.device.applictionListing")
 	if err != nil {
 		return nil, err
@@ -325,15 +356,26 @@ func (this *InstrumentService) AppList() ([]Application, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := dtxError(resp.Obj, "installedApplicationsMatching:registerUpdateToken:", this.service.UDID()); err != nil {
+		return nil, err
+	}
 
 	var apps []Application
-	rapps := resp.Obj.([]interface{})
+	rapps, ok := resp.Obj.([]interface{})
+	if !ok {
+		return nil, unexpectedReply("installedApplicationsMatching:registerUpdateToken:", resp.Obj)
+	}
 	for _, v := range rapps {
-		m := v.(map[string]interface{})
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, unexpectedReply("installedApplicationsMatching:registerUpdateToken:", v)
+		}
 		a := &Application{}
 		if uuids, ok := m["AppExtensionUUIDs"].([]interface{}); ok {
 			for _, uuid := range uuids {
-				a.AppExtensionUUIDs = append(a.AppExtensionUUIDs, uuid.(string))
+				if s, ok := uuid.(string); ok {
+					a.AppExtensionUUIDs = append(a.AppExtensionUUIDs, s)
+				}
 			}
 		}
 		a.BundlePath, _ = m["BundlePath"].(string)
@@ -345,7 +387,9 @@ func (this *InstrumentService) AppList() ([]Application, error) {
 		a.ContainerBundlePath, _ = m["ContainerBundlePath"].(string)
 		a.PluginIdentifier, _ = m["PluginIdentifier"].(string)
 		a.PluginUUID, _ = m["PluginUUID"].(string)
-		a.Restricted = int(m["Restricted"].(uint64))
+		if restricted, ok := m["Restricted"].(uint64); ok {
+			a.Restricted = int(restricted)
+		}
 		a.Type, _ = m["Type"].(string)
 		a.Version, _ = m["Version"].(string)
 		apps = append(apps, *a)
@@ -363,6 +407,9 @@ type Process struct {
 }
 
 func (this *InstrumentService) ProcessList() ([]Process, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
 	c, err := this.makeChannel("com.apple.instruments.server.services.deviceinfo")
 	if err != nil {
 		return nil, err
@@ -376,19 +423,29 @@ func (this *InstrumentService) ProcessList() ([]Process, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := dtxError(resp.Obj, "runningProcesses", this.service.UDID()); err != nil {
+		return nil, err
+	}
 
 	var p []Process
 
-	objs := resp.Obj.([]interface{})
+	objs, ok := resp.Obj.([]interface{})
+	if !ok {
+		return nil, unexpectedReply("runningProcesses", resp.Obj)
+	}
 	for _, v := range objs {
-		m := v.(map[string]interface{})
-		tp := &Process{}
-		if m["isApplication"].(bool) {
-			tp.IsApplication = true
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, unexpectedReply("runningProcesses", v)
+		}
+		pid, ok := m["pid"].(uint64)
+		if !ok {
+			return nil, unexpectedReply("runningProcesses", m["pid"])
 		}
-		tp.Name = m["name"].(string)
-		tp.Pid = int(m["pid"].(uint64))
-		tp.RealAppName = m["realAppName"].(string)
+		tp := &Process{Pid: int(pid)}
+		tp.IsApplication, _ = m["isApplication"].(bool)
+		tp.Name, _ = m["name"].(string)
+		tp.RealAppName, _ = m["realAppName"].(string)
 		if t, ok := m["startDate"].(time.Time); ok {
 			tp.StartDate = t
 		}
@@ -400,6 +457,9 @@ func (this *InstrumentService) ProcessList() ([]Process, error) {
 }
 
 func (this *InstrumentService) Kill(pid int) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
 	c, err := this.makeChannel("com.apple.instruments.server.services.processcontrol")
 	if err != nil {
 		return err
@@ -418,6 +478,9 @@ func (this *InstrumentService) Kill(pid int) error {
 }
 
 func (this *InstrumentService) Launch(bundleId string) (int, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
 	c, err := this.makeChannel("com.apple.instruments.server.services.processcontrol")
 	if err != nil {
 		return 0, err
@@ -457,14 +520,27 @@ func (this *InstrumentService) Launch(bundleId string) (int, error) {
 		return 0, err
 	}
 
-	if err, ok := resp.Obj.(ns.GoNSError); ok {
-		return 0, fmt.Errorf("%s", err.NSUserInfo.(map[string]interface{})["NSLocalizedDescription"])
+	if err := dtxError(resp.Obj, "launchSuspendedProcessWithDevicePath:bundleIdentifier:environment:arguments:options:", this.service.UDID()); err != nil {
+		return 0, err
 	}
 
-	return int(resp.Obj.(uint64)), nil
+	pid, ok := resp.Obj.(uint64)
+	if !ok {
+		return 0, unexpectedReply("launchSuspendedProcessWithDevicePath:bundleIdentifier:environment:arguments:options:", resp.Obj)
+	}
+	return int(pid), nil
+}
+
+// WithContext runs fn, any requests on this service, until ctx is done.
+// Its end, cancel or deadline, closes the service for every caller.
+func (this *InstrumentService) WithContext(ctx context.Context, fn func() error) error {
+	return this.service.WithContext(ctx, fn)
 }
 
 func (this *InstrumentService) Handshake() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
 	if !this.hs {
 		msg := ns.NewDTXMessage()
 		if err := msg.AppendObject(map[string]interface{}{
@@ -483,15 +559,30 @@ func (this *InstrumentService) Handshake() error {
 			return err
 		}
 
-		if resp.Obj.(string) != "_notifyOfPublishedCapabilities:" {
-			return fmt.Errorf("response obj %s", resp.Obj)
+		if s, ok := resp.Obj.(string); !ok || s != "_notifyOfPublishedCapabilities:" {
+			return unexpectedReply("_notifyOfPublishedCapabilities:", resp.Obj)
 		}
 
-		aux := resp.Aux[0].(map[string]interface{})
-		for k, v := range aux {
-			this.channels[k] = int32(v.(uint64))
+		var capabilities map[string]interface{}
+		if len(resp.Aux) > 0 {
+			capabilities, _ = resp.Aux[0].(map[string]interface{})
+		}
+		if capabilities == nil {
+			return unexpectedReply("_notifyOfPublishedCapabilities:", resp.Aux)
 		}
+		for k, v := range capabilities {
+			if version, ok := v.(uint64); ok {
+				this.channels[k] = int32(version)
+			}
+		}
+		/* the device publishes its capabilities once per connection */
+		this.hs = true
 	}
 
 	return nil
 }
+
+// Close may be called while another goroutine waits for a reply
+func (this *InstrumentService) Close() error {
+	return this.service.Close()
+}
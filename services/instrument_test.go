@@ -0,0 +1,372 @@
+package services_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"iconsole/ns"
+	"iconsole/services"
+	"iconsole/tunnel"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+	"unsafe"
+
+	"howett.net/plist"
+)
+
+const (
+	dtxMagic            = 0x1F3D5B79
+	dtxProcessControl   = "com.apple.instruments.server.services.processcontrol"
+	dtxDeviceInfo       = "com.apple.instruments.server.services.deviceinfo"
+	dtxLaunchSelector   = "launchSuspendedProcessWithDevicePath:bundleIdentifier:environment:arguments:options:"
+	dtxNotifySelector   = "_notifyOfPublishedCapabilities:"
+	dtxChannelSelector  = "_requestChannelWithCode:identifier:"
+	dtxPayloadHeaderLen = int(unsafe.Sizeof(services.DTXMessagePayloadHeader{}))
+)
+
+// dtxServer is a stand-in for the instruments service. It answers the
+// handshake, channel requests and launches, a launch gets its message
+// identifier plus 1000 as pid. Launches wait for hold to be closed when
+// it is set, launched is told of every launch request. A selector in
+// replies is answered with that object and no auxiliary instead.
+type dtxServer struct {
+	hold     chan struct{}
+	launched chan uint32
+	replies  map[string]interface{}
+
+	mutex  sync.Mutex
+	counts map[string]int
+}
+
+// count is how often selector was sent
+func (this *dtxServer) count(selector string) int {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.counts[selector]
+}
+
+func (this *dtxServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		header := &services.DTXMessageHeader{}
+		headerBuf := make([]byte, unsafe.Sizeof(*header))
+		if _, err := io.ReadFull(conn, headerBuf); err != nil {
+			return
+		}
+		if err := header.Unmarshal(headerBuf); err != nil || header.Magic != dtxMagic || header.FragmentCount != 1 {
+			return
+		}
+		body := make([]byte, header.Length)
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return
+		}
+
+		payload := &services.DTXMessagePayloadHeader{}
+		if err := payload.Unmarshal(body); err != nil {
+			return
+		}
+		selector, err := ns.NewNSKeyedArchiver().Unmarshal(body[dtxPayloadHeaderLen+int(payload.AuxiliaryLength):])
+		if err != nil {
+			return
+		}
+
+		name, _ := selector.(string)
+		this.mutex.Lock()
+		if this.counts == nil {
+			this.counts = make(map[string]int)
+		}
+		this.counts[name]++
+		this.mutex.Unlock()
+
+		var reply []byte
+		if obj, ok := this.replies[name]; ok {
+			conversation := uint32(0)
+			if header.ExpectsReply != 0 {
+				conversation = 1
+			}
+			if _, err := conn.Write(dtxReply(header.Identifier, conversation, nil, obj)); err != nil {
+				return
+			}
+			continue
+		}
+		switch selector {
+		case dtxNotifySelector:
+			aux := ns.NewDTXMessage()
+			if err := aux.AppendObject(map[string]interface{}{dtxProcessControl: 1, dtxDeviceInfo: 1}); err != nil {
+				return
+			}
+			reply = dtxReply(header.Identifier, 0, auxiliary(aux), dtxNotifySelector)
+		case dtxChannelSelector:
+			reply = dtxReply(header.Identifier, 1, nil, nil)
+		case dtxLaunchSelector:
+			if this.launched != nil {
+				this.launched <- header.Identifier
+			}
+			if this.hold != nil {
+				<-this.hold
+			}
+			reply = dtxReply(header.Identifier, 1, nil, uint64(header.Identifier+1000))
+		default:
+			continue
+		}
+		if _, err := conn.Write(reply); err != nil {
+			return
+		}
+	}
+}
+
+/* ToBytes writes a magic the decoder does not take */
+func auxiliary(msg *ns.DTXMessage) []byte {
+	b := msg.ToBytes()
+	binary.LittleEndian.PutUint64(b, 0x1df0)
+	return b
+}
+
+// archived is a reply object already encoded
+type archived []byte
+
+// archiveDicts encodes an array of dictionaries the way the device does,
+// `ns.NSKeyedArchiver` only marshals flat values
+func archiveDicts(dicts ...map[string]interface{}) archived {
+	objects := []interface{}{ns.NSNull}
+	add := func(v interface{}) plist.UID {
+		objects = append(objects, v)
+		return plist.UID(len(objects) - 1)
+	}
+
+	arrayClass := add(*ns.NSArrayClass)
+	dictClass := add(*ns.NSDictionaryClass)
+	var items []plist.UID
+	for _, dict := range dicts {
+		var d ns.NSDictionary
+		d.Class = dictClass
+		for k, v := range dict {
+			d.Keys = append(d.Keys, add(k))
+			d.Values = append(d.Values, add(v))
+		}
+		items = append(items, add(d))
+	}
+
+	array := ns.NSArray{Values: items}
+	array.Class = arrayClass
+	root := ns.NewKeyedArchiver()
+	root.Top.Root = add(array)
+	root.Objects = objects
+	data, err := plist.Marshal(root, plist.BinaryFormat)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+func dtxReply(identifier, conversation uint32, aux []byte, obj interface{}) []byte {
+	data, _ := obj.(archived)
+	if obj != nil && data == nil {
+		var err error
+		if data, err = ns.NewNSKeyedArchiver().Marshal(obj); err != nil {
+			panic(err)
+		}
+	}
+
+	payload := services.DTXMessagePayloadHeader{
+		Flags:           0x2,
+		AuxiliaryLength: uint32(len(aux)),
+		TotalLength:     uint64(len(aux) + len(data)),
+	}
+	header := services.DTXMessageHeader{
+		Magic:             dtxMagic,
+		CB:                uint32(unsafe.Sizeof(services.DTXMessageHeader{})),
+		FragmentCount:     1,
+		Length:            uint32(dtxPayloadHeaderLen) + uint32(payload.TotalLength),
+		Identifier:        identifier,
+		ConversationIndex: conversation,
+	}
+
+	b := append(header.Marshal(), payload.Marshal()...)
+	b = append(b, aux...)
+	return append(b, data...)
+}
+
+func startInstruments(t *testing.T, server *dtxServer) *services.InstrumentService {
+	t.Helper()
+
+	client, device := net.Pipe()
+	go server.serve(device)
+
+	service := tunnel.NewService(tunnel.MixConnectionClient(client), nil, services.InstrumentsServiceName)
+	instruments := services.NewInstrumentServiceWith(service)
+	if err := instruments.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	return instruments
+}
+
+func TestInstrumentConcurrentLaunch(t *testing.T) {
+	instruments := startInstruments(t, &dtxServer{})
+	defer instruments.Close()
+
+	const callers = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, callers*4)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 4; j++ {
+				pid, err := instruments.Launch("com.example.app")
+				if err != nil {
+					errs <- err
+					return
+				}
+				if pid <= 1000 {
+					errs <- errors.New("bad pid")
+					return
+				}
+				/* a second handshake must not wait for capabilities again */
+				if err := instruments.Handshake(); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	waitGroup(t, &wg)
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+/* interleaved frames may leave callers waiting forever, fail instead */
+func waitGroup(t *testing.T, wg *sync.WaitGroup) {
+	t.Helper()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("callers still running")
+	}
+}
+
+func TestInstrumentCloseWhilePending(t *testing.T) {
+	server := &dtxServer{hold: make(chan struct{}), launched: make(chan uint32, 1)}
+	defer close(server.hold)
+	instruments := startInstruments(t, server)
+
+	const callers = 4
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		go func() {
+			_, err := instruments.Launch("com.example.app")
+			errs <- err
+		}()
+	}
+
+	/* one launch is on the wire, the others wait for the connection */
+	select {
+	case <-server.launched:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no launch request")
+	}
+	if err := instruments.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := time.After(5 * time.Second)
+	for i := 0; i < callers; i++ {
+		select {
+		case err := <-errs:
+			if !errors.Is(err, tunnel.ErrServiceClosed) {
+				t.Errorf("launch cut off by Close = %v, want ErrServiceClosed", err)
+			}
+		case <-timeout:
+			t.Fatal("launch still pending after Close")
+		}
+	}
+}
+
+func TestInstrumentChannels(t *testing.T) {
+	server := &dtxServer{replies: map[string]interface{}{"runningProcesses": archiveDicts(
+		map[string]interface{}{"pid": uint64(1), "name": "launchd", "isApplication": false},
+	)}}
+	instruments := startInstruments(t, server)
+	defer instruments.Close()
+
+	for i := 0; i < 2; i++ {
+		if _, err := instruments.Launch("com.example.app"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := instruments.Kill(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := instruments.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if n := server.count(dtxNotifySelector); n != 1 {
+		t.Errorf("capabilities asked %d times, want once", n)
+	}
+	if n := server.count(dtxChannelSelector); n != 1 {
+		t.Errorf("%d channel requests for one service, want 1", n)
+	}
+
+	processes, err := instruments.ProcessList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(processes) != 1 || processes[0].Pid != 1 || processes[0].Name != "launchd" {
+		t.Errorf("processes %+v", processes)
+	}
+	if n := server.count(dtxChannelSelector); n != 2 {
+		t.Errorf("%d channel requests for two services, want 2", n)
+	}
+
+	/* the device did not publish it */
+	if _, err := instruments.AppList(); err == nil {
+		t.Error("AppList on a channel the device lacks succeeded")
+	}
+	if n := server.count(dtxChannelSelector); n != 2 {
+		t.Errorf("%d channel requests after an unknown channel, want 2", n)
+	}
+}
+
+func TestInstrumentUnexpectedReplies(t *testing.T) {
+	for name, replies := range map[string]map[string]interface{}{
+		"launch string":        {dtxLaunchSelector: "pid"},
+		"processes string":     {"runningProcesses": "processes"},
+		"processes not maps":   {"runningProcesses": []interface{}{"process"}},
+		"processes no pid":     {"runningProcesses": archiveDicts(map[string]interface{}{"name": "launchd"})},
+		"capabilities missing": {dtxNotifySelector: dtxNotifySelector},
+		"capabilities other":   {dtxNotifySelector: uint64(1)},
+	} {
+		client, device := net.Pipe()
+		server := &dtxServer{replies: replies}
+		go server.serve(device)
+		instruments := services.NewInstrumentServiceWith(tunnel.NewService(tunnel.MixConnectionClient(client), nil, services.InstrumentsServiceName))
+
+		err := instruments.Handshake()
+		if _, ok := replies[dtxNotifySelector]; !ok {
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if _, ok := replies[dtxLaunchSelector]; ok {
+				_, err = instruments.Launch("com.example.app")
+			} else {
+				_, err = instruments.ProcessList()
+			}
+		}
+		if !errors.Is(err, services.ErrUnexpectedReply) {
+			t.Errorf("%s: %v, want ErrUnexpectedReply", name, err)
+		}
+		_ = instruments.Close()
+	}
+}
@@ -137,6 +137,7 @@ func (this *MountService) UploadImage(dmg, signature, imageType string) error {
 			if _, err := baseConn.Write(b[:n]); err != nil {
 				return err
 			}
+			this.service.TraceFrame(tunnel.TraceSend, b[:n])
 		} else {
 			break
 		}
@@ -188,5 +189,5 @@ func (this *MountService) Mount(path, imageType, signature string) error {
 }
 
 func (this *MountService) Close() error {
-	return this.service.GetConnection().Close()
+	return this.service.Close()
 }
@@ -79,5 +79,5 @@ func (this *ScreenshotService) Shot(w io.Writer) error {
 }
 
 func (this *ScreenshotService) Close() error {
-	return this.service.GetConnection().Close()
+	return this.service.Close()
 }
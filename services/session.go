@@ -0,0 +1,188 @@
+package services
+
+import (
+	"errors"
+	"iconsole/frames"
+	"iconsole/tunnel"
+	"net"
+	"sync"
+)
+
+// SessionPool keeps one authenticated lockdown session per device and
+// starts every service on it, so opening a service costs a single
+// `StartService` round trip. The product version and pair record are
+// cached for the life of the pool, the session is rebuilt when the
+// device reconnected or the session broke.
+type SessionPool struct {
+	// Store holds the pair records, `tunnel.DefaultPairRecordStore` when nil
+	Store tunnel.PairRecordStore
+	// PairOptions waits for the trust dialog when a device pairs
+	PairOptions *tunnel.PairOptions
+	// Dial opens lockdown on a device, `tunnel.LockdownDial` when nil.
+	// Services are reached the same way lockdown was.
+	Dial func(device frames.Device) (*tunnel.LockdownConnection, error)
+
+	mutex    sync.Mutex
+	sessions map[string]*lockdownSession
+}
+
+// DefaultSessionPool serves the `New*Service` functions
+var DefaultSessionPool = NewSessionPool()
+
+func NewSessionPool() *SessionPool {
+	return &SessionPool{sessions: make(map[string]*lockdownSession)}
+}
+
+type lockdownSession struct {
+	mutex      sync.Mutex
+	device     frames.Device
+	lockdown   *tunnel.LockdownConnection
+	version    []int
+	pairRecord *frames.PairRecord
+}
+
+func (this *SessionPool) session(device frames.Device) *lockdownSession {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	key := device.GetConnectionType() + "\x00" + device.GetSerialNumber()
+	s, ok := this.sessions[key]
+	if !ok {
+		s = &lockdownSession{device: device}
+		this.sessions[key] = s
+	}
+	return s
+}
+
+// StartService starts name on the device session and connects to it
+func (this *SessionPool) StartService(device frames.Device, name string) (*tunnel.Service, error) {
+	tunnel.Logf(tunnel.LogDebug, "session", "start %s on %s", name, device.GetSerialNumber())
+
+	dial := this.Dial
+	if dial == nil {
+		dial = tunnel.LockdownDial
+	}
+
+	resp, start, err := this.session(device).startService(device, name, dial, this.Store, this.PairOptions)
+	if err != nil {
+		tunnel.Logf(tunnel.LogDebug, "session", "start %s: %s", name, err)
+		return nil, err
+	}
+
+	raw, err := start.dial(resp.Port)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := tunnel.MixConnectionClient(raw)
+	if resp.EnableServiceSSL {
+		if err := conn.Handshake(start.version, start.pairRecord); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+
+	return tunnel.NewService(conn, device, name), nil
+}
+
+// Close stops every session, the pool stays usable and opens new ones
+func (this *SessionPool) Close() error {
+	this.mutex.Lock()
+	sessions := this.sessions
+	this.sessions = make(map[string]*lockdownSession)
+	this.mutex.Unlock()
+
+	for _, s := range sessions {
+		s.mutex.Lock()
+		s.close()
+		s.mutex.Unlock()
+	}
+	return nil
+}
+
+// serviceStart is what connecting to a started service takes
+type serviceStart struct {
+	dial       func(port int) (net.Conn, error)
+	version    []int
+	pairRecord *frames.PairRecord
+}
+
+// startService returns the service port with what it takes to connect
+func (this *lockdownSession) startService(device frames.Device, name string, dial func(frames.Device) (*tunnel.LockdownConnection, error),
+	store tunnel.PairRecordStore, options *tunnel.PairOptions) (*frames.StartServiceResponse, *serviceStart, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.device.GetDeviceID() != device.GetDeviceID() {
+		/* usbmuxd hands out a new id when the device is plugged in again */
+		if this.lockdown != nil {
+			tunnel.Logf(tunnel.LogInfo, "session", "%s reconnected, new lockdown session", device.GetSerialNumber())
+		}
+		this.close()
+	}
+	this.device = device
+
+	for {
+		reused := this.lockdown != nil
+		if !reused {
+			if err := this.open(dial, store, options); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		resp, err := this.lockdown.StartService(name)
+		if err == nil {
+			return resp, &serviceStart{dial: this.lockdown.Dial, version: this.version, pairRecord: this.pairRecord}, nil
+		}
+
+		var lockdownErr *tunnel.LockdownError
+		if errors.As(err, &lockdownErr) && !errors.Is(err, tunnel.ErrSessionInactive) {
+			/* the device refused the service, the session is fine */
+			return nil, nil, err
+		}
+
+		this.close()
+		if !reused {
+			return nil, nil, err
+		}
+		tunnel.Logf(tunnel.LogInfo, "session", "lockdown session of %s broke, rebuilding: %s", device.GetSerialNumber(), err)
+	}
+}
+
+func (this *lockdownSession) open(dial func(frames.Device) (*tunnel.LockdownConnection, error), store tunnel.PairRecordStore, options *tunnel.PairOptions) error {
+	lockdown, err := dial(this.device)
+	if err != nil {
+		return err
+	}
+
+	lockdown.PairOptions = options
+	if this.pairRecord != nil {
+		lockdown.Version = this.version
+		lockdown.SetPairRecord(this.pairRecord)
+	}
+
+	err = lockdown.StartSession(store)
+	if err == nil && !lockdown.IsSessionStart() {
+		/* the device was paired again on the way, the session is still to start */
+		err = lockdown.StartSession(store)
+	}
+	if err != nil {
+		lockdown.Close()
+		return err
+	}
+
+	tunnel.Logf(tunnel.LogDebug, "session", "lockdown session of %s started, version %v", this.device.GetSerialNumber(), lockdown.Version)
+
+	this.lockdown = lockdown
+	this.version = lockdown.Version
+	this.pairRecord = lockdown.PairRecord()
+
+	return nil
+}
+
+func (this *lockdownSession) close() {
+	if this.lockdown != nil {
+		this.lockdown.Close()
+		this.lockdown = nil
+	}
+}
@@ -0,0 +1,344 @@
+package services_test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"iconsole/frames"
+	"iconsole/services"
+	"iconsole/services/afctest"
+	"iconsole/tunnel"
+	"iconsole/tunnel/muxtest"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"howett.net/plist"
+)
+
+// lockdownDevice answers lockdown like a paired device without SSL,
+// counting the sessions and services it started
+type lockdownDevice struct {
+	// the port `StartService` hands out
+	Port int
+
+	mutex    sync.Mutex
+	sessions int
+	started  int
+	buid     string
+}
+
+func (this *lockdownDevice) serve(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	for {
+		var h [4]byte
+		if _, err := io.ReadFull(r, h[:]); err != nil {
+			return
+		}
+		body := make([]byte, binary.BigEndian.Uint32(h[:]))
+		if _, err := io.ReadFull(r, body); err != nil {
+			return
+		}
+
+		var req map[string]interface{}
+		if _, err := plist.Unmarshal(body, &req); err != nil {
+			return
+		}
+		name, _ := req["Request"].(string)
+		resp := map[string]interface{}{"Request": name}
+
+		this.mutex.Lock()
+		switch name {
+		case "QueryType":
+			resp["Type"] = "com.apple.mobile.lockdown"
+		case "GetValue":
+			resp["Value"] = "14.2"
+		case "StartSession":
+			this.sessions++
+			this.buid, _ = req["SystemBUID"].(string)
+			resp["SessionID"] = fmt.Sprintf("SESSION-%d", this.sessions)
+			resp["EnableSessionSSL"] = false
+		case "StartService":
+			this.started++
+			resp["Service"] = req["Service"]
+			resp["Port"] = this.Port
+			resp["EnableServiceSSL"] = false
+		case "StopSession":
+		default:
+			resp["Error"] = "InvalidService"
+		}
+		this.mutex.Unlock()
+
+		out, err := plist.Marshal(resp, plist.XMLFormat)
+		if err != nil {
+			return
+		}
+		binary.BigEndian.PutUint32(h[:], uint32(len(out)))
+		if _, err := conn.Write(append(h[:], out...)); err != nil {
+			return
+		}
+	}
+}
+
+// serveTCP accepts on l until it is closed
+func serveTCP(l net.Listener, handler func(conn net.Conn)) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go handler(conn)
+	}
+}
+
+func TestSessionPoolNetwork(t *testing.T) {
+	/* lockdown has a fixed port, the device is this host */
+	l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", tunnel.LockdownPort))
+	if err != nil {
+		t.Skipf("lockdown port taken: %v", err)
+	}
+	defer l.Close()
+
+	afcListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer afcListener.Close()
+	server := afctest.NewServer()
+	server.Mkdir("/DCIM")
+	go serveTCP(afcListener, server.Serve)
+
+	lockdown := &lockdownDevice{Port: afcListener.Addr().(*net.TCPAddr).Port}
+	go serveTCP(l, lockdown.serve)
+
+	/* no usbmuxd on this host */
+	old := tunnel.SocketAddress()
+	if err := tunnel.SetSocketAddress("UNIX:/nonexistent/usbmuxd"); err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.SetSocketAddress(old)
+
+	device := frames.NewNetworkDevice("fedcba9876543210", net.IPv4(127, 0, 0, 1))
+	store := tunnel.NewMemoryPairRecordStore()
+	pool := services.NewSessionPool()
+	pool.Store = store
+	pool.Dial = tunnel.NetworkLockdownDialer(store)
+	defer pool.Close()
+
+	if _, err := pool.StartService(device, services.AFCServiceName); err != tunnel.ErrPairRecordNotFound {
+		t.Fatalf("StartService without a pair record = %v, want ErrPairRecordNotFound", err)
+	}
+
+	if err := store.SavePairRecord(device, &frames.PairRecord{HostID: "HOST", SystemBUID: "RECORD-BUID"}); err != nil {
+		t.Fatal(err)
+	}
+	service, err := pool.StartService(device, services.AFCServiceName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	afc := services.NewAFCServiceWith(service)
+	defer afc.Close()
+
+	names, err := afc.ReadDirectory("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(names) != "[. .. DCIM]" {
+		t.Errorf("listing %v", names)
+	}
+
+	lockdown.mutex.Lock()
+	defer lockdown.mutex.Unlock()
+	if lockdown.buid != "RECORD-BUID" {
+		t.Errorf("session started with BUID %q, want the one of the pair record", lockdown.buid)
+	}
+}
+
+// poolDevice is a paired USB device behind a muxtest usbmuxd, running
+// AFC on `afcPort`
+type poolDevice struct {
+	server   *muxtest.Server
+	lockdown *muxtest.Lockdown
+	store    *tunnel.MemoryPairRecordStore
+}
+
+const afcPort = 2000
+
+func startPoolDevice(t *testing.T) (*poolDevice, func()) {
+	t.Helper()
+
+	server, err := muxtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := tunnel.SocketAddress()
+	if err := tunnel.SetSocketAddress(server.Address()); err != nil {
+		_ = server.Close()
+		t.Fatal(err)
+	}
+
+	device := &poolDevice{server: server, lockdown: muxtest.NewLockdown(), store: tunnel.NewMemoryPairRecordStore()}
+	device.lockdown.ServicePort = afcPort
+	device.lockdown.Services = []string{services.AFCServiceName}
+	device.lockdown.Trust("HOST")
+	device.plug(t, 1)
+
+	return device, func() {
+		_ = tunnel.SetSocketAddress(old)
+		_ = server.Close()
+	}
+}
+
+// plug attaches the device with id, as usbmuxd does on every plug in
+func (this *poolDevice) plug(t *testing.T, id int) frames.Device {
+	t.Helper()
+
+	usb := &frames.USBDevice{DeviceModel: frames.DeviceModel{ConnectionType: "USB", DeviceID: id, SerialNumber: "0123456789abcdef"}}
+	this.server.Attach(usb)
+	if err := this.server.Handle(id, tunnel.LockdownPort, this.lockdown.Serve); err != nil {
+		t.Fatal(err)
+	}
+	if err := this.server.Handle(id, afcPort, afctest.NewServer().Serve); err != nil {
+		t.Fatal(err)
+	}
+	if err := this.store.SavePairRecord(usb, &frames.PairRecord{HostID: "HOST", SystemBUID: "BUID"}); err != nil {
+		t.Fatal(err)
+	}
+	return usb
+}
+
+func (this *poolDevice) count(request string) int {
+	n := 0
+	for _, r := range this.lockdown.Requests() {
+		if r == request {
+			n++
+		}
+	}
+	return n
+}
+
+// startAFCOn starts AFC through pool and checks it answers
+func startAFCOn(t *testing.T, pool *services.SessionPool, device frames.Device) {
+	t.Helper()
+
+	service, err := pool.StartService(device, services.AFCServiceName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	afc := services.NewAFCServiceWith(service)
+	defer afc.Close()
+	if _, err := afc.GetDeviceInfo(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSessionPoolReuse(t *testing.T) {
+	device, done := startPoolDevice(t)
+	defer done()
+	usb := &frames.USBDevice{DeviceModel: frames.DeviceModel{ConnectionType: "USB", DeviceID: 1, SerialNumber: "0123456789abcdef"}}
+
+	pool := services.NewSessionPool()
+	pool.Store = device.store
+	defer pool.Close()
+
+	for i := 0; i < 3; i++ {
+		startAFCOn(t, pool, usb)
+	}
+	if n := device.count("StartSession"); n != 1 {
+		t.Errorf("%d sessions for three services, want one", n)
+	}
+	if n := device.count("StartService"); n != 3 {
+		t.Errorf("%d StartService requests, want 3", n)
+	}
+
+	/* a refused service leaves the session alone */
+	if _, err := pool.StartService(usb, services.InstrumentsServiceName); !errors.Is(err, tunnel.ErrInvalidService) {
+		t.Errorf("StartService of an unknown service = %v, want ErrInvalidService", err)
+	}
+	startAFCOn(t, pool, usb)
+	if n := device.count("StartSession"); n != 1 {
+		t.Errorf("%d sessions after a refused service, want one", n)
+	}
+
+	/* Close stops the session, the pool opens a new one afterwards */
+	if err := pool.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := device.count("StopSession"); n != 1 {
+		t.Errorf("%d StopSession after Close, want 1", n)
+	}
+	startAFCOn(t, pool, usb)
+	if n := device.count("StartSession"); n != 2 {
+		t.Errorf("%d sessions after Close, want 2", n)
+	}
+}
+
+func TestSessionPoolExpiry(t *testing.T) {
+	device, done := startPoolDevice(t)
+	defer done()
+	usb := &frames.USBDevice{DeviceModel: frames.DeviceModel{ConnectionType: "USB", DeviceID: 1, SerialNumber: "0123456789abcdef"}}
+
+	pool := services.NewSessionPool()
+	pool.Store = device.store
+	defer pool.Close()
+
+	startAFCOn(t, pool, usb)
+
+	/* the device forgot the session, SessionInactive has it rebuilt */
+	device.lockdown.ExpireSessions()
+	startAFCOn(t, pool, usb)
+	if n := device.count("StartSession"); n != 2 {
+		t.Errorf("%d sessions after the device dropped one, want 2", n)
+	}
+
+	/* plugged in again under a new id, the old session is stopped */
+	stopped := device.count("StopSession")
+	again := device.plug(t, 2)
+	device.server.Detach(1)
+	startAFCOn(t, pool, again)
+	if n := device.count("StartSession"); n != 3 {
+		t.Errorf("%d sessions after the device reconnected, want 3", n)
+	}
+	if n := device.count("StopSession"); n != stopped+1 {
+		t.Errorf("%d StopSession after the device reconnected, want %d", n, stopped+1)
+	}
+	startAFCOn(t, pool, again)
+	if n := device.count("StartSession"); n != 3 {
+		t.Errorf("%d sessions, the new one is not reused", n)
+	}
+}
+
+func TestSessionPoolPairing(t *testing.T) {
+	device, done := startPoolDevice(t)
+	defer done()
+	usb := &frames.USBDevice{DeviceModel: frames.DeviceModel{ConnectionType: "USB", DeviceID: 1, SerialNumber: "0123456789abcdef"}}
+
+	lockdown := muxtest.NewLockdown()
+	lockdown.ServicePort = afcPort
+	if err := device.server.Handle(1, tunnel.LockdownPort, lockdown.Serve); err != nil {
+		t.Fatal(err)
+	}
+
+	pool := services.NewSessionPool()
+	pool.Store = device.store
+	defer pool.Close()
+
+	/* the host pairs again, a failed session is not kept */
+	lockdown.FailPair("UserDeniedPairing", "UserDeniedPairing")
+	for i := 0; i < 2; i++ {
+		if _, err := pool.StartService(usb, services.AFCServiceName); !errors.Is(err, tunnel.ErrUserDeniedPairing) {
+			t.Fatalf("StartService on a device denying the host = %v, want ErrUserDeniedPairing", err)
+		}
+	}
+	startAFCOn(t, pool, usb)
+	if n := device.count("StartSession"); n != 0 {
+		t.Errorf("%d sessions on the trusting lockdown", n)
+	}
+	if record, err := device.store.ReadPairRecord(usb); err != nil || !lockdown.Trusted(record.HostID) {
+		t.Errorf("stored pair record %v, %v not trusted by the device", record, err)
+	}
+}
@@ -124,6 +124,7 @@ func (this *SimulateLocationService) Start(lon, lat float64, coor string) error
 	if _, err := this.service.GetConnection().Write(buf.Bytes()); err != nil {
 		return err
 	}
+	this.service.TraceFrame(tunnel.TraceSend, buf.Bytes())
 
 	return nil
 }
@@ -132,12 +133,14 @@ func (this *SimulateLocationService) Start(lon, lat float64, coor string) error
 	version test in 12.3.1 can't stop but 13 up can stop
 */
 func (this *SimulateLocationService) Stop() error {
-	if _, err := this.service.GetConnection().Write([]byte{0x00, 0x00, 0x00, 0x01}); err != nil {
+	stop := []byte{0x00, 0x00, 0x00, 0x01}
+	if _, err := this.service.GetConnection().Write(stop); err != nil {
 		return err
 	}
+	this.service.TraceFrame(tunnel.TraceSend, stop)
 	return nil
 }
 
 func (this *SimulateLocationService) Close() error {
-	return this.service.GetConnection().Close()
+	return this.service.Close()
 }
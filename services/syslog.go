@@ -1,6 +1,7 @@
 package services
 
 import (
+	"context"
 	"errors"
 	"iconsole/frames"
 	"iconsole/tunnel"
@@ -78,6 +79,7 @@ func (this *SyslogRelayService) Relay(cb func(*SyslogRelayService, []byte) bool)
 		if err != nil && n == 0 {
 			return err
 		}
+		this.service.TraceFrame(tunnel.TraceRecv, buf[:n])
 
 		if !cb(this, this.unicode(buf[:n])) {
 			break
@@ -87,7 +89,16 @@ func (this *SyslogRelayService) Relay(cb func(*SyslogRelayService, []byte) bool)
 	return this.Close()
 }
 
+// RelayContext is `Relay` that stops when ctx is done
+func (this *SyslogRelayService) RelayContext(ctx context.Context, cb func(*SyslogRelayService, []byte) bool) error {
+	err := this.service.WithContext(ctx, func() error {
+		return this.Relay(cb)
+	})
+	this.closed = true
+	return err
+}
+
 func (this *SyslogRelayService) Close() error {
 	this.closed = true
-	return this.service.GetConnection().Close()
+	return this.service.Close()
 }
@@ -2,15 +2,7 @@
 
 package tunnel
 
-import (
-	"net"
-	"time"
+const (
+	defaultSocketNetwork = "unix"
+	defaultSocketAddress = "/var/run/usbmuxd"
 )
-
-func RawDial(timeout time.Duration) (net.Conn, error) {
-	dialer := net.Dialer{
-		Timeout: timeout,
-	}
-
-	return dialer.Dial("unix", "/var/run/usbmuxd")
-}
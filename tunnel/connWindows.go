@@ -2,15 +2,7 @@
 
 package tunnel
 
-import (
-	"net"
-	"time"
+const (
+	defaultSocketNetwork = "tcp"
+	defaultSocketAddress = "127.0.0.1:27015"
 )
-
-func RawDial(timeout time.Duration) (net.Conn, error) {
-	dialer := net.Dialer{
-		Timeout: timeout,
-	}
-
-	return dialer.Dial("tcp", "127.0.0.1:27015")
-}
@@ -0,0 +1,44 @@
+package tunnel
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// withContext runs fn until ctx is done. A cancelled or expired ctx
+// closes c, so the pending read or write returns at once. No socket
+// deadline is set: callers sharing c don't overwrite each other's, but
+// the first ctx to end tears c down for all of them.
+func withContext(ctx context.Context, c io.Closer, fn func() error) error {
+	if ctx.Done() == nil {
+		return fn()
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	closed := false
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		select {
+		case <-ctx.Done():
+			closed = true
+			_ = c.Close()
+		case <-done:
+		}
+	}()
+
+	err := fn()
+	close(done)
+	wg.Wait()
+
+	if closed {
+		return ctx.Err()
+	}
+	return err
+}
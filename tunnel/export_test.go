@@ -0,0 +1,11 @@
+package tunnel
+
+import "time"
+
+// SetPlistTimeout shortens the usbmuxd request deadline, the returned
+// func restores it
+func SetPlistTimeout(d time.Duration) func() {
+	old := plistTimeout
+	plistTimeout = d
+	return func() { plistTimeout = old }
+}
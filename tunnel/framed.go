@@ -0,0 +1,116 @@
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"iconsole/frames"
+	"io"
+	"net"
+	"sync"
+)
+
+const (
+	bufferedConnSize = 64 << 10
+	// larger buffers go back to the GC instead of the pool
+	maxPooledBufferSize = 1 << 20
+)
+
+// bufferedConn reads through bufio, so framed reads cost one syscall
+// for many small messages. Hand the same value on to the next layer or
+// the buffered bytes are lost.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func newBufferedConn(conn net.Conn) net.Conn {
+	if _, ok := conn.(*bufferedConn); ok {
+		return conn
+	}
+	return &bufferedConn{Conn: conn, reader: bufio.NewReaderSize(conn, bufferedConnSize)}
+}
+
+func (this *bufferedConn) Read(b []byte) (int, error) {
+	return this.reader.Read(b)
+}
+
+var framePool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+func getFrameBuffer() *bytes.Buffer {
+	buf := framePool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putFrameBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledBufferSize {
+		framePool.Put(buf)
+	}
+}
+
+// readPackage reads one usbmuxd frame, the body is never shared. Read
+// buffers are deliberately not pooled, the package keeps a slice of its
+// buffer and callers hold on to it, or to plist data decoded from it,
+// long after the next read. Only `writeFrame` buffers are pooled.
+func readPackage(r io.Reader) (*frames.Package, error) {
+	var header [frames.PackageHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	length := binary.LittleEndian.Uint32(header[:4])
+	if err := frames.CheckPackageLength(length); err != nil {
+		return nil, err
+	}
+
+	pkgBuf := make([]byte, length)
+	copy(pkgBuf, header[:])
+	if _, err := io.ReadFull(r, pkgBuf[frames.PackageHeaderSize:]); err != nil {
+		return nil, err
+	}
+
+	return frames.Unpack(pkgBuf)
+}
+
+// readServicePackage reads one lockdown service frame of at most max
+// body bytes, zero means `frames.MaxServicePackageSize`. The body is
+// the caller's, not pooled for the same reason as `readPackage`.
+func readServicePackage(r io.Reader, max uint32) (*frames.ServicePackage, error) {
+	var header [frames.ServicePackageHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header[:])
+	if max != 0 && length > max {
+		return nil, &frames.FrameError{Frame: "lockdown", Length: uint64(length), Err: frames.ErrFrameTooLarge}
+	} else if err := frames.CheckServicePackageLength(length); err != nil {
+		return nil, err
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	return &frames.ServicePackage{Length: length, Body: body}, nil
+}
+
+// writeFrame packs into a pooled buffer and writes it at once, a frame
+// split over several writes would also be split over TLS records
+func writeFrame(w io.Writer, pack func(buf *bytes.Buffer) error) error {
+	buf := getFrameBuffer()
+	defer putFrameBuffer(buf)
+
+	if err := pack(buf); err != nil {
+		return err
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
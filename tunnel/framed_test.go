@@ -0,0 +1,163 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"iconsole/frames"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"howett.net/plist"
+)
+
+var benchmarkRequest = map[string]interface{}{
+	"MessageType":         "ReadPairRecord",
+	"PairRecordID":        "00008030-001A2D3C0E62802E",
+	"ClientVersionString": "iconsole",
+	"ProgName":            "iconsole",
+	"kLibUSBMuxVersion":   3,
+}
+
+// repeatReader replays b forever
+type repeatReader struct {
+	b   []byte
+	off int
+}
+
+func (this *repeatReader) Read(p []byte) (int, error) {
+	n := copy(p, this.b[this.off:])
+	this.off = (this.off + n) % len(this.b)
+	return n, nil
+}
+
+// readerConn is a net.Conn that only reads
+type readerConn struct {
+	net.Conn
+	Reader io.Reader
+}
+
+func (this *readerConn) Read(b []byte) (int, error) {
+	return this.Reader.Read(b)
+}
+
+func usbmuxdFrame(b *testing.B) []byte {
+	pkg := &frames.Package{Version: 1, Type: frames.PlistMessage, Tag: 1}
+	raw, err := pkg.Pack(benchmarkRequest)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return raw
+}
+
+func serviceFrame(b *testing.B, size int) []byte {
+	body, err := plist.Marshal(map[string]interface{}{"Request": "GetValue", "Value": make([]byte, size)}, plist.XMLFormat)
+	if err != nil {
+		b.Fatal(err)
+	}
+	raw := make([]byte, 4, 4+len(body))
+	binary.BigEndian.PutUint32(raw, uint32(len(body)))
+	return append(raw, body...)
+}
+
+func BenchmarkReadPackage(b *testing.B) {
+	raw := usbmuxdFrame(b)
+	r := newBufferedConn(&readerConn{Reader: &repeatReader{b: raw}})
+	b.SetBytes(int64(len(raw)))
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := readPackage(r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkReadServicePackage(b *testing.B, size int) {
+	raw := serviceFrame(b, size)
+	r := newBufferedConn(&readerConn{Reader: &repeatReader{b: raw}})
+	b.SetBytes(int64(len(raw)))
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := readServicePackage(r, 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadServicePackageSmall(b *testing.B) { benchmarkReadServicePackage(b, 64) }
+func BenchmarkReadServicePackageLarge(b *testing.B) { benchmarkReadServicePackage(b, 256<<10) }
+
+func BenchmarkWriteFramePlist(b *testing.B) {
+	pkg := &frames.Package{Version: 1, Type: frames.PlistMessage, Tag: 1}
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		if err := writeFrame(ioutil.Discard, func(buf *bytes.Buffer) error {
+			return pkg.PackTo(buf, benchmarkRequest)
+		}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWriteFrameRaw(b *testing.B) {
+	body := make([]byte, 64<<10)
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		if err := writeFrame(ioutil.Discard, func(buf *bytes.Buffer) error {
+			var header [4]byte
+			binary.BigEndian.PutUint32(header[:], uint32(len(body)))
+			buf.Write(header[:])
+			buf.Write(body)
+			return nil
+		}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestReadPackageRoundTrip(t *testing.T) {
+	pkg := &frames.Package{Version: 1, Type: frames.PlistMessage, Tag: 42}
+	var buf bytes.Buffer
+	if err := writeFrame(&buf, func(b *bytes.Buffer) error {
+		return pkg.PackTo(b, benchmarkRequest)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := readPackage(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Tag != 42 || got.Type != frames.PlistMessage {
+		t.Errorf("read %+v", got)
+	}
+	var m map[string]interface{}
+	if err := got.UnmarshalBody(&m); err != nil {
+		t.Fatal(err)
+	}
+	if m["PairRecordID"] != benchmarkRequest["PairRecordID"] {
+		t.Errorf("body %v", m)
+	}
+
+	if _, err := readPackage(&buf); err != io.EOF {
+		t.Errorf("read past the end = %v", err)
+	}
+}
+
+func TestReadServicePackageLimit(t *testing.T) {
+	raw := make([]byte, 4+100)
+	binary.BigEndian.PutUint32(raw, 100)
+
+	if _, err := readServicePackage(bytes.NewReader(raw), 50); err == nil {
+		t.Error("frame over the limit accepted")
+	}
+	if pkg, err := readServicePackage(bytes.NewReader(raw), 0); err != nil || len(pkg.Body) != 100 {
+		t.Errorf("read %v, %v", pkg, err)
+	}
+}
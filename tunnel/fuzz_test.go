@@ -0,0 +1,127 @@
+//go:build go1.18
+// +build go1.18
+
+package tunnel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"iconsole/frames"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"howett.net/plist"
+)
+
+/* real usbmuxd and lockdown messages, shared with the frames fuzz targets */
+func seedBodies(f *testing.F) [][]byte {
+	files, err := filepath.Glob(filepath.Join("..", "frames", "testdata", "*.plist"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	var bodies [][]byte
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			f.Fatal(err)
+		}
+		bodies = append(bodies, b)
+	}
+	return bodies
+}
+
+func FuzzReadServicePackage(f *testing.F) {
+	for _, body := range seedBodies(f) {
+		raw := make([]byte, frames.ServicePackageHeaderSize, frames.ServicePackageHeaderSize+len(body))
+		binary.BigEndian.PutUint32(raw, uint32(len(body)))
+		raw = append(raw, body...)
+		f.Add(raw, uint32(0))
+		f.Add(raw, uint32(len(body)-1))
+		/* two frames back to back, as they come off the wire */
+		f.Add(append(append([]byte{}, raw...), raw...), uint32(0))
+	}
+
+	f.Fuzz(func(t *testing.T, raw []byte, max uint32) {
+		r := bytes.NewReader(raw)
+		for {
+			before := r.Len()
+			pkg, err := readServicePackage(r, max)
+			if err != nil {
+				var frameErr *frames.FrameError
+				if errors.As(err, &frameErr) && frameErr.Error() == "" {
+					t.Fatal("empty frame error")
+				}
+				return
+			}
+			if max != 0 && uint32(len(pkg.Body)) > max {
+				t.Fatalf("%d byte body over the %d limit", len(pkg.Body), max)
+			}
+			if used := before - r.Len(); used != frames.ServicePackageHeaderSize+len(pkg.Body) {
+				t.Fatalf("read %d bytes for a %d byte body", used, len(pkg.Body))
+			}
+		}
+	})
+}
+
+func FuzzReadPackage(f *testing.F) {
+	for _, body := range seedBodies(f) {
+		var buf bytes.Buffer
+		pkg := &frames.Package{Version: 1, Type: frames.PlistMessage}
+		pkg.PackBinaryTo(&buf, body)
+		f.Add(buf.Bytes())
+	}
+
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		r := bytes.NewReader(raw)
+		for {
+			pkg, err := readPackage(r)
+			if err != nil {
+				return
+			}
+			/* notifications of either protocol decode or fail, never panic */
+			if msg, err := decodePackage(pkg); err == nil && msg == nil {
+				t.Fatal("nil message without an error")
+			}
+		}
+	})
+}
+
+func FuzzDecodeMessage(f *testing.F) {
+	for _, body := range seedBodies(f) {
+		f.Add(body)
+	}
+	/* wrong property types from a confused daemon */
+	f.Add([]byte(`<plist><dict><key>MessageType</key><string>Attached</string><key>DeviceID</key><string>3</string></dict></plist>`))
+	f.Add([]byte(`<plist><dict><key>MessageType</key><string>Attached</string><key>DeviceID</key><integer>3</integer>` +
+		`<key>Properties</key><dict><key>ConnectionType</key><string>Network</string><key>DeviceID</key><integer>3</integer>` +
+		`<key>NetworkAddress</key><string>fe80::1</string></dict></dict></plist>`))
+
+	f.Fuzz(func(t *testing.T, body []byte) {
+		var m map[string]interface{}
+		if _, err := plist.Unmarshal(body, &m); err != nil {
+			return
+		}
+
+		msg, err := decodeMessage(m)
+		var propErr *PropertyError
+		if errors.As(err, &propErr) {
+			if propErr.Key == "" || propErr.Error() == "" {
+				t.Fatalf("property error %#v", propErr)
+			}
+			return
+		} else if err != nil {
+			return
+		}
+
+		if attached, ok := msg.(*frames.DeviceAttached); ok {
+			if attached.Properties == nil {
+				t.Fatal("attached without a device")
+			}
+			if d, ok := attached.Properties.(*frames.NetworkDevice); ok {
+				_, _ = d.IP()
+			}
+		}
+	})
+}
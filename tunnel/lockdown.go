@@ -2,15 +2,16 @@ package tunnel
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
-	"fmt"
 	"iconsole/frames"
 	"math/big"
+	"net"
 	"strconv"
 	"strings"
 	"time"
@@ -28,6 +29,11 @@ type LockdownConnection struct {
 	device     frames.Device
 	pairRecord *frames.PairRecord
 	sslSession *frames.StartSessionResponse
+	store      PairRecordStore
+	/* wait for the trust dialog when set */
+	PairOptions *PairOptions
+	/* direct connection without usbmuxd */
+	dial func(port int) (net.Conn, error)
 }
 
 func getPemCertificate(cert []byte) ([]byte, error) {
@@ -68,6 +74,9 @@ func (this *LockdownConnection) generatePairRecord(devicePubkeyPEM []byte) (*fra
 	}
 
 	block, _ := pem.Decode(devicePubkeyPEM)
+	if block == nil {
+		return nil, errors.New("DevicePublicKey not PEM encoded")
+	}
 	deviceKey, err := x509.ParsePKCS1PublicKey(block.Bytes)
 	if err != nil {
 		return nil, err
@@ -160,12 +169,23 @@ func (this *LockdownConnection) generatePairRecord(devicePubkeyPEM []byte) (*fra
 }
 
 func LockdownDial(device frames.Device) (*LockdownConnection, error) {
-	c, err := Connect(device, LockdownPort)
+	return LockdownDialContext(context.Background(), device)
+}
+
+// LockdownDialContext is `LockdownDial` that gives up when ctx is done
+func LockdownDialContext(ctx context.Context, device frames.Device) (*LockdownConnection, error) {
+	c, err := ConnectContext(ctx, device, LockdownPort)
 	if err != nil {
 		return nil, err
 	}
 
-	s := &Service{conn: MixConnectionClient(c.RawConn)}
+	/* the connect request deadline would end an idle session */
+	if err := c.RawConn.SetDeadline(time.Time{}); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	s := NewService(MixConnectionClient(c.RawConn), device, LockdownServiceName)
 
 	return &LockdownConnection{conn: s, device: device}, nil
 }
@@ -178,10 +198,10 @@ func (this *LockdownConnection) Pair() (*frames.PairRecord, error) {
 
 	var devicePub []byte
 
-	if valueResp.Value == nil {
-		return nil, fmt.Errorf("%s", valueResp.Error)
-	} else if d, ok := valueResp.Value.([]byte); ok {
+	if d, ok := valueResp.Value.([]byte); ok {
 		devicePub = d
+	} else {
+		return nil, &PropertyError{Key: "DevicePublicKey", Value: valueResp.Value}
 	}
 
 	buid, err := ReadBUID()
@@ -192,8 +212,8 @@ func (this *LockdownConnection) Pair() (*frames.PairRecord, error) {
 	wifiAddress := ""
 
 	valueResp, err = this.GetValue("", "WiFiAddress")
-	if err == nil && valueResp.Value != nil {
-		wifiAddress = valueResp.Value.(string)
+	if err == nil {
+		wifiAddress, _ = valueResp.Value.(string)
 	}
 
 	record, err := this.generatePairRecord(devicePub)
@@ -203,17 +223,92 @@ func (this *LockdownConnection) Pair() (*frames.PairRecord, error) {
 
 	record.SystemBUID = buid
 	record.HostID = strings.ToUpper(uuid.NewV4().String())
-	hostPrivKey := record.HostPrivateKey
-	record.HostPrivateKey = nil
-	rootPrivKey := record.RootPrivateKey
-	record.RootPrivateKey = nil
 
-	request := &frames.PairRequest{
-		LockdownRequest: *frames.CreateLockdownRequest("Pair"),
-		PairRecord:      record,
-		PairingOptions: map[string]interface{}{
+	resp, err := this.waitPair(record)
+	if err != nil {
+		return nil, err
+	}
+
+	record.EscrowBag = resp.EscrowBag
+	record.WiFiMACAddress = wifiAddress
+
+	return record, nil
+}
+
+// waitPair repeats the pair request while the device waits for the
+// user, as long as `PairOptions` allows
+func (this *LockdownConnection) waitPair(record *frames.PairRecord) (*frames.PairResponse, error) {
+	var deadline time.Time
+	if this.PairOptions != nil {
+		deadline = time.Now().Add(this.PairOptions.Timeout)
+	}
+
+	for {
+		resp, err := this.pairRequest("Pair", record, map[string]interface{}{
 			"ExtendedPairingErrors": true,
-		},
+		})
+		if err == nil {
+			return resp, nil
+		}
+
+		if this.PairOptions == nil {
+			return nil, err
+		} else if !errors.Is(err, ErrPairingDialogResponsePending) && !errors.Is(err, ErrPasswordProtected) {
+			return nil, err
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, err
+		}
+
+		if this.PairOptions.Progress != nil {
+			this.PairOptions.Progress(err, remaining)
+		}
+
+		interval := this.PairOptions.Interval
+		if interval <= 0 {
+			interval = time.Second
+		}
+		if interval > remaining {
+			interval = remaining
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Unpair removes the host from the device trusted list, the record
+// should be deleted from its store afterwards
+func (this *LockdownConnection) Unpair(record *frames.PairRecord) error {
+	if record == nil {
+		return errors.New("record nil")
+	}
+
+	_, err := this.pairRequest("Unpair", &frames.PairRecord{HostID: record.HostID}, nil)
+	return err
+}
+
+// ValidatePair asks the device whether record still is a trusted pairing
+func (this *LockdownConnection) ValidatePair(record *frames.PairRecord) error {
+	if record == nil {
+		return errors.New("record nil")
+	}
+
+	_, err := this.pairRequest("ValidatePair", record, nil)
+	return err
+}
+
+// the host private keys never leave this machine
+func (this *LockdownConnection) pairRequest(req string, record *frames.PairRecord, options map[string]interface{}) (*frames.PairResponse, error) {
+	public := *record
+	public.HostPrivateKey = nil
+	public.RootPrivateKey = nil
+	public.EscrowBag = nil
+
+	request := &frames.PairRequest{
+		LockdownRequest: *frames.CreateLockdownRequest(req),
+		PairRecord:      &public,
+		PairingOptions:  options,
 	}
 
 	if err := this.conn.SendXML(request); err != nil {
@@ -229,16 +324,22 @@ func (this *LockdownConnection) Pair() (*frames.PairRecord, error) {
 		return nil, err
 	}
 
-	if resp.Error != "" {
-		return nil, fmt.Errorf("%s", resp.Error)
+	if err := this.lockdownError(resp.Request, resp.Error); err != nil {
+		return nil, err
 	}
 
-	record.EscrowBag = resp.EscrowBag
-	record.WiFiMACAddress = wifiAddress
-	record.HostPrivateKey = hostPrivKey
-	record.RootPrivateKey = rootPrivKey
+	return &resp, nil
+}
 
-	return record, nil
+// PairRecord in use after `Handshake`
+func (this *LockdownConnection) PairRecord() *frames.PairRecord {
+	return this.pairRecord
+}
+
+// SetPairRecord uses a record known from an earlier connection, with
+// `Version` set as well `StartSession` skips the handshake
+func (this *LockdownConnection) SetPairRecord(record *frames.PairRecord) {
+	this.pairRecord = record
 }
 
 func (this *LockdownConnection) StopSession() error {
@@ -264,8 +365,8 @@ func (this *LockdownConnection) StopSession() error {
 		return err
 	}
 
-	if resp.Error != "" {
-		return fmt.Errorf("%s", resp.Error)
+	if err := this.lockdownError(resp.Request, resp.Error); err != nil {
+		return err
 	}
 
 	this.sslSession = nil
@@ -276,22 +377,27 @@ func (this *LockdownConnection) IsSessionStart() bool {
 	return this.sslSession != nil
 }
 
-func (this *LockdownConnection) StartSession() error {
+func (this *LockdownConnection) StartSession(store PairRecordStore) error {
+	this.store = pairRecordStore(store)
+
 	if this.IsSessionStart() {
 		if err := this.StopSession(); err != nil {
 			return err
 		}
 	}
 
-	if this.pairRecord == nil {
-		if err := this.Handshake(); err != nil {
+	if this.pairRecord == nil || this.Version == nil {
+		if err := this.Handshake(store); err != nil {
 			return err
 		}
 	}
 
-	buid, err := ReadBUID()
-	if err != nil {
-		return err
+	buid := this.pairRecord.SystemBUID
+	if this.dial == nil || buid == "" {
+		var err error
+		if buid, err = ReadBUID(); err != nil {
+			return err
+		}
 	}
 
 	request := &frames.StartSessionRequest{
@@ -314,16 +420,16 @@ func (this *LockdownConnection) StartSession() error {
 		return err
 	}
 
-	if resp.Error != "" {
-		if resp.Error == "InvalidHostID" {
+	if err := this.lockdownError(resp.Request, resp.Error); err != nil {
+		if errors.Is(err, ErrInvalidHostID) && this.dial == nil {
 			/* try repair device */
 			this.pairRecord = nil
-			if err := DeletePairRecord(this.device); err != nil {
+			if err := this.store.DeletePairRecord(this.device); err != nil {
 				return err
 			}
-			return this.Handshake()
+			return this.Handshake(this.store)
 		}
-		return fmt.Errorf("%s", resp.Error)
+		return err
 	}
 
 	this.sslSession = &resp
@@ -337,7 +443,11 @@ func (this *LockdownConnection) StartSession() error {
 	return nil
 }
 
-func (this *LockdownConnection) Handshake() error {
+// Handshake reads the product version and loads the host pair record
+// from store, pairing the device when there is none yet
+func (this *LockdownConnection) Handshake(store PairRecordStore) error {
+	this.store = pairRecordStore(store)
+
 	qtResp, err := this.QueryType()
 	if err != nil {
 		return err
@@ -350,22 +460,28 @@ func (this *LockdownConnection) Handshake() error {
 	if err != nil {
 		return err
 	}
-	if pvResp.Error != "" {
-		return fmt.Errorf("%s", pvResp.Error)
+
+	pv, ok := pvResp.Value.(string)
+	if !ok {
+		return &PropertyError{Key: "ProductVersion", Value: pvResp.Value}
 	}
 
-	version := strings.Split(pvResp.Value.(string), ".")
+	version := strings.Split(pv, ".")
 	this.Version = make([]int, len(version))
 	for i, v := range version {
 		this.Version[i], _ = strconv.Atoi(v)
 	}
 
-	if fResp, err := ReadPairRecord(this.device); err != nil {
+	if this.pairRecord != nil {
+		return nil
+	}
+
+	if fResp, err := this.store.ReadPairRecord(this.device); err != nil {
 		// try pair device
 		if record, err := this.Pair(); err != nil {
 			return err
-		} else if resp, err := ReadPairRecord(this.device); err != nil {
-			if err := SavePairRecord(this.device, record); err != nil {
+		} else if resp, err := this.store.ReadPairRecord(this.device); err != nil {
+			if err := this.store.SavePairRecord(this.device, record); err != nil {
 				return err
 			} else {
 				this.pairRecord = record
@@ -413,8 +529,8 @@ func (this *LockdownConnection) rawStartService(service string, escrowBag bool)
 		return nil, err
 	}
 
-	if resp.Error != "" {
-		return nil, errors.New(resp.Error)
+	if err := this.lockdownError(resp.Request, resp.Error); err != nil {
+		return nil, err
 	}
 
 	return &resp, nil
@@ -435,8 +551,8 @@ func (this *LockdownConnection) QueryType() (*frames.LockdownTypeResponse, error
 		return nil, err
 	}
 
-	if resp.Error != "" {
-		return nil, fmt.Errorf("%s", resp.Error)
+	if err := this.lockdownError(resp.Request, resp.Error); err != nil {
+		return nil, err
 	}
 
 	return &resp, nil
@@ -463,8 +579,8 @@ func (this *LockdownConnection) GetValue(domain string, key string) (*frames.Loc
 		return nil, err
 	}
 
-	if resp.Error != "" {
-		return nil, fmt.Errorf("%s", resp.Error)
+	if err := this.lockdownError(resp.Request, resp.Error); err != nil {
+		return nil, err
 	}
 
 	return &resp, nil
@@ -490,8 +606,8 @@ func (this *LockdownConnection) SetValue(domain string, key string, value interf
 		return nil, err
 	}
 
-	if resp.Error != "" {
-		return nil, fmt.Errorf("%s", resp.Error)
+	if err := this.lockdownError(resp.Request, resp.Error); err != nil {
+		return nil, err
 	}
 
 	return &resp, nil
@@ -504,11 +620,10 @@ func (this *LockdownConnection) GetStringValue(key string) (string, error) {
 		return "", err
 	}
 
-	if resp.Error != "" {
-		return "", fmt.Errorf("%s", resp.Error)
+	if v, ok := resp.Value.(string); ok {
+		return v, nil
 	}
-
-	return resp.Value.(string), nil
+	return "", &PropertyError{Key: key, Value: resp.Value}
 }
 
 func (this *LockdownConnection) EnterRecovery() error {
@@ -526,8 +641,8 @@ func (this *LockdownConnection) EnterRecovery() error {
 		return err
 	}
 
-	if resp.Error != "" {
-		return fmt.Errorf("%s", resp.Error)
+	if err := this.lockdownError(resp.Request, resp.Error); err != nil {
+		return err
 	}
 
 	return nil
@@ -559,22 +674,17 @@ func (this *LockdownConnection) ProductName() (string, error) {
 
 func (this *LockdownConnection) GenerateConnection(port int, enableSSL bool) (*MixConnection, error) {
 	if enableSSL && (this.pairRecord == nil || this.Version == nil) {
-		if err := this.Handshake(); err != nil {
+		if err := this.Handshake(this.store); err != nil {
 			return nil, err
 		}
 	}
 
-	base, err := Connect(this.device, port)
+	conn, err := this.Dial(port)
 	if err != nil {
 		return nil, err
 	}
 
-	/* clean deadline */
-	if err := base.RawConn.SetDeadline(time.Time{}); err != nil {
-		return nil, err
-	}
-
-	client := MixConnectionClient(base.RawConn)
+	client := MixConnectionClient(conn)
 
 	if enableSSL {
 		if err := client.Handshake(this.Version, this.pairRecord); err != nil {
@@ -585,8 +695,38 @@ func (this *LockdownConnection) GenerateConnection(port int, enableSSL bool) (*M
 	return client, nil
 }
 
+// Dial connects to a service port the way lockdown itself was reached,
+// through usbmuxd or straight over TCP
+func (this *LockdownConnection) Dial(port int) (net.Conn, error) {
+	if this.dial != nil {
+		return this.dial(port)
+	}
+
+	base, err := Connect(this.device, port)
+	if err != nil {
+		return nil, err
+	}
+
+	/* clean deadline */
+	if err := base.RawConn.SetDeadline(time.Time{}); err != nil {
+		base.Close()
+		return nil, err
+	}
+
+	return base.RawConn, nil
+}
+
 func GenerateService(c *MixConnection) *Service {
-	return &Service{conn: c}
+	return NewService(c, nil, "")
+}
+
+// WithContext runs fn, usually a few requests, until ctx is done,
+// cancelling closes the connection
+func (this *LockdownConnection) WithContext(ctx context.Context, fn func() error) error {
+	if this.conn == nil {
+		return ErrNoConnection
+	}
+	return this.conn.WithContext(ctx, fn)
 }
 
 func (this *LockdownConnection) Close() {
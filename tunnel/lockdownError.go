@@ -0,0 +1,71 @@
+package tunnel
+
+import (
+	"time"
+)
+
+// LockdownError is the `Error` a lockdown request came back with,
+// `Device` is the serial number of the device that answered. Compare
+// against the sentinels below with `errors.Is`
+type LockdownError struct {
+	Request string
+	Code    string
+	Device  string
+}
+
+func (this *LockdownError) Error() string {
+	msg := this.Code
+	if this.Request != "" {
+		msg = this.Request + ": " + msg
+	}
+	if this.Device != "" {
+		msg += " (" + this.Device + ")"
+	}
+	return msg
+}
+
+func (this *LockdownError) Is(target error) bool {
+	t, ok := target.(*LockdownError)
+	return ok && t.Code == this.Code &&
+		(t.Request == "" || t.Request == this.Request) &&
+		(t.Device == "" || t.Device == this.Device)
+}
+
+var (
+	ErrPasswordProtected            = &LockdownError{Code: "PasswordProtected"}
+	ErrPairingDialogResponsePending = &LockdownError{Code: "PairingDialogResponsePending"}
+	ErrUserDeniedPairing            = &LockdownError{Code: "UserDeniedPairing"}
+	ErrInvalidHostID                = &LockdownError{Code: "InvalidHostID"}
+	ErrSessionInactive              = &LockdownError{Code: "SessionInactive"}
+	ErrInvalidService               = &LockdownError{Code: "InvalidService"}
+)
+
+/* every lockdown reply passes here, so it also logs them */
+func lockdownError(device, request, code string) error {
+	if code == "" {
+		debugf(LockdownServiceName, "%s: ok", request)
+		return nil
+	}
+	debugf(LockdownServiceName, "%s: %s", request, code)
+	return &LockdownError{Request: request, Code: code, Device: device}
+}
+
+func (this *LockdownConnection) lockdownError(request, code string) error {
+	var device string
+	if this.device != nil {
+		device = this.device.GetSerialNumber()
+	}
+	return lockdownError(device, request, code)
+}
+
+// PairOptions makes `Pair` and `Handshake` wait for the user to answer
+// the trust dialog instead of failing right away
+type PairOptions struct {
+	// give up after this long
+	Timeout time.Duration
+	// between two attempts, one second when zero
+	Interval time.Duration
+	// called before every retry with the pending error, either
+	// `ErrPairingDialogResponsePending` or `ErrPasswordProtected`
+	Progress func(err error, remaining time.Duration)
+}
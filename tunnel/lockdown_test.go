@@ -0,0 +1,315 @@
+package tunnel_test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"iconsole/frames"
+	"iconsole/tunnel"
+	"iconsole/tunnel/muxtest"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"howett.net/plist"
+)
+
+// lockdownStub answers lockdown requests like an unpaired device would
+func lockdownStub(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	for {
+		var h [4]byte
+		if _, err := io.ReadFull(r, h[:]); err != nil {
+			return
+		}
+		body := make([]byte, binary.BigEndian.Uint32(h[:]))
+		if _, err := io.ReadFull(r, body); err != nil {
+			return
+		}
+
+		var req map[string]interface{}
+		if _, err := plist.Unmarshal(body, &req); err != nil {
+			return
+		}
+		name, _ := req["Request"].(string)
+		resp := map[string]interface{}{"Request": name}
+		switch name {
+		case "QueryType":
+			resp["Type"] = "com.apple.mobile.lockdown"
+		case "GetValue":
+			resp["Value"] = "13.4"
+		default:
+			resp["Error"] = "InvalidService"
+		}
+
+		out, err := plist.Marshal(resp, plist.XMLFormat)
+		if err != nil {
+			return
+		}
+		binary.BigEndian.PutUint32(h[:], uint32(len(out)))
+		if _, err := conn.Write(append(h[:], out...)); err != nil {
+			return
+		}
+	}
+}
+
+// startMux points the package at a fresh muxtest server with one USB
+// device attached, the returned func restores the previous daemon
+func startMux(t *testing.T) (*muxtest.Server, *frames.USBDevice, func()) {
+	t.Helper()
+
+	server, err := muxtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old := tunnel.SocketAddress()
+	if err := tunnel.SetSocketAddress(server.Address()); err != nil {
+		_ = server.Close()
+		t.Fatal(err)
+	}
+
+	device := &frames.USBDevice{
+		DeviceModel: frames.DeviceModel{ConnectionType: "USB", DeviceID: 1, SerialNumber: "0123456789abcdef"},
+		ProductID:   0x12a8,
+		LocationID:  0x14200000,
+	}
+	server.Attach(device)
+	if err := server.Handle(1, tunnel.LockdownPort, lockdownStub); err != nil {
+		t.Fatal(err)
+	}
+
+	return server, device, func() {
+		_ = tunnel.SetSocketAddress(old)
+		_ = server.Close()
+	}
+}
+
+func TestLockdownIdleAfterTimeout(t *testing.T) {
+	timeout := 50 * time.Millisecond
+	defer tunnel.SetPlistTimeout(timeout)()
+
+	_, device, done := startMux(t)
+	defer done()
+
+	lockdown, err := tunnel.LockdownDial(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lockdown.Close()
+
+	if _, err := lockdown.QueryType(); err != nil {
+		t.Fatal(err)
+	}
+
+	/* idle past the usbmuxd request deadline, the session must live on */
+	time.Sleep(3 * timeout)
+
+	resp, err := lockdown.QueryType()
+	if err != nil {
+		t.Fatalf("QueryType after idling: %v", err)
+	}
+	if resp.Type != "com.apple.mobile.lockdown" {
+		t.Errorf("Type = %q", resp.Type)
+	}
+}
+
+// startLockdown serves lockdown of the device of startMux with a
+// `muxtest.Lockdown`
+func startLockdown(t *testing.T) (*muxtest.Lockdown, *tunnel.LockdownConnection, func()) {
+	t.Helper()
+
+	server, device, done := startMux(t)
+	lockdown := muxtest.NewLockdown()
+	if err := server.Handle(device.DeviceID, tunnel.LockdownPort, lockdown.Serve); err != nil {
+		done()
+		t.Fatal(err)
+	}
+
+	conn, err := tunnel.LockdownDial(device)
+	if err != nil {
+		done()
+		t.Fatal(err)
+	}
+	return lockdown, conn, func() {
+		conn.Close()
+		done()
+	}
+}
+
+func TestPairUnpairValidate(t *testing.T) {
+	lockdown, conn, done := startLockdown(t)
+	defer done()
+
+	record, err := conn.Pair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !lockdown.Trusted(record.HostID) {
+		t.Fatalf("device does not trust %s after pairing", record.HostID)
+	}
+	if record.HostPrivateKey == nil || record.RootPrivateKey == nil || string(record.EscrowBag) != "escrow bag" ||
+		record.WiFiMACAddress != "00:11:22:33:44:55" || record.SystemBUID == "" {
+		t.Errorf("pair record %+v", record)
+	}
+
+	if err := conn.ValidatePair(record); err != nil {
+		t.Errorf("ValidatePair of a trusted host: %v", err)
+	}
+	if err := conn.Unpair(record); err != nil {
+		t.Fatal(err)
+	}
+	if lockdown.Trusted(record.HostID) {
+		t.Error("device still trusts the host after Unpair")
+	}
+	if err := conn.ValidatePair(record); !errors.Is(err, tunnel.ErrInvalidHostID) {
+		t.Errorf("ValidatePair after Unpair = %v, want ErrInvalidHostID", err)
+	}
+	if err := conn.Unpair(record); !errors.Is(err, tunnel.ErrInvalidHostID) {
+		t.Errorf("Unpair twice = %v, want ErrInvalidHostID", err)
+	}
+	if err := conn.Unpair(nil); err == nil {
+		t.Error("Unpair without a record succeeded")
+	}
+
+	if lockdown.LeakedKeys() {
+		t.Error("a private key of the host was sent to the device")
+	}
+}
+
+func countRequests(lockdown *muxtest.Lockdown, name string) int {
+	n := 0
+	for _, r := range lockdown.Requests() {
+		if r == name {
+			n++
+		}
+	}
+	return n
+}
+
+func TestPairErrors(t *testing.T) {
+	for code, sentinel := range map[string]error{
+		"PairingDialogResponsePending": tunnel.ErrPairingDialogResponsePending,
+		"PasswordProtected":            tunnel.ErrPasswordProtected,
+		"UserDeniedPairing":            tunnel.ErrUserDeniedPairing,
+		"InvalidHostID":                tunnel.ErrInvalidHostID,
+	} {
+		lockdown, conn, done := startLockdown(t)
+		lockdown.FailPair(code)
+
+		/* without PairOptions nothing is retried */
+		_, err := conn.Pair()
+		if !errors.Is(err, sentinel) {
+			t.Errorf("%s: Pair = %v", code, err)
+		}
+		var lockdownErr *tunnel.LockdownError
+		if !errors.As(err, &lockdownErr) || lockdownErr.Request != "Pair" || lockdownErr.Device != "0123456789abcdef" {
+			t.Errorf("%s: error %#v", code, err)
+		}
+		if errors.Is(err, tunnel.ErrSessionInactive) {
+			t.Errorf("%s: matches another sentinel", code)
+		}
+		if n := countRequests(lockdown, "Pair"); n != 1 {
+			t.Errorf("%s: %d pair requests, want 1", code, n)
+		}
+		done()
+	}
+}
+
+func TestPairWaitsForTrust(t *testing.T) {
+	lockdown, conn, done := startLockdown(t)
+	defer done()
+
+	lockdown.FailPair("PairingDialogResponsePending", "PasswordProtected")
+	var progress []error
+	var remaining []time.Duration
+	conn.PairOptions = &tunnel.PairOptions{
+		Timeout:  5 * time.Second,
+		Interval: 10 * time.Millisecond,
+		Progress: func(err error, left time.Duration) {
+			progress = append(progress, err)
+			remaining = append(remaining, left)
+		},
+	}
+
+	record, err := conn.Pair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !lockdown.Trusted(record.HostID) {
+		t.Error("device does not trust the host")
+	}
+	if n := countRequests(lockdown, "Pair"); n != 3 {
+		t.Errorf("%d pair requests, want 3", n)
+	}
+	if len(progress) != 2 || !errors.Is(progress[0], tunnel.ErrPairingDialogResponsePending) || !errors.Is(progress[1], tunnel.ErrPasswordProtected) {
+		t.Fatalf("progress %v", progress)
+	}
+	if remaining[0] <= 0 || remaining[0] > 5*time.Second || remaining[1] > remaining[0] {
+		t.Errorf("remaining %v", remaining)
+	}
+}
+
+func TestPairWaitGivesUp(t *testing.T) {
+	lockdown, conn, done := startLockdown(t)
+	defer done()
+
+	pending := make([]string, 100)
+	for i := range pending {
+		pending[i] = "PairingDialogResponsePending"
+	}
+	lockdown.FailPair(pending...)
+
+	/* the default interval of a second is cut short by the timeout */
+	conn.PairOptions = &tunnel.PairOptions{Timeout: 100 * time.Millisecond}
+	start := time.Now()
+	_, err := conn.Pair()
+	if !errors.Is(err, tunnel.ErrPairingDialogResponsePending) {
+		t.Fatalf("Pair = %v, want ErrPairingDialogResponsePending", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("gave up after %v", elapsed)
+	}
+	if n := countRequests(lockdown, "Pair"); n != 2 {
+		t.Errorf("%d pair requests, want 2", n)
+	}
+
+	/* a denial ends the wait right away */
+	lockdown, conn, done = startLockdown(t)
+	defer done()
+	lockdown.FailPair("PairingDialogResponsePending", "UserDeniedPairing")
+	conn.PairOptions = &tunnel.PairOptions{Timeout: 5 * time.Second, Interval: 10 * time.Millisecond}
+	if _, err := conn.Pair(); !errors.Is(err, tunnel.ErrUserDeniedPairing) {
+		t.Errorf("Pair = %v, want ErrUserDeniedPairing", err)
+	}
+	if n := countRequests(lockdown, "Pair"); n != 2 {
+		t.Errorf("%d pair requests, want 2", n)
+	}
+}
+
+func TestLockdownErrors(t *testing.T) {
+	_, conn, done := startLockdown(t)
+	defer done()
+
+	if _, err := conn.StartService("com.apple.afc"); !errors.Is(err, tunnel.ErrSessionInactive) {
+		t.Errorf("StartService without a session = %v, want ErrSessionInactive", err)
+	}
+
+	_, err := conn.GetValue("", "Unknown")
+	var lockdownErr *tunnel.LockdownError
+	if !errors.As(err, &lockdownErr) || lockdownErr.Code != "MissingValue" || lockdownErr.Request != "GetValue" {
+		t.Fatalf("GetValue of a missing key = %#v", err)
+	}
+	for _, sentinel := range []error{tunnel.ErrPasswordProtected, tunnel.ErrPairingDialogResponsePending, tunnel.ErrUserDeniedPairing,
+		tunnel.ErrInvalidHostID, tunnel.ErrSessionInactive, tunnel.ErrInvalidService} {
+		if errors.Is(err, sentinel) {
+			t.Errorf("MissingValue matches %v", sentinel)
+		}
+	}
+	if !errors.Is(err, &tunnel.LockdownError{Code: "MissingValue", Device: "0123456789abcdef"}) {
+		t.Error("error does not match its code on this device")
+	}
+}
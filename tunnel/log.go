@@ -0,0 +1,70 @@
+package tunnel
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+)
+
+func (this LogLevel) String() string {
+	switch this {
+	case LogDebug:
+		return "DEBUG"
+	case LogInfo:
+		return "INFO"
+	case LogWarn:
+		return "WARN"
+	}
+	return fmt.Sprintf("LogLevel(%d)", int(this))
+}
+
+// Logger receives diagnostics, component names the layer they come
+// from: `usbmuxd`, `lockdown`, `tls`, `session` or a service name
+type Logger interface {
+	Log(level LogLevel, component string, msg string)
+}
+
+// DefaultLogger receives the diagnostics of tunnel and services, nil
+// discards them. Set it before opening any connection.
+var DefaultLogger Logger
+
+// Logf formats for `DefaultLogger`, nothing is formatted without one
+func Logf(level LogLevel, component string, format string, v ...interface{}) {
+	if logger := DefaultLogger; logger != nil {
+		logger.Log(level, component, fmt.Sprintf(format, v...))
+	}
+}
+
+func debugf(component string, format string, v ...interface{}) {
+	Logf(LogDebug, component, format, v...)
+}
+
+// WriterLogger writes one line per message of at least `Level`
+type WriterLogger struct {
+	Level LogLevel
+
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+func NewWriterLogger(w io.Writer, level LogLevel) *WriterLogger {
+	return &WriterLogger{Level: level, w: w}
+}
+
+func (this *WriterLogger) Log(level LogLevel, component string, msg string) {
+	if level < this.Level {
+		return
+	}
+	this.mutex.Lock()
+	_, _ = fmt.Fprintf(this.w, "%s %-5s %s: %s\n", time.Now().Format("15:04:05.000"), level, component, msg)
+	this.mutex.Unlock()
+}
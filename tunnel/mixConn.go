@@ -1,32 +1,101 @@
 package tunnel
 
 import (
+	"bytes"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
 	"errors"
+	"fmt"
 	"iconsole/frames"
+	"io"
 	"net"
 	"time"
 )
 
+// DismissSSLTimeout bounds how long `DismissSSL` waits for the peer close_notify
+var DismissSSLTimeout = time.Second
+
+var (
+	ErrCertificateMismatch = errors.New("device certificate does not match the pair record")
+	ErrSSLShutdown         = errors.New("ssl shutdown left the stream inside a record")
+
+	errNotRecord = errors.New("not a tls record")
+)
+
 type MixConnection struct {
-	conn net.Conn
-	ssl  *tls.Conn
+	conn   net.Conn
+	ssl    *tls.Conn
+	record *recordConn
+	// plain data the peer sent inside TLS before its close_notify
+	pending []byte
 }
 
 func MixConnectionClient(conn net.Conn) *MixConnection {
 	return &MixConnection{
-		conn: conn,
+		conn: newBufferedConn(conn),
 	}
 }
 
+// DismissSSL goes back to plain text the way `SSL_shutdown` does: send
+// close_notify, then read up to the one of the peer so no TLS bytes are
+// left on the raw connection. Application data found on the way is kept
+// and returned by the next reads.
 func (this *MixConnection) DismissSSL() error {
-	// in openssl should be shutdown ssl connection
-	// but in there i don't know how to dismiss that
+	if this.ssl == nil {
+		return nil
+	}
+
+	ssl, record := this.ssl, this.record
+	this.ssl, this.record = nil, nil
+
+	err := ssl.CloseWrite()
+	/* CloseWrite leaves the write deadline in the past */
+	if derr := this.conn.SetWriteDeadline(time.Time{}); err == nil {
+		err = derr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := this.conn.SetReadDeadline(time.Now().Add(DismissSSLTimeout)); err != nil {
+		return err
+	}
 
-	//if err := this.ssl.CloseWrite(); err != nil {
-	//	return err
-	//}
-	this.ssl = nil
+	buf := make([]byte, 4096)
+	for {
+		n, rerr := ssl.Read(buf)
+		this.pending = append(this.pending, buf[:n]...)
+		if rerr == nil {
+			continue
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if errors.Is(rerr, errNotRecord) {
+			/* the peer went plain without close_notify */
+			this.pending = append(this.pending, record.header[:record.hlen]...)
+			break
+		}
+		if ne, ok := rerr.(net.Error); !ok || !ne.Timeout() {
+			return rerr
+		}
+		/* some peers drop SSL without close_notify, fine between two records */
+		if !record.boundary() {
+			return ErrSSLShutdown
+		}
+		break
+	}
+
+	debugf("tls", "shut down, %d plain bytes pending", len(this.pending))
+	return this.conn.SetReadDeadline(time.Time{})
+}
+
+// DismissSSLBypass drops TLS without a shutdown, for services like
+// instruments that switch to plain text right after the handshake
+func (this *MixConnection) DismissSSLBypass() error {
+	this.ssl, this.record = nil, nil
 	return nil
 }
 
@@ -53,17 +122,76 @@ func (this *MixConnection) Handshake(version []int, record *frames.PairRecord) e
 		InsecureSkipVerify: true,
 		MinVersion:         minVersion,
 		MaxVersion:         maxVersion,
+		/* the device has no name to verify, check it against the pair record instead */
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyDeviceCertificate(rawCerts, record)
+		},
 	}
 
-	this.ssl = tls.Client(this.conn, cfg)
+	/* tls must not read past its last record or DismissSSL would lose plain data */
+	this.record = &recordConn{Conn: this.conn}
+	this.ssl = tls.Client(this.record, cfg)
 
+	debugf("tls", "handshake, product version %v", version)
 	if err := this.ssl.Handshake(); err != nil {
+		debugf("tls", "handshake failed: %s", err)
 		return err
 	}
+	debugf("tls", "handshake done, %s", tlsVersionName(this.ssl.ConnectionState().Version))
 
 	return nil
 }
 
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("TLS %#04x", version)
+}
+
+// verifyDeviceCertificate accepts the peer only if it presents the device
+// certificate of the pair record or one signed by the pair record root
+func verifyDeviceCertificate(rawCerts [][]byte, record *frames.PairRecord) error {
+	if len(rawCerts) == 0 {
+		return ErrCertificateMismatch
+	}
+
+	if device, err := decodeCertificate(record.DeviceCertificate); err == nil && bytes.Equal(rawCerts[0], device.Raw) {
+		return nil
+	}
+
+	peer, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return ErrCertificateMismatch
+	}
+
+	root, err := decodeCertificate(record.RootCertificate)
+	if err != nil {
+		return err
+	}
+
+	/* pair records are signed with SHA1 which `CheckSignatureFrom` refuses */
+	if !root.IsCA || (peer.CheckSignatureFrom(root) != nil && root.CheckSignature(peer.SignatureAlgorithm, peer.RawTBSCertificate, peer.Signature) != nil) {
+		return ErrCertificateMismatch
+	}
+
+	return nil
+}
+
+func decodeCertificate(data []byte) (*x509.Certificate, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	return x509.ParseCertificate(data)
+}
+
 func (this *MixConnection) getConn() net.Conn {
 	if this.ssl != nil {
 		return this.ssl
@@ -72,6 +200,13 @@ func (this *MixConnection) getConn() net.Conn {
 }
 
 func (this *MixConnection) Read(b []byte) (n int, err error) {
+	if this.ssl == nil && len(this.pending) > 0 {
+		n = copy(b, this.pending)
+		if this.pending = this.pending[n:]; len(this.pending) == 0 {
+			this.pending = nil
+		}
+		return n, nil
+	}
 	return this.getConn().Read(b)
 }
 
@@ -80,7 +215,7 @@ func (this *MixConnection) Write(b []byte) (n int, err error) {
 }
 
 func (this *MixConnection) Close() error {
-	this.ssl = nil
+	this.ssl, this.record = nil, nil
 	return this.getConn().Close()
 }
 
@@ -103,3 +238,58 @@ func (this *MixConnection) SetReadDeadline(t time.Time) error {
 func (this *MixConnection) SetWriteDeadline(t time.Time) error {
 	return this.getConn().SetWriteDeadline(t)
 }
+
+// recordConn hands TLS one record at a time so it never buffers bytes
+// that follow the record it is reading
+type recordConn struct {
+	net.Conn
+	header  [5]byte
+	hlen    int
+	pending []byte
+	remain  int
+}
+
+func (this *recordConn) Read(b []byte) (int, error) {
+	if len(this.pending) == 0 && this.remain == 0 {
+		/* keep a partial header across timeouts */
+		for this.hlen < len(this.header) {
+			n, err := this.Conn.Read(this.header[this.hlen:])
+			this.hlen += n
+			if !this.valid() {
+				return 0, errNotRecord
+			}
+			if err != nil {
+				return 0, err
+			}
+		}
+		this.hlen = 0
+		this.pending = this.header[:]
+		this.remain = int(binary.BigEndian.Uint16(this.header[3:]))
+	}
+
+	if len(this.pending) > 0 {
+		n := copy(b, this.pending)
+		this.pending = this.pending[n:]
+		return n, nil
+	}
+
+	if len(b) > this.remain {
+		b = b[:this.remain]
+	}
+	n, err := this.Conn.Read(b)
+	this.remain -= n
+	return n, err
+}
+
+// valid checks the header read so far is a TLS content type and version
+func (this *recordConn) valid() bool {
+	if this.hlen > 0 && (this.header[0] < 20 || this.header[0] > 24) {
+		return false
+	}
+	return this.hlen < 2 || this.header[1] == 3
+}
+
+// boundary reports whether the stream sits between two records
+func (this *recordConn) boundary() bool {
+	return this.hlen == 0 && len(this.pending) == 0 && this.remain == 0
+}
@@ -0,0 +1,378 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"iconsole/frames"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testPairRecord returns a pair record and the device side certificate
+// the way lockdown presents it, signed by the record root
+func testPairRecord(t *testing.T) (*frames.PairRecord, tls.Certificate) {
+	t.Helper()
+
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deviceKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	rootTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	rootDER, err := x509.CreateCertificate(rand.Reader, rootTemplate, rootTemplate, rootKey.Public(), rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deviceTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	deviceDER, err := x509.CreateCertificate(rand.Reader, deviceTemplate, rootTemplate, deviceKey.Public(), rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rootKeyDER, err := x509.MarshalECPrivateKey(rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record := &frames.PairRecord{
+		HostID:            "HOST",
+		RootCertificate:   pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: rootDER}),
+		RootPrivateKey:    pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: rootKeyDER}),
+		DeviceCertificate: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: deviceDER}),
+	}
+
+	return record, tls.Certificate{Certificate: [][]byte{deviceDER}, PrivateKey: deviceKey}
+}
+
+// holdConn is the device end of the pipe, while held writes pile up and
+// go out in one piece on `flush`, like records sharing a TCP segment
+type holdConn struct {
+	net.Conn
+	mutex sync.Mutex
+	hold  bool
+	buf   bytes.Buffer
+}
+
+func (this *holdConn) Write(b []byte) (int, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.hold {
+		return this.buf.Write(b)
+	}
+	return this.Conn.Write(b)
+}
+
+func (this *holdConn) setHold() {
+	this.mutex.Lock()
+	this.hold = true
+	this.mutex.Unlock()
+}
+
+func (this *holdConn) flush() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.hold = false
+	_, err := this.Conn.Write(this.buf.Bytes())
+	this.buf.Reset()
+	return err
+}
+
+// tlsPair runs the lockdown side with fn once the client finished its
+// handshake. With hold the last device flight is held back for fn to
+// flush, so the client sees it together with whatever fn writes.
+func tlsPair(t *testing.T, maxVersion uint16, hold bool, fn func(device *tls.Conn, raw *holdConn)) (*MixConnection, chan error) {
+	t.Helper()
+
+	record, cert := testPairRecord(t)
+	client, server := net.Pipe()
+	raw := &holdConn{Conn: server}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAnyClientCert,
+		MinVersion:   tls.VersionTLS11,
+		MaxVersion:   maxVersion,
+		/* called once the client flight is in, before the device Finished */
+		VerifyConnection: func(tls.ConnectionState) error {
+			if hold {
+				raw.setHold()
+			}
+			return nil
+		},
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		device := tls.Server(raw, cfg)
+		if err := device.Handshake(); err != nil {
+			done <- err
+			return
+		}
+		fn(device, raw)
+		done <- nil
+	}()
+
+	conn := MixConnectionClient(client)
+	if err := conn.Handshake([]int{13, 4}, record); err != nil {
+		t.Fatal(err)
+	}
+	return conn, done
+}
+
+/* a lost byte fails the test instead of hanging it */
+func readString(t *testing.T, conn *MixConnection, n int) string {
+	t.Helper()
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestDismissSSL(t *testing.T) {
+	for _, version := range []uint16{tls.VersionTLS12, tls.VersionTLS13} {
+		notified := make(chan error, 1)
+		conn, done := tlsPair(t, version, false, func(device *tls.Conn, raw *holdConn) {
+			if _, err := device.Write([]byte("secret")); err != nil {
+				notified <- err
+				return
+			}
+			/* the host close_notify ends the TLS stream */
+			buf := make([]byte, 16)
+			_, err := device.Read(buf)
+			notified <- err
+
+			/* data, close_notify and plain text in one segment */
+			raw.setHold()
+			_, _ = device.Write([]byte("late"))
+			_ = device.CloseWrite()
+			_ = raw.Conn.SetWriteDeadline(time.Time{})
+			_, _ = raw.Write([]byte("plain"))
+			_ = raw.flush()
+
+			_, _ = io.Copy(raw, raw)
+		})
+
+		if got := readString(t, conn, 6); got != "secret" {
+			t.Fatalf("TLS read %q", got)
+		}
+
+		if err := conn.DismissSSL(); err != nil {
+			t.Fatalf("%s: DismissSSL: %v", tlsVersionName(version), err)
+		}
+		if err := <-notified; err != io.EOF {
+			t.Fatalf("%s: device read %v, want io.EOF from close_notify", tlsVersionName(version), err)
+		}
+
+		/* data sent before the device close_notify is not lost */
+		if got := readString(t, conn, 9); got != "lateplain" {
+			t.Errorf("%s: after shutdown read %q", tlsVersionName(version), got)
+		}
+
+		/* plain text both ways from now on */
+		if _, err := conn.Write([]byte("echo")); err != nil {
+			t.Fatal(err)
+		}
+		if got := readString(t, conn, 4); got != "echo" {
+			t.Errorf("%s: plain echo %q", tlsVersionName(version), got)
+		}
+
+		_ = conn.Close()
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDismissSSLWithoutPeerNotify(t *testing.T) {
+	conn, done := tlsPair(t, tls.VersionTLS13, false, func(device *tls.Conn, raw *holdConn) {
+		buf := make([]byte, 16)
+		_, _ = device.Read(buf)
+		/* goes plain right away, no close_notify */
+		_, _ = raw.Write([]byte("PLAIN"))
+		_, _ = io.Copy(raw, raw)
+	})
+
+	if err := conn.DismissSSL(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readString(t, conn, 5); got != "PLAIN" {
+		t.Errorf("read %q after a peer that skipped close_notify", got)
+	}
+
+	_ = conn.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDismissSSLSilentPeer(t *testing.T) {
+	defer func(d time.Duration) { DismissSSLTimeout = d }(DismissSSLTimeout)
+	DismissSSLTimeout = 50 * time.Millisecond
+
+	release := make(chan struct{})
+	conn, done := tlsPair(t, tls.VersionTLS12, false, func(device *tls.Conn, raw *holdConn) {
+		buf := make([]byte, 16)
+		_, _ = device.Read(buf)
+		/* says nothing until the host gave up waiting */
+		<-release
+		_, _ = raw.Write([]byte("late plain"))
+	})
+
+	if err := conn.DismissSSL(); err != nil {
+		t.Fatalf("DismissSSL between records: %v", err)
+	}
+	close(release)
+	if got := readString(t, conn, 10); got != "late plain" {
+		t.Errorf("read %q", got)
+	}
+
+	_ = conn.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDismissSSLBypassBuffered(t *testing.T) {
+	conn, done := tlsPair(t, tls.VersionTLS12, true, func(device *tls.Conn, raw *holdConn) {
+		_, _ = raw.Write([]byte("bypassed"))
+		_ = raw.flush()
+		_, _ = io.Copy(raw, raw)
+	})
+
+	/* the device Finished and the plain text arrived together */
+	if err := conn.DismissSSLBypass(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readString(t, conn, 8); got != "bypassed" {
+		t.Errorf("read %q after bypass", got)
+	}
+	if _, err := conn.Write([]byte("more")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readString(t, conn, 4); got != "more" {
+		t.Errorf("plain echo %q", got)
+	}
+
+	_ = conn.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// selfSigned returns a certificate no pair record knows of
+func selfSigned(t *testing.T) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(3),
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestVerifyDeviceCertificate(t *testing.T) {
+	record, device := testPairRecord(t)
+	foreign := selfSigned(t)
+
+	/* the exact certificate of the record, whoever signed it */
+	exact := *record
+	exact.DeviceCertificate = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: foreign.Certificate[0]})
+	if err := verifyDeviceCertificate(foreign.Certificate, &exact); err != nil {
+		t.Errorf("exact device certificate: %v", err)
+	}
+
+	/* a leaf the record root signed, the device certificate renewed */
+	renewed := *record
+	renewed.DeviceCertificate = nil
+	if err := verifyDeviceCertificate(device.Certificate, &renewed); err != nil {
+		t.Errorf("leaf signed by the root: %v", err)
+	}
+	if err := verifyDeviceCertificate(device.Certificate, record); err != nil {
+		t.Errorf("device certificate: %v", err)
+	}
+
+	for name, raw := range map[string][][]byte{
+		"foreign self signed": foreign.Certificate,
+		"none":                nil,
+		"garbage":             {[]byte("not a certificate")},
+	} {
+		if err := verifyDeviceCertificate(raw, record); err != ErrCertificateMismatch {
+			t.Errorf("%s: %v, want ErrCertificateMismatch", name, err)
+		}
+	}
+
+	/* a root that is no CA signs nothing */
+	notCA := *record
+	notCA.DeviceCertificate = nil
+	notCA.RootCertificate = exact.DeviceCertificate
+	if err := verifyDeviceCertificate(device.Certificate, &notCA); err != ErrCertificateMismatch {
+		t.Errorf("leaf of another root: %v, want ErrCertificateMismatch", err)
+	}
+}
+
+func TestHandshakeRejectsForeignDevice(t *testing.T) {
+	record, _ := testPairRecord(t)
+	client, server := net.Pipe()
+
+	go func() {
+		device := tls.Server(server, &tls.Config{
+			Certificates: []tls.Certificate{selfSigned(t)},
+			ClientAuth:   tls.RequireAnyClientCert,
+			MaxVersion:   tls.VersionTLS13,
+		})
+		_ = device.Handshake()
+		_ = device.Close()
+	}()
+
+	conn := MixConnectionClient(client)
+	defer conn.Close()
+	if err := conn.Handshake([]int{14, 2}, record); !errors.Is(err, ErrCertificateMismatch) {
+		t.Fatalf("handshake with a foreign device = %v, want ErrCertificateMismatch", err)
+	}
+}
@@ -0,0 +1,295 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iconsole/frames"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+type DeviceEventType int
+
+const (
+	DeviceAttached DeviceEventType = iota
+	DeviceDetached
+	DevicePaired
+	// connection to usbmuxd lost, `Err` holds the reason
+	MonitorDisconnected
+	// (re)connected to usbmuxd and the device table is in sync
+	MonitorConnected
+)
+
+func (this DeviceEventType) String() string {
+	switch this {
+	case DeviceAttached:
+		return "Attached"
+	case DeviceDetached:
+		return "Detached"
+	case DevicePaired:
+		return "Paired"
+	case MonitorDisconnected:
+		return "Disconnected"
+	case MonitorConnected:
+		return "Connected"
+	}
+	return fmt.Sprintf("DeviceEventType(%d)", int(this))
+}
+
+type DeviceEvent struct {
+	Type   DeviceEventType
+	Device frames.Device
+	Err    error
+}
+
+// DeviceMonitor keeps a live table of the devices usbmuxd knows about.
+// It reconnects with exponential backoff when usbmuxd goes away and
+// resyncs the table afterwards, so every attach and detach is reported
+// exactly once. The event channel is closed only after `Close`.
+type DeviceMonitor struct {
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	mutex   sync.Mutex
+	devices map[int]frames.Device
+	rawConn net.Conn
+	events  chan *DeviceEvent
+	done    chan struct{}
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+func NewDeviceMonitor() *DeviceMonitor {
+	return &DeviceMonitor{
+		MinBackoff: 500 * time.Millisecond,
+		MaxBackoff: 30 * time.Second,
+		devices:    make(map[int]frames.Device),
+	}
+}
+
+// Start connects to usbmuxd and returns the event channel, the current
+// devices are reported as `DeviceAttached` events first
+func (this *DeviceMonitor) Start() (<-chan *DeviceEvent, error) {
+	this.mutex.Lock()
+	if this.events != nil {
+		this.mutex.Unlock()
+		return nil, errors.New("monitor already started")
+	}
+	this.events = make(chan *DeviceEvent, 32)
+	this.done = make(chan struct{})
+	this.mutex.Unlock()
+
+	conn, attached, err := this.connect()
+	if err != nil {
+		this.mutex.Lock()
+		this.events = nil
+		this.mutex.Unlock()
+		return nil, err
+	}
+
+	this.wg.Add(1)
+	go this.run(conn, attached)
+
+	return this.events, nil
+}
+
+// Devices returns a snapshot of the device table ordered by device id
+func (this *DeviceMonitor) Devices() []frames.Device {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	ids := make([]int, 0, len(this.devices))
+	for id := range this.devices {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	devices := make([]frames.Device, len(ids))
+	for i, id := range ids {
+		devices[i] = this.devices[id]
+	}
+	return devices
+}
+
+// Device looks up an attached device by serial number, preferring USB
+func (this *DeviceMonitor) Device(udid string) frames.Device {
+	var found frames.Device
+	for _, d := range this.Devices() {
+		if d.GetSerialNumber() != udid {
+			continue
+		}
+		if d.GetConnectionType() == "USB" {
+			return d
+		}
+		if found == nil {
+			found = d
+		}
+	}
+	return found
+}
+
+func (this *DeviceMonitor) Close() error {
+	this.mutex.Lock()
+	if this.closed || this.events == nil {
+		this.closed = true
+		this.mutex.Unlock()
+		return nil
+	}
+	this.closed = true
+	close(this.done)
+	if this.rawConn != nil {
+		/* unblock the pending read */
+		_ = this.rawConn.Close()
+	}
+	this.mutex.Unlock()
+
+	this.wg.Wait()
+	return nil
+}
+
+func (this *DeviceMonitor) emit(event *DeviceEvent) bool {
+	select {
+	case this.events <- event:
+		return true
+	case <-this.done:
+		return false
+	}
+}
+
+// connect starts listening and diffs the table against a fresh device list
+func (this *DeviceMonitor) connect() (*PlistConnection, []*DeviceEvent, error) {
+	frame := frames.CreateBaseRequest(frames.Listen)
+	conn, err := dialRequest(context.Background(), "", frame, frames.BinaryListen, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	devices, err := Devices()
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	current := make(map[int]frames.Device, len(devices))
+	for _, d := range devices {
+		current[d.GetDeviceID()] = d
+	}
+
+	var events []*DeviceEvent
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.closed {
+		conn.Close()
+		return nil, nil, errors.New("monitor closed")
+	}
+
+	for id, d := range this.devices {
+		if _, ok := current[id]; !ok {
+			delete(this.devices, id)
+			events = append(events, &DeviceEvent{Type: DeviceDetached, Device: d})
+		}
+	}
+	for _, d := range devices {
+		if _, ok := this.devices[d.GetDeviceID()]; !ok {
+			events = append(events, &DeviceEvent{Type: DeviceAttached, Device: d})
+		}
+		this.devices[d.GetDeviceID()] = d
+	}
+	events = append(events, &DeviceEvent{Type: MonitorConnected})
+
+	/* notifications may be minutes apart */
+	conn.Timeout = 0
+	this.rawConn = conn.RawConn
+
+	return conn, events, nil
+}
+
+func (this *DeviceMonitor) run(conn *PlistConnection, events []*DeviceEvent) {
+	defer this.wg.Done()
+	defer close(this.events)
+
+	for {
+		for _, event := range events {
+			if !this.emit(event) {
+				conn.Close()
+				return
+			}
+		}
+
+		err := this.watch(conn)
+
+		this.mutex.Lock()
+		this.rawConn = nil
+		closed := this.closed
+		this.mutex.Unlock()
+
+		conn.Close()
+
+		if closed || !this.emit(&DeviceEvent{Type: MonitorDisconnected, Err: err}) {
+			return
+		}
+
+		backoff := this.MinBackoff
+		for {
+			select {
+			case <-this.done:
+				return
+			case <-time.After(backoff):
+			}
+
+			if conn, events, err = this.connect(); err == nil {
+				break
+			}
+
+			if backoff *= 2; backoff > this.MaxBackoff {
+				backoff = this.MaxBackoff
+			}
+		}
+	}
+}
+
+// watch applies notifications to the table until the connection fails
+func (this *DeviceMonitor) watch(conn *PlistConnection) error {
+	for {
+		pkg, err := conn.Sync()
+		if err != nil {
+			return err
+		}
+
+		msg, err := decodePackage(pkg)
+		if err != nil {
+			/* unknown or malformed notification, keep listening */
+			continue
+		}
+
+		var event *DeviceEvent
+
+		this.mutex.Lock()
+		switch v := msg.(type) {
+		case *frames.DeviceAttached:
+			if _, ok := this.devices[v.DeviceID]; !ok {
+				event = &DeviceEvent{Type: DeviceAttached, Device: v.Properties}
+			}
+			this.devices[v.DeviceID] = v.Properties
+		case *frames.DeviceDetached:
+			if d, ok := this.devices[v.DeviceID]; ok {
+				delete(this.devices, v.DeviceID)
+				event = &DeviceEvent{Type: DeviceDetached, Device: d}
+			}
+		case *frames.DevicePaired:
+			if d, ok := this.devices[v.DeviceID]; ok {
+				event = &DeviceEvent{Type: DevicePaired, Device: d}
+			}
+		}
+		this.mutex.Unlock()
+
+		if event != nil && !this.emit(event) {
+			return errors.New("monitor closed")
+		}
+	}
+}
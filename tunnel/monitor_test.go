@@ -0,0 +1,124 @@
+package tunnel_test
+
+import (
+	"iconsole/frames"
+	"iconsole/tunnel"
+	"iconsole/tunnel/muxtest"
+	"testing"
+	"time"
+)
+
+// nextEvent waits for one event of a `DeviceMonitor`
+func nextEvent(t *testing.T, events <-chan *tunnel.DeviceEvent) *tunnel.DeviceEvent {
+	t.Helper()
+
+	select {
+	case event, ok := <-events:
+		if !ok {
+			t.Fatal("event channel closed")
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event")
+	}
+	return nil
+}
+
+// expectEvents reads events up to the next `MonitorConnected` or
+// `MonitorDisconnected` and checks them against want, in any order
+func expectEvents(t *testing.T, events <-chan *tunnel.DeviceEvent, until tunnel.DeviceEventType, want map[int]tunnel.DeviceEventType) {
+	t.Helper()
+
+	got := make(map[int]tunnel.DeviceEventType)
+	for {
+		event := nextEvent(t, events)
+		if event.Type == until {
+			break
+		}
+		if event.Device == nil {
+			t.Fatalf("%s event while waiting for %s", event.Type, until)
+		}
+		id := event.Device.GetDeviceID()
+		if _, ok := got[id]; ok {
+			t.Errorf("device %d reported twice, %s after %s", id, event.Type, got[id])
+		}
+		got[id] = event.Type
+	}
+
+	if len(got) != len(want) {
+		t.Errorf("events %v, want %v", got, want)
+	}
+	for id, typ := range want {
+		if got[id] != typ {
+			t.Errorf("device %d: %s, want %s", id, got[id], typ)
+		}
+	}
+}
+
+func TestDeviceMonitorResync(t *testing.T) {
+	first, usb, done := startMux(t)
+	defer done()
+	first.Attach(networkDevice(2))
+
+	monitor := tunnel.NewDeviceMonitor()
+	monitor.MinBackoff = 5 * time.Millisecond
+	monitor.MaxBackoff = 20 * time.Millisecond
+	events, err := monitor.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer monitor.Close()
+
+	expectEvents(t, events, tunnel.MonitorConnected, map[int]tunnel.DeviceEventType{
+		usb.DeviceID: tunnel.DeviceAttached,
+		2:            tunnel.DeviceAttached,
+	})
+
+	/* usbmuxd goes away and stays away for a few backoff rounds */
+	if err := tunnel.SetSocketAddress("UNIX:" + first.Path() + ".gone"); err != nil {
+		t.Fatal(err)
+	}
+	_ = first.Close()
+	if event := nextEvent(t, events); event.Type != tunnel.MonitorDisconnected || event.Err == nil {
+		t.Fatalf("event %s %v, want disconnected with the reason", event.Type, event.Err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	/* back with device 2 still plugged in, the USB device gone and a new one */
+	second, err := muxtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	second.Attach(networkDevice(2))
+	third := &frames.USBDevice{DeviceModel: frames.DeviceModel{ConnectionType: "USB", DeviceID: 3, SerialNumber: "third"}}
+	second.Attach(third)
+	if err := tunnel.SetSocketAddress(second.Address()); err != nil {
+		t.Fatal(err)
+	}
+
+	expectEvents(t, events, tunnel.MonitorConnected, map[int]tunnel.DeviceEventType{
+		usb.DeviceID: tunnel.DeviceDetached,
+		3:            tunnel.DeviceAttached,
+	})
+	if devices := monitor.Devices(); len(devices) != 2 || devices[0].GetDeviceID() != 2 || devices[1].GetDeviceID() != 3 {
+		t.Errorf("devices after resync %v", devices)
+	}
+
+	/* live notifications go on, a repeated attach is not reported again */
+	second.Attach(third)
+	second.Detach(2)
+	if event := nextEvent(t, events); event.Type != tunnel.DeviceDetached || event.Device.GetDeviceID() != 2 {
+		t.Errorf("event %s of %v, want device 2 detached", event.Type, event.Device)
+	}
+	if d := monitor.Device("third"); d == nil || d.GetDeviceID() != 3 {
+		t.Errorf("Device(third) = %v", d)
+	}
+
+	_ = monitor.Close()
+	for event := range events {
+		if event.Type != tunnel.MonitorDisconnected {
+			t.Errorf("event %s after Close", event.Type)
+		}
+	}
+}
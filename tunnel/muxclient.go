@@ -0,0 +1,564 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"iconsole/frames"
+	"sync"
+	"time"
+
+	"howett.net/plist"
+)
+
+var (
+	ErrMuxTimeout = errors.New("usbmuxd request timed out")
+
+	errStaleConnection = errors.New("stale usbmuxd connection")
+)
+
+type muxReply struct {
+	pkg *frames.Package
+	err error
+}
+
+// MuxClient keeps one usbmuxd control connection and matches replies to
+// requests by tag, so any number of goroutines can share it. The
+// connection is dialed on first use and again after it fails.
+// Notifications, tag 0, go through the same reader to every `Listen`
+// subscriber. usbmuxd takes no further request on a connection that
+// listens, so they arrive on a second connection, one for all
+// subscribers. `Connect` still opens its own, it becomes a device stream.
+type MuxClient struct {
+	// Timeout bounds every request, zero waits as long as it takes
+	Timeout time.Duration
+
+	mutex   sync.Mutex
+	conn    *PlistConnection
+	tag     uint32
+	pending map[uint32]chan muxReply
+	buid    string
+
+	/* the listening connection, its subscribers and the devices it reported */
+	events    *PlistConnection
+	listeners map[*muxListener]bool
+	devices   []frames.Device
+	/* serializes dialing the listening connection */
+	listenMutex sync.Mutex
+
+	writeMutex sync.Mutex
+}
+
+// DefaultMuxClient serves the package level usbmuxd functions
+var DefaultMuxClient = NewMuxClient()
+
+func NewMuxClient() *MuxClient {
+	return &MuxClient{
+		Timeout:   30 * time.Second,
+		pending:   make(map[uint32]chan muxReply),
+		listeners: make(map[*muxListener]bool),
+	}
+}
+
+// Close drops the connections, pending requests fail, `Listen` channels
+// are closed and the next request dials again
+func (this *MuxClient) Close() error {
+	this.mutex.Lock()
+	conn, events := this.conn, this.events
+	this.mutex.Unlock()
+
+	if conn != nil {
+		this.fail(conn, ErrNoConnection)
+	}
+	if events != nil {
+		this.fail(events, ErrNoConnection)
+	}
+	return nil
+}
+
+// connection must be called with the mutex held
+func (this *MuxClient) connection() (*PlistConnection, error) {
+	if this.conn != nil {
+		return this.conn, nil
+	}
+
+	conn := NewPlistConnection()
+	if err := conn.Dial(); err != nil {
+		return nil, err
+	}
+	/* the reader waits for replies as long as it takes, requests time out on their own */
+	conn.Timeout = 0
+
+	this.conn = conn
+	go this.read(conn)
+
+	return conn, nil
+}
+
+// read hands replies to the request of the same tag and notifications
+// to the listeners, until conn fails
+func (this *MuxClient) read(conn *PlistConnection) {
+	for {
+		pkg, err := conn.Sync()
+		if err != nil {
+			this.fail(conn, err)
+			return
+		}
+
+		if pkg.Tag == 0 {
+			this.notify(pkg)
+			continue
+		}
+
+		this.mutex.Lock()
+		ch, ok := this.pending[pkg.Tag]
+		delete(this.pending, pkg.Tag)
+		this.mutex.Unlock()
+
+		/* replies to requests that timed out are dropped */
+		if ok {
+			ch <- muxReply{pkg: pkg}
+		}
+	}
+}
+
+// fail closes conn and fails every request or listener waiting on it
+func (this *MuxClient) fail(conn *PlistConnection, err error) {
+	this.mutex.Lock()
+	if this.events == conn {
+		this.dropEvents()
+		this.mutex.Unlock()
+		conn.Close()
+		debugf(UsbmuxdServiceName, "listening connection closed: %s", err)
+		return
+	} else if this.conn != conn {
+		this.mutex.Unlock()
+		return
+	}
+	pending := this.pending
+	this.pending = make(map[uint32]chan muxReply)
+	this.conn = nil
+	this.buid = ""
+	this.mutex.Unlock()
+
+	conn.Close()
+
+	for _, ch := range pending {
+		ch <- muxReply{err: err}
+	}
+}
+
+// Request sends frame and waits for the reply carrying the same tag, a
+// daemon of the binary protocol fails every request with `ErrBadVersion`
+func (this *MuxClient) Request(frame interface{}) (*frames.Package, error) {
+	if isLegacyProtocol() {
+		return nil, ErrBadVersion
+	}
+
+	tag, ch, err := this.send(frame)
+	if err == errStaleConnection {
+		/* usbmuxd restarted since the last request, dial once more */
+		Logf(LogInfo, UsbmuxdServiceName, "control connection went stale, dialing again")
+		tag, ch, err = this.send(frame)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var timeout <-chan time.Time
+	if this.Timeout > 0 {
+		timer := time.NewTimer(this.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case reply := <-ch:
+		if reply.err != nil || !reply.pkg.IsBinary() {
+			return reply.pkg, reply.err
+		}
+		/* a binary result is all an old daemon has to say to plist */
+		err := packageResult(reply.pkg, "")
+		if err == nil {
+			err = usbmuxdError(ResultUnknown, "")
+		} else if errors.Is(err, ErrBadVersion) {
+			setLegacyProtocol(true)
+			_ = this.Close()
+		}
+		return nil, err
+	case <-timeout:
+		this.mutex.Lock()
+		delete(this.pending, tag)
+		this.mutex.Unlock()
+		return nil, ErrMuxTimeout
+	}
+}
+
+func (this *MuxClient) send(frame interface{}) (uint32, chan muxReply, error) {
+	this.mutex.Lock()
+	reused := this.conn != nil
+	conn, err := this.connection()
+	if err != nil {
+		this.mutex.Unlock()
+		return 0, nil, err
+	}
+	if this.tag++; this.tag == 0 {
+		this.tag++
+	}
+	tag := this.tag
+	ch := make(chan muxReply, 1)
+	this.pending[tag] = ch
+	this.mutex.Unlock()
+
+	this.writeMutex.Lock()
+	err = conn.SendTag(frame, tag)
+	this.writeMutex.Unlock()
+
+	if err != nil {
+		this.fail(conn, err)
+		if reused {
+			return 0, nil, errStaleConnection
+		}
+		return 0, nil, err
+	}
+
+	return tag, ch, nil
+}
+
+// Devices lists the attached devices, a binary daemon only tells them
+// to listeners so they are collected through `Listen` instead
+func (this *MuxClient) Devices() ([]frames.Device, error) {
+	frame := frames.CreateBaseRequest(frames.ListDevices)
+
+	respPkg, err := this.Request(frame)
+	if errors.Is(err, ErrBadVersion) {
+		return listenDevices()
+	} else if err != nil {
+		return nil, err
+	}
+
+	var devices []frames.Device
+	var m map[string]interface{}
+
+	if err := respPkg.UnmarshalBody(&m); err != nil {
+		return nil, err
+	}
+
+	deviceList, ok := m["DeviceList"].([]interface{})
+	if ok {
+		for _, v := range deviceList {
+			item, _ := v.(map[string]interface{})
+			properties, ok := item["Properties"].(map[string]interface{})
+			if !ok {
+				return nil, &PropertyError{Key: "Properties", Value: item["Properties"]}
+			}
+			device, err := analyzeDevice(properties)
+			if err == errUnknownConnectionType {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			devices = append(devices, device)
+		}
+	} else if n, ok := m["Number"].(uint64); ok {
+		return nil, usbmuxdError(n, "")
+	} else {
+		return nil, usbmuxdError(ResultUnknown, "")
+	}
+
+	return devices, nil
+}
+
+// ReadBUID asks usbmuxd once per connection
+func (this *MuxClient) ReadBUID() (string, error) {
+	this.mutex.Lock()
+	buid := this.buid
+	this.mutex.Unlock()
+
+	if buid != "" {
+		return buid, nil
+	}
+
+	frame := frames.CreateBaseRequest("ReadBUID")
+
+	pkg, err := this.Request(frame)
+	if err != nil {
+		return "", err
+	}
+
+	var m map[string]interface{}
+	if err := pkg.UnmarshalBody(&m); err != nil {
+		return "", err
+	}
+
+	if buid, ok := m["BUID"].(string); ok {
+		this.mutex.Lock()
+		this.buid = buid
+		this.mutex.Unlock()
+		return buid, nil
+	} else if n, ok := m["Number"].(uint64); ok {
+		return "", usbmuxdError(n, "")
+	}
+
+	return "", usbmuxdError(ResultUnknown, "")
+}
+
+func (this *MuxClient) ReadPairRecord(udid string) (*frames.PairRecord, error) {
+	req := &frames.PairRecordRequest{
+		BaseRequest:  *frames.CreateBaseRequest("ReadPairRecord"),
+		PairRecordID: udid,
+	}
+
+	pkg, err := this.Request(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var m frames.PairRecordResponse
+	if err := pkg.UnmarshalBody(&m); err != nil {
+		return nil, err
+	}
+
+	if m.Number != 0 {
+		return nil, usbmuxdError(uint64(m.Number), udid)
+	}
+
+	var resp frames.PairRecord
+	if _, err := plist.Unmarshal(m.PairRecordData, &resp); err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+}
+
+func (this *MuxClient) SavePairRecord(device frames.Device, record *frames.PairRecord) error {
+	data, err := plist.Marshal(record, plist.XMLFormat)
+	if err != nil {
+		return err
+	}
+
+	req := &frames.SavePairRecordRequest{
+		BaseRequest:    *frames.CreateBaseRequest("SavePairRecord"),
+		PairRecordID:   device.GetSerialNumber(),
+		PairRecordData: data,
+		DeviceID:       device.GetDeviceID(),
+	}
+
+	return this.result(req, device.GetSerialNumber())
+}
+
+func (this *MuxClient) DeletePairRecord(udid string) error {
+	req := &frames.DeletePairRecordRequest{
+		BaseRequest:  *frames.CreateBaseRequest("DeletePairRecord"),
+		PairRecordID: udid,
+	}
+
+	return this.result(req, udid)
+}
+
+// result returns the error of a request answered by a result, about device if set
+func (this *MuxClient) result(frame interface{}, device string) error {
+	pkg, err := this.Request(frame)
+	if err != nil {
+		return err
+	}
+
+	var resp frames.Result
+	if err := pkg.UnmarshalBody(&resp); err != nil {
+		return err
+	}
+
+	if resp.Number != 0 {
+		return usbmuxdError(uint64(resp.Number), device)
+	}
+
+	return nil
+}
+
+// muxListener is one `Listen` subscriber, notifications queue up here
+// so a slow subscriber holds up nobody else
+type muxListener struct {
+	ch    chan frames.Response
+	queue []frames.Response
+	/* the listening connection is gone, close ch once queue is drained */
+	ended bool
+	wake  chan struct{}
+	done  chan struct{}
+}
+
+// Listen sends every notification to ch, starting with an `Attached`
+// for each device already plugged in. ch is closed once cancelled or
+// when the usbmuxd connection fails.
+func (this *MuxClient) Listen(ch chan frames.Response) (context.CancelFunc, error) {
+	l := &muxListener{
+		ch:   ch,
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+
+	for {
+		if err := this.listen(); err != nil {
+			return nil, err
+		}
+
+		this.mutex.Lock()
+		/* the connection may have failed since it was dialed */
+		if this.events == nil {
+			this.mutex.Unlock()
+			continue
+		}
+		for _, d := range this.devices {
+			l.queue = append(l.queue, attachedResponse(d))
+		}
+		this.listeners[l] = true
+		this.mutex.Unlock()
+		break
+	}
+
+	go l.deliver(&this.mutex)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(l.done)
+
+			this.mutex.Lock()
+			delete(this.listeners, l)
+			events := this.events
+			/* nobody listens anymore, the daemon need not keep talking */
+			if len(this.listeners) == 0 && events != nil {
+				this.dropEvents()
+			} else {
+				events = nil
+			}
+			this.mutex.Unlock()
+
+			if events != nil {
+				events.Close()
+			}
+		})
+	}, nil
+}
+
+// listen dials the listening connection unless it is up
+func (this *MuxClient) listen() error {
+	this.listenMutex.Lock()
+	defer this.listenMutex.Unlock()
+
+	this.mutex.Lock()
+	up := this.events != nil
+	this.mutex.Unlock()
+	if up {
+		return nil
+	}
+
+	frame := frames.CreateBaseRequest(frames.Listen)
+	frame.LibUSBMuxVersion = frames.LibUSBMuxVersion
+
+	conn, err := dialRequest(context.Background(), "", frame, frames.BinaryListen, nil)
+	if err != nil {
+		return err
+	}
+
+	/* notifications may be minutes apart */
+	conn.Timeout = 0
+
+	this.mutex.Lock()
+	this.events = conn
+	this.devices = nil
+	this.mutex.Unlock()
+
+	go this.read(conn)
+
+	return nil
+}
+
+// dropEvents must be called with the mutex held, the caller closes the connection
+func (this *MuxClient) dropEvents() {
+	for l := range this.listeners {
+		l.ended = true
+		l.signal()
+	}
+	this.listeners = make(map[*muxListener]bool)
+	this.events = nil
+	this.devices = nil
+}
+
+// notify keeps track of the devices and queues the notification for every listener
+func (this *MuxClient) notify(pkg *frames.Package) {
+	msg, err := decodePackage(pkg)
+	if err != nil {
+		debugf(UsbmuxdServiceName, "notification dropped: %s", err)
+		return
+	} else if _, ok := msg.(*frames.Result); ok {
+		return
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	switch v := msg.(type) {
+	case *frames.DeviceAttached:
+		this.devices = append(removeDevice(this.devices, v.DeviceID), v.Properties)
+	case *frames.DeviceDetached:
+		this.devices = removeDevice(this.devices, v.DeviceID)
+	}
+
+	for l := range this.listeners {
+		l.queue = append(l.queue, msg)
+		l.signal()
+	}
+}
+
+func removeDevice(devices []frames.Device, id int) []frames.Device {
+	for i, d := range devices {
+		if d.GetDeviceID() == id {
+			return append(devices[:i:i], devices[i+1:]...)
+		}
+	}
+	return devices
+}
+
+func attachedResponse(d frames.Device) *frames.DeviceAttached {
+	return &frames.DeviceAttached{
+		BaseResponse: frames.BaseResponse{MessageType: "Attached"},
+		DeviceID:     d.GetDeviceID(),
+		Properties:   d,
+	}
+}
+
+func (this *muxListener) signal() {
+	select {
+	case this.wake <- struct{}{}:
+	default:
+	}
+}
+
+// deliver hands the queue to ch in order, mutex guards the queue
+func (this *muxListener) deliver(mutex *sync.Mutex) {
+	defer close(this.ch)
+
+	for {
+		mutex.Lock()
+		queue, ended := this.queue, this.ended
+		this.queue = nil
+		mutex.Unlock()
+
+		for _, msg := range queue {
+			select {
+			case this.ch <- msg:
+			case <-this.done:
+				return
+			}
+		}
+
+		if ended {
+			return
+		}
+
+		select {
+		case <-this.wake:
+		case <-this.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package muxtest
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"net"
+	"sync"
+
+	"howett.net/plist"
+)
+
+var (
+	deviceKeyOnce sync.Once
+	deviceKeyPEM  []byte
+)
+
+/* generating a key is slow, every stand-in shares one */
+func devicePublicKey() []byte {
+	deviceKeyOnce.Do(func() {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			panic(err)
+		}
+		deviceKeyPEM = pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&key.PublicKey)})
+	})
+	return deviceKeyPEM
+}
+
+// Lockdown answers the lockdown port of a device, without SSL. Host ids
+// become trusted by pairing or `Trust`, sessions only start for them.
+// `Serve` is the `Handler` to register for `tunnel.LockdownPort`.
+type Lockdown struct {
+	// ProductVersion reported, "14.2" when empty
+	ProductVersion string
+	// ServicePort handed out by `StartService`
+	ServicePort int
+	// Services `StartService` knows, any when nil
+	Services []string
+
+	mutex      sync.Mutex
+	pairErrors []string
+	trusted    map[string]bool
+	requests   []string
+	leaked     bool
+	/* sessions of older generations are gone */
+	generation int
+}
+
+func NewLockdown() *Lockdown {
+	return &Lockdown{trusted: make(map[string]bool), generation: 1}
+}
+
+// FailPair answers the next `Pair` requests with these errors, in order
+func (this *Lockdown) FailPair(codes ...string) {
+	this.mutex.Lock()
+	this.pairErrors = append(this.pairErrors, codes...)
+	this.mutex.Unlock()
+}
+
+func (this *Lockdown) Trust(hostID string) {
+	this.mutex.Lock()
+	this.trusted[hostID] = true
+	this.mutex.Unlock()
+}
+
+func (this *Lockdown) Trusted(hostID string) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.trusted[hostID]
+}
+
+// ExpireSessions ends the sessions started so far, like a device that
+// restarted lockdownd, their next `StartService` fails with SessionInactive
+func (this *Lockdown) ExpireSessions() {
+	this.mutex.Lock()
+	this.generation++
+	this.mutex.Unlock()
+}
+
+// LeakedKeys tells whether a pair record sent to the device held a
+// private key
+func (this *Lockdown) LeakedKeys() bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.leaked
+}
+
+// Requests names the requests answered so far
+func (this *Lockdown) Requests() []string {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return append([]string(nil), this.requests...)
+}
+
+func (this *Lockdown) Serve(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	/* generation of the session on conn, 0 without */
+	session := 0
+	for {
+		var h [4]byte
+		if _, err := io.ReadFull(r, h[:]); err != nil {
+			return
+		}
+		body := make([]byte, binary.BigEndian.Uint32(h[:]))
+		if _, err := io.ReadFull(r, body); err != nil {
+			return
+		}
+
+		var req map[string]interface{}
+		if _, err := plist.Unmarshal(body, &req); err != nil {
+			return
+		}
+
+		resp := this.answer(req, &session)
+		out, err := plist.Marshal(resp, plist.XMLFormat)
+		if err != nil {
+			return
+		}
+		binary.BigEndian.PutUint32(h[:], uint32(len(out)))
+		if _, err := conn.Write(append(h[:], out...)); err != nil {
+			return
+		}
+	}
+}
+
+func (this *Lockdown) answer(req map[string]interface{}, session *int) map[string]interface{} {
+	name, _ := req["Request"].(string)
+	resp := map[string]interface{}{"Request": name}
+
+	hostID, _ := req["HostID"].(string)
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if record, ok := req["PairRecord"].(map[string]interface{}); ok {
+		hostID, _ = record["HostID"].(string)
+		if record["HostPrivateKey"] != nil || record["RootPrivateKey"] != nil {
+			this.leaked = true
+		}
+	}
+
+	this.requests = append(this.requests, name)
+	switch name {
+	case "QueryType":
+		resp["Type"] = "com.apple.mobile.lockdown"
+	case "GetValue":
+		switch key, _ := req["Key"].(string); key {
+		case "ProductVersion":
+			resp["Value"] = this.ProductVersion
+			if this.ProductVersion == "" {
+				resp["Value"] = "14.2"
+			}
+		case "DevicePublicKey":
+			resp["Value"] = devicePublicKey()
+		case "WiFiAddress":
+			resp["Value"] = "00:11:22:33:44:55"
+		default:
+			resp["Error"] = "MissingValue"
+		}
+	case "Pair":
+		if len(this.pairErrors) > 0 {
+			resp["Error"] = this.pairErrors[0]
+			this.pairErrors = this.pairErrors[1:]
+			break
+		}
+		this.trusted[hostID] = true
+		resp["EscrowBag"] = []byte("escrow bag")
+	case "Unpair":
+		if !this.trusted[hostID] {
+			resp["Error"] = "InvalidHostID"
+			break
+		}
+		delete(this.trusted, hostID)
+	case "ValidatePair":
+		if !this.trusted[hostID] {
+			resp["Error"] = "InvalidHostID"
+		}
+	case "StartSession":
+		if !this.trusted[hostID] {
+			resp["Error"] = "InvalidHostID"
+			break
+		}
+		*session = this.generation
+		resp["SessionID"] = "SESSION"
+		resp["EnableSessionSSL"] = false
+	case "StopSession":
+		*session = 0
+	case "StartService":
+		if *session != this.generation {
+			resp["Error"] = "SessionInactive"
+			break
+		}
+		if !this.knows(req["Service"]) {
+			resp["Error"] = "InvalidService"
+			break
+		}
+		resp["Service"] = req["Service"]
+		resp["Port"] = this.ServicePort
+		resp["EnableServiceSSL"] = false
+	default:
+		resp["Error"] = "InvalidService"
+	}
+	return resp
+}
+
+func (this *Lockdown) knows(name interface{}) bool {
+	if this.Services == nil {
+		return true
+	}
+	for _, service := range this.Services {
+		if service == name {
+			return true
+		}
+	}
+	return false
+}
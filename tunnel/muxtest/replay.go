@@ -0,0 +1,496 @@
+package muxtest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"iconsole/frames"
+	"iconsole/tunnel"
+	"io"
+	"net"
+	"sort"
+	"sync"
+
+	"howett.net/plist"
+)
+
+// Divergence is where a client left the recorded conversation
+type Divergence struct {
+	Conn     uint64
+	Device   string
+	Service  string
+	Index    int
+	Expected string
+	Got      string
+}
+
+func (this *Divergence) Error() string {
+	return fmt.Sprintf("conn %d %s of %s diverged at record %d\nexpected: %s\ngot: %s",
+		this.Conn, this.Service, this.Device, this.Index, this.Expected, this.Got)
+}
+
+type conversation struct {
+	id      uint64
+	device  string
+	service string
+	records []*tunnel.TraceRecord
+	played  bool
+}
+
+// muxConversation is a recorded usbmuxd connection, requests holds its
+// plist requests in comparable form and index where they were recorded
+type muxConversation struct {
+	*conversation
+	requests []string
+	index    []int
+}
+
+// Replay serves a recorded trace as fake devices behind a `Server`.
+// usbmuxd replies come from the server, but every plist request is
+// matched against a recorded usbmuxd connection, picked by its first
+// request. Every device connection plays the next recorded conversation
+// of the same service. Requests are matched frame by frame and the first
+// mismatch ends the connection. Requests of the binary usbmuxd protocol
+// are not matched.
+type Replay struct {
+	*Server
+
+	mutex         sync.Mutex
+	conversations map[string][]*conversation
+	muxes         []*muxConversation
+	divergences   []*Divergence
+}
+
+// ReadTrace parses the JSON lines written by `tunnel.JSONTracer`
+func ReadTrace(r io.Reader) ([]*tunnel.TraceRecord, error) {
+	var records []*tunnel.TraceRecord
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, int(frames.MaxServicePackageSize))
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var record tunnel.TraceRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("trace line %d: %s", line, err)
+		}
+		records = append(records, &record)
+	}
+
+	return records, scanner.Err()
+}
+
+func NewReplay(records []*tunnel.TraceRecord) (*Replay, error) {
+	this := &Replay{conversations: make(map[string][]*conversation)}
+
+	/* group by connection, keeping the recorded order */
+	byConn := make(map[uint64]*conversation)
+	var order, muxes []*conversation
+	for _, record := range records {
+		if record.Service == "" {
+			continue
+		}
+		c, ok := byConn[record.Conn]
+		if !ok {
+			c = &conversation{id: record.Conn, device: record.Device, service: record.Service}
+			byConn[record.Conn] = c
+			if c.service == tunnel.UsbmuxdServiceName {
+				muxes = append(muxes, c)
+			} else {
+				order = append(order, c)
+			}
+		}
+		c.records = append(c.records, record)
+	}
+
+	if len(order) == 0 {
+		return nil, errors.New("trace has no device connections")
+	}
+
+	server, err := NewServer()
+	if err != nil {
+		return nil, err
+	}
+	this.Server = server
+
+	ports := make(map[string]map[int]string)
+	pairRecords := make(map[string]*frames.PairRecord)
+
+	for _, c := range order {
+		key := c.device + "\x00" + c.service
+		this.conversations[key] = append(this.conversations[key], c)
+
+		if ports[c.device] == nil {
+			ports[c.device] = map[int]string{tunnel.LockdownPort: tunnel.LockdownServiceName}
+		}
+		if c.service == tunnel.LockdownServiceName {
+			if err := this.prepareLockdown(c, ports[c.device], pairRecords); err != nil {
+				server.Close()
+				return nil, err
+			}
+		}
+	}
+
+	recorded := recordedSerials(muxes)
+	for _, c := range muxes {
+		m := &muxConversation{conversation: c}
+		for i, record := range c.records {
+			if record.Direction == tunnel.TraceSend && record.Plist != "" {
+				m.requests = append(m.requests, muxRequest(record.Plist, recorded))
+				m.index = append(m.index, i)
+			}
+		}
+		if len(m.requests) > 0 {
+			this.muxes = append(this.muxes, m)
+		}
+	}
+	server.mutex.Lock()
+	server.inspect = this.inspector
+	server.mutex.Unlock()
+
+	devices := make([]string, 0, len(ports))
+	for udid := range ports {
+		devices = append(devices, udid)
+	}
+	sort.Strings(devices)
+
+	for i, udid := range devices {
+		id := i + 1
+		this.Attach(&frames.USBDevice{
+			DeviceModel: frames.DeviceModel{ConnectionType: "USB", DeviceID: id, SerialNumber: udid},
+			UDID:        udid,
+		})
+		for port, service := range ports[udid] {
+			_ = this.Handle(id, port, this.handler(udid, service))
+		}
+		if record, ok := pairRecords[udid]; ok {
+			_ = this.SetPairRecord(udid, record)
+		}
+	}
+
+	return this, nil
+}
+
+// prepareLockdown learns the service ports and the pair record ids and
+// turns SSL off, the trace holds plain text only
+func (this *Replay) prepareLockdown(c *conversation, ports map[int]string, pairRecords map[string]*frames.PairRecord) error {
+	for _, record := range c.records {
+		if record.Plist == "" {
+			continue
+		}
+
+		var m map[string]interface{}
+		if _, err := plist.Unmarshal([]byte(record.Plist), &m); err != nil {
+			return fmt.Errorf("conn %d: %s", c.id, err)
+		}
+
+		if record.Direction == tunnel.TraceSend {
+			if m["Request"] == "StartSession" {
+				hostId, _ := m["HostID"].(string)
+				buid, _ := m["SystemBUID"].(string)
+				pairRecords[c.device] = &frames.PairRecord{HostID: hostId, SystemBUID: buid}
+				this.BUID = buid
+			}
+			continue
+		}
+
+		rewrite := false
+		for _, key := range []string{"EnableSessionSSL", "EnableServiceSSL"} {
+			if enable, _ := m[key].(bool); enable {
+				m[key] = false
+				rewrite = true
+			}
+		}
+		if rewrite {
+			data, err := plist.MarshalIndent(m, plist.XMLFormat, "\t")
+			if err != nil {
+				return err
+			}
+			record.Plist = string(data)
+		}
+
+		if service, ok := m["Service"].(string); ok {
+			switch port := m["Port"].(type) {
+			case uint64:
+				ports[int(port)] = service
+			case int64:
+				ports[int(port)] = service
+			}
+		}
+	}
+	return nil
+}
+
+// recordedSerials maps the device ids of the recording to serial numbers,
+// the replay hands out ids of its own
+func recordedSerials(muxes []*conversation) func(id uint64) string {
+	serials := make(map[uint64]string)
+	add := func(v interface{}) {
+		m, _ := v.(map[string]interface{})
+		id, _ := m["DeviceID"].(uint64)
+		properties, _ := m["Properties"].(map[string]interface{})
+		if serial, ok := properties["SerialNumber"].(string); ok {
+			serials[id] = serial
+		}
+	}
+
+	for _, c := range muxes {
+		for _, record := range c.records {
+			if record.Direction != tunnel.TraceRecv || record.Plist == "" {
+				continue
+			}
+			var m map[string]interface{}
+			if _, err := plist.Unmarshal([]byte(record.Plist), &m); err != nil {
+				continue
+			}
+			if list, ok := m["DeviceList"].([]interface{}); ok {
+				for _, v := range list {
+					add(v)
+				}
+			} else if m["MessageType"] == "Attached" {
+				add(m)
+			}
+		}
+	}
+
+	return func(id uint64) string {
+		return serials[id]
+	}
+}
+
+// muxRequest is the usbmuxd request in text as the trace has it, without
+// what names the client and with the device given by serial number
+func muxRequest(text string, serials func(id uint64) string) string {
+	var m map[string]interface{}
+	if _, err := plist.Unmarshal([]byte(text), &m); err != nil {
+		return text
+	}
+	for _, key := range []string{"BundleID", "ClientVersionString", "ProgName", "kLibUSBMuxVersion"} {
+		delete(m, key)
+	}
+	if id, ok := m["DeviceID"].(uint64); ok {
+		if serial := serials(id); serial != "" {
+			m["DeviceID"] = serial
+		}
+	}
+
+	data, err := plist.MarshalIndent(m, plist.XMLFormat, "\t")
+	if err != nil {
+		return text
+	}
+	return string(data)
+}
+
+// inspector matches the requests of one usbmuxd connection, the first
+// one picks the recorded connection to follow
+func (this *Replay) inspector() func(body []byte) bool {
+	var c *muxConversation
+	next := 0
+
+	serials := func(id uint64) string {
+		return this.serialNumber(int(id))
+	}
+
+	return func(body []byte) bool {
+		got := muxRequest(tunnel.TracePlist(body), serials)
+
+		if c == nil {
+			var d *Divergence
+			if c, d = this.nextMux(got); d != nil {
+				this.diverge(d)
+				return false
+			}
+			next = 1
+			return true
+		}
+
+		if next >= len(c.requests) {
+			this.diverge(&Divergence{Conn: c.id, Service: c.service, Index: len(c.records), Expected: "end of conversation", Got: got})
+			return false
+		}
+		if want := c.requests[next]; got != want {
+			this.diverge(&Divergence{Conn: c.id, Service: c.service, Index: c.index[next], Expected: tunnel.TraceSend + " " + want, Got: got})
+			return false
+		}
+		next++
+		return true
+	}
+}
+
+// nextMux takes the first unplayed usbmuxd connection starting with request
+func (this *Replay) nextMux(request string) (*muxConversation, *Divergence) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	var first *muxConversation
+	for _, c := range this.muxes {
+		if c.played {
+			continue
+		}
+		if c.requests[0] == request {
+			c.played = true
+			return c, nil
+		}
+		if first == nil {
+			first = c
+		}
+	}
+
+	if first == nil {
+		return nil, &Divergence{Service: tunnel.UsbmuxdServiceName, Expected: "no more connections", Got: request}
+	}
+	return nil, &Divergence{Conn: first.id, Service: first.service, Index: first.index[0],
+		Expected: tunnel.TraceSend + " " + first.requests[0], Got: request}
+}
+
+// Divergences returns every mismatch so far
+func (this *Replay) Divergences() []*Divergence {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return append([]*Divergence(nil), this.divergences...)
+}
+
+// Unplayed counts the recorded connections no client asked for yet
+func (this *Replay) Unplayed() int {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	n := 0
+	for _, list := range this.conversations {
+		for _, c := range list {
+			if !c.played {
+				n++
+			}
+		}
+	}
+	for _, c := range this.muxes {
+		if !c.played {
+			n++
+		}
+	}
+	return n
+}
+
+func (this *Replay) diverge(d *Divergence) {
+	this.mutex.Lock()
+	this.divergences = append(this.divergences, d)
+	this.mutex.Unlock()
+}
+
+func (this *Replay) next(udid, service string) *conversation {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	for _, c := range this.conversations[udid+"\x00"+service] {
+		if !c.played {
+			c.played = true
+			return c
+		}
+	}
+	return nil
+}
+
+func (this *Replay) handler(udid, service string) Handler {
+	return func(conn net.Conn) {
+		defer conn.Close()
+
+		c := this.next(udid, service)
+		if c == nil {
+			this.diverge(&Divergence{Device: udid, Service: service, Expected: "no more connections", Got: "connect"})
+			return
+		}
+
+		if d := c.play(conn); d != nil {
+			this.diverge(d)
+		}
+	}
+}
+
+func (this *conversation) play(conn net.Conn) *Divergence {
+	reader := bufio.NewReader(conn)
+
+	for i, record := range this.records {
+		diverge := func(got string) *Divergence {
+			return &Divergence{Conn: this.id, Device: this.device, Service: this.service, Index: i, Expected: expected(record), Got: got}
+		}
+
+		switch {
+		case record.Direction == tunnel.TraceRecv && record.Plist != "":
+			if err := writeServicePlist(conn, []byte(record.Plist)); err != nil {
+				return diverge(err.Error())
+			}
+		case record.Direction == tunnel.TraceRecv:
+			data, err := hex.DecodeString(record.Hex)
+			if err != nil {
+				return diverge(err.Error())
+			}
+			if _, err := conn.Write(data); err != nil {
+				return diverge(err.Error())
+			}
+		case record.Plist != "":
+			body, err := readServicePlist(reader)
+			if err != nil {
+				return diverge(err.Error())
+			}
+			if got := tunnel.TracePlist(body); got != record.Plist {
+				return diverge(got)
+			}
+		default:
+			want, err := hex.DecodeString(record.Hex)
+			if err != nil {
+				return diverge(err.Error())
+			}
+			got := make([]byte, len(want))
+			if n, err := io.ReadFull(reader, got); err != nil {
+				return diverge(hex.EncodeToString(got[:n]) + " " + err.Error())
+			}
+			if !bytes.Equal(got, want) {
+				return diverge(hex.EncodeToString(got))
+			}
+		}
+	}
+
+	/* the client must not ask for more than the recording has */
+	var b [1]byte
+	if n, _ := reader.Read(b[:]); n > 0 {
+		return &Divergence{Conn: this.id, Device: this.device, Service: this.service, Index: len(this.records),
+			Expected: "end of conversation", Got: hex.EncodeToString(b[:n])}
+	}
+	return nil
+}
+
+func expected(record *tunnel.TraceRecord) string {
+	if record.Plist != "" {
+		return record.Direction + " " + record.Plist
+	}
+	return record.Direction + " " + record.Hex
+}
+
+func readServicePlist(r io.Reader) ([]byte, error) {
+	var header [frames.ServicePackageHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:])
+	if err := frames.CheckServicePackageLength(length); err != nil {
+		return nil, err
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+func writeServicePlist(w io.Writer, body []byte) error {
+	buf := make([]byte, frames.ServicePackageHeaderSize+len(body))
+	binary.BigEndian.PutUint32(buf, uint32(len(body)))
+	copy(buf[frames.ServicePackageHeaderSize:], body)
+	_, err := w.Write(buf)
+	return err
+}
@@ -0,0 +1,265 @@
+package muxtest_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"iconsole/frames"
+	"iconsole/services"
+	"iconsole/services/afctest"
+	"iconsole/tunnel"
+	"iconsole/tunnel/muxtest"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"howett.net/plist"
+)
+
+var update = flag.Bool("update", false, "record testdata/afc.jsonl again")
+
+const (
+	fixtureSerial = "00008030-001A2B3C4D5E802E"
+	fixturePort   = 49152
+)
+
+// lockdownStub answers lockdown like a paired device, without SSL so the
+// trace can be recorded in process
+func lockdownStub(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	for {
+		var h [4]byte
+		if _, err := io.ReadFull(r, h[:]); err != nil {
+			return
+		}
+		body := make([]byte, binary.BigEndian.Uint32(h[:]))
+		if _, err := io.ReadFull(r, body); err != nil {
+			return
+		}
+
+		var req map[string]interface{}
+		if _, err := plist.Unmarshal(body, &req); err != nil {
+			return
+		}
+		name, _ := req["Request"].(string)
+		resp := map[string]interface{}{"Request": name}
+		switch name {
+		case "QueryType":
+			resp["Type"] = "com.apple.mobile.lockdown"
+		case "GetValue":
+			resp["Value"] = "14.2"
+		case "StartSession":
+			resp["SessionID"] = "6B3D9A1E-42C5-4F0E-9D8C-1A2B3C4D5E6F"
+			resp["EnableSessionSSL"] = false
+		case "StartService":
+			resp["Service"] = req["Service"]
+			resp["Port"] = fixturePort
+			resp["EnableServiceSSL"] = false
+		case "StopSession":
+		default:
+			resp["Error"] = "InvalidService"
+		}
+
+		out, err := plist.Marshal(resp, plist.XMLFormat)
+		if err != nil {
+			return
+		}
+		binary.BigEndian.PutUint32(h[:], uint32(len(out)))
+		if _, err := conn.Write(append(h[:], out...)); err != nil {
+			return
+		}
+	}
+}
+
+// afcSession is what the fixture recorded, listing the camera roll and
+// reading a file out of it
+func afcSession(dir string) (string, error) {
+	defer services.DefaultSessionPool.Close()
+
+	devices, err := tunnel.Devices()
+	if err != nil {
+		return "", err
+	}
+	var device frames.Device
+	for _, d := range devices {
+		if d.GetSerialNumber() == fixtureSerial {
+			device = d
+		}
+	}
+	if device == nil {
+		return "", os.ErrNotExist
+	}
+
+	afc, err := services.NewAFCService(device)
+	if err != nil {
+		return "", err
+	}
+	defer afc.Close()
+
+	names, err := afc.ReadDirectory(dir)
+	if err != nil {
+		return "", err
+	}
+	f, err := afc.FileOpen(dir+"/IMG_0001.JPG", services.AFC_RDONLY)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	data := &bytes.Buffer{}
+	if _, err := f.WriteTo(data); err != nil {
+		return "", err
+	}
+	return strings.Join(names, " ") + " " + data.String(), nil
+}
+
+// record runs afcSession against stand-ins and writes its trace
+func record(t *testing.T, path string) {
+	server, err := muxtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.BUID = "1F2E3D4C-5B6A-4978-8695-A4B3C2D1E0F9"
+
+	/* an id other than the one the replay hands out */
+	server.Attach(&frames.USBDevice{
+		DeviceModel: frames.DeviceModel{ConnectionType: "USB", DeviceID: 7, SerialNumber: fixtureSerial},
+		ProductID:   0x12a8,
+		LocationID:  0x14200000,
+	})
+	if err := server.SetPairRecord(fixtureSerial, &frames.PairRecord{HostID: "A1B2C3D4-E5F6-4789-9ABC-DEF012345678",
+		SystemBUID: server.BUID, EscrowBag: []byte{1, 2, 3}}); err != nil {
+		t.Fatal(err)
+	}
+
+	mtime := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	afc := afctest.NewServer()
+	afc.Mkdir("/DCIM/100APPLE")
+	for _, name := range []string{"IMG_0001.JPG", "IMG_0002.JPG"} {
+		if err := afc.WriteFile("/DCIM/100APPLE/"+name, []byte("jpeg "+name), mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = server.Handle(7, tunnel.LockdownPort, lockdownStub)
+	_ = server.Handle(7, fixturePort, afc.Serve)
+
+	defer useSocket(t, server.Address())()
+
+	out := &bytes.Buffer{}
+	tunnel.DefaultTracer = tunnel.NewJSONTracer(out)
+	_, err = afcSession("/DCIM/100APPLE")
+	tunnel.DefaultTracer = nil
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	/* a device turns SSL on, the trace holds the plain text anyway */
+	trace := strings.Replace(out.String(), `<key>EnableSessionSSL</key>\n\t\t<false/>`, `<key>EnableSessionSSL</key>\n\t\t<true/>`, -1)
+	trace = strings.Replace(trace, `<key>EnableServiceSSL</key>\n\t\t<false/>`, `<key>EnableServiceSSL</key>\n\t\t<true/>`, -1)
+	if err := ioutil.WriteFile(path, []byte(trace), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func useSocket(t *testing.T, address string) func() {
+	t.Helper()
+
+	old := tunnel.SocketAddress()
+	if err := tunnel.SetSocketAddress(address); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		_ = tunnel.SetSocketAddress(old)
+	}
+}
+
+func startReplay(t *testing.T) *muxtest.Replay {
+	t.Helper()
+
+	f, err := os.Open(filepath.Join("testdata", "afc.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	records, err := muxtest.ReadTrace(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replay, err := muxtest.NewReplay(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return replay
+}
+
+func TestReplay(t *testing.T) {
+	if *update {
+		record(t, filepath.Join("testdata", "afc.jsonl"))
+	}
+
+	replay := startReplay(t)
+	restore := useSocket(t, replay.Address())
+	got, err := afcSession("/DCIM/100APPLE")
+	restore()
+	_ = replay.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := ". .. IMG_0001.JPG IMG_0002.JPG jpeg IMG_0001.JPG"; got != want {
+		t.Errorf("session = %q, want %q", got, want)
+	}
+	for _, d := range replay.Divergences() {
+		t.Error(d)
+	}
+	if n := replay.Unplayed(); n != 0 {
+		t.Errorf("%d recorded connections not played", n)
+	}
+}
+
+func TestReplayDiverges(t *testing.T) {
+	replay := startReplay(t)
+	restore := useSocket(t, replay.Address())
+	_, err := afcSession("/DCIM/101APPLE")
+	restore()
+	_ = replay.Close()
+
+	if err == nil {
+		t.Fatal("session left the recording and still worked")
+	}
+	divergences := replay.Divergences()
+	if len(divergences) != 1 {
+		t.Fatalf("%d divergences, want 1: %v", len(divergences), divergences)
+	}
+	if d := divergences[0]; d.Service != services.AFCServiceName || d.Device != fixtureSerial {
+		t.Errorf("diverged in %s of %s", d.Service, d.Device)
+	}
+}
+
+func TestReplayUsbmuxdDiverges(t *testing.T) {
+	replay := startReplay(t)
+	defer replay.Close()
+	defer useSocket(t, replay.Address())()
+
+	/* the recording never asked usbmuxd for a pair record to delete */
+	device := &frames.USBDevice{DeviceModel: frames.DeviceModel{ConnectionType: "USB", DeviceID: 1, SerialNumber: fixtureSerial}}
+	if err := tunnel.DeletePairRecord(device); err == nil {
+		t.Error("request the recording lacks was answered")
+	}
+
+	divergences := replay.Divergences()
+	if len(divergences) != 1 || divergences[0].Service != tunnel.UsbmuxdServiceName {
+		t.Fatalf("divergences %v, want one of usbmuxd", divergences)
+	}
+	if !strings.Contains(divergences[0].Got, "DeletePairRecord") {
+		t.Errorf("divergence got %q", divergences[0].Got)
+	}
+}
@@ -0,0 +1,623 @@
+package muxtest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"iconsole/frames"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"howett.net/plist"
+)
+
+const (
+	resultOk          = 0
+	resultBadCommand  = 1
+	resultBadDev      = 2
+	resultCommRefused = 3
+	resultBadVersion  = 6
+)
+
+// Handler serves a raw device port once usbmuxd accepted a `Connect`
+// the handler owns conn and must close it
+type Handler func(conn net.Conn)
+
+type device struct {
+	device frames.Device
+	ports  map[int]Handler
+}
+
+// Server is an in-process usbmuxd speaking the plist and the binary
+// protocol on a local unix socket. It is meant for hermetic tests of
+// `tunnel` and `services` without a real daemon or device.
+type Server struct {
+	BUID string
+	// Legacy answers plist requests with BadVersion like an old daemon
+	Legacy bool
+
+	listener net.Listener
+	dir      string
+
+	mutex       sync.Mutex
+	devices     map[int]*device
+	order       []int
+	pairRecords map[string][]byte
+	listeners   map[*serverConn]bool
+	conns       map[net.Conn]bool
+	closed      bool
+	wg          sync.WaitGroup
+	/* gives every connection a check of its plist requests, false ends it */
+	inspect func() func(body []byte) bool
+}
+
+func NewServer() (*Server, error) {
+	dir, err := ioutil.TempDir("", "muxtest")
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := net.Listen("unix", filepath.Join(dir, "usbmuxd"))
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, err
+	}
+
+	s := &Server{
+		BUID:        "00000000-0000-0000-0000-000000000000",
+		listener:    l,
+		dir:         dir,
+		devices:     make(map[int]*device),
+		pairRecords: make(map[string][]byte),
+		listeners:   make(map[*serverConn]bool),
+		conns:       make(map[net.Conn]bool),
+	}
+
+	s.wg.Add(1)
+	go s.serve()
+
+	return s, nil
+}
+
+// Path of the unix socket the server listens on
+func (this *Server) Path() string {
+	return this.listener.Addr().String()
+}
+
+// Address in `USBMUXD_SOCKET_ADDRESS` form for `tunnel.SetSocketAddress`
+func (this *Server) Address() string {
+	return "UNIX:" + this.Path()
+}
+
+func (this *Server) Close() error {
+	this.mutex.Lock()
+	if this.closed {
+		this.mutex.Unlock()
+		return nil
+	}
+	this.closed = true
+	err := this.listener.Close()
+	for c := range this.conns {
+		_ = c.Close()
+	}
+	this.mutex.Unlock()
+
+	this.wg.Wait()
+
+	if e := os.RemoveAll(this.dir); err == nil {
+		err = e
+	}
+	return err
+}
+
+// Attach plugs a device in and notifies every listening client.
+// `device` must be a *frames.USBDevice or *frames.NetworkDevice
+func (this *Server) Attach(d frames.Device) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	id := d.GetDeviceID()
+	if _, ok := this.devices[id]; !ok {
+		this.order = append(this.order, id)
+	}
+	this.devices[id] = &device{device: d, ports: make(map[int]Handler)}
+
+	msg := attachedMessage(d)
+	for c := range this.listeners {
+		c.notify(msg)
+	}
+}
+
+// Detach unplugs the device and notifies every listening client
+func (this *Server) Detach(deviceId int) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if _, ok := this.devices[deviceId]; !ok {
+		return
+	}
+	delete(this.devices, deviceId)
+	for i, id := range this.order {
+		if id == deviceId {
+			this.order = append(this.order[:i], this.order[i+1:]...)
+			break
+		}
+	}
+
+	msg := map[string]interface{}{
+		"MessageType": "Detached",
+		"DeviceID":    deviceId,
+	}
+	for c := range this.listeners {
+		c.notify(msg)
+	}
+}
+
+// Handle registers the handler serving `port` of an attached device
+func (this *Server) Handle(deviceId int, port int, handler Handler) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	d, ok := this.devices[deviceId]
+	if !ok {
+		return errors.New("device not attached")
+	}
+	d.ports[port] = handler
+	return nil
+}
+
+// SetPairRecord stores a pair record as if it was saved by a client
+func (this *Server) SetPairRecord(udid string, record *frames.PairRecord) error {
+	data, err := plist.Marshal(record, plist.XMLFormat)
+	if err != nil {
+		return err
+	}
+
+	this.mutex.Lock()
+	this.pairRecords[udid] = data
+	this.mutex.Unlock()
+	return nil
+}
+
+// PairRecord returns the record currently stored for udid
+func (this *Server) PairRecord(udid string) (*frames.PairRecord, error) {
+	this.mutex.Lock()
+	data, ok := this.pairRecords[udid]
+	this.mutex.Unlock()
+
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+
+	var record frames.PairRecord
+	if _, err := plist.Unmarshal(data, &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func (this *Server) serve() {
+	defer this.wg.Done()
+	for {
+		conn, err := this.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		this.mutex.Lock()
+		if this.closed {
+			this.mutex.Unlock()
+			_ = conn.Close()
+			return
+		}
+		this.conns[conn] = true
+		this.mutex.Unlock()
+
+		this.wg.Add(1)
+		go func() {
+			defer this.wg.Done()
+			c := &serverConn{server: this, conn: conn}
+			if handler := c.serve(); handler != nil {
+				handler(conn)
+			} else {
+				_ = conn.Close()
+			}
+			this.forget(conn)
+		}()
+	}
+}
+
+func (this *Server) forget(conn net.Conn) {
+	this.mutex.Lock()
+	delete(this.conns, conn)
+	this.mutex.Unlock()
+}
+
+// serialNumber of an attached device, empty when there is none
+func (this *Server) serialNumber(id int) string {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if d, ok := this.devices[id]; ok {
+		return d.device.GetSerialNumber()
+	}
+	return ""
+}
+
+func (this *Server) deviceProperties() []interface{} {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	list := make([]interface{}, 0, len(this.order))
+	for _, id := range this.order {
+		list = append(list, attachedMessage(this.devices[id].device))
+	}
+	return list
+}
+
+func attachedMessage(d frames.Device) map[string]interface{} {
+	return map[string]interface{}{
+		"MessageType": "Attached",
+		"DeviceID":    d.GetDeviceID(),
+		"Properties":  properties(d),
+	}
+}
+
+func properties(d frames.Device) map[string]interface{} {
+	m := map[string]interface{}{
+		"ConnectionType": d.GetConnectionType(),
+		"DeviceID":       d.GetDeviceID(),
+		"SerialNumber":   d.GetSerialNumber(),
+	}
+
+	switch v := d.(type) {
+	case *frames.USBDevice:
+		m["ConnectionSpeed"] = v.ConnectionSpeed
+		m["LocationID"] = v.LocationID
+		m["ProductID"] = v.ProductID
+		m["UDID"] = v.UDID
+		m["USBSerialNumber"] = v.USBSerialNumber
+	case *frames.NetworkDevice:
+		m["EscapedFullServiceName"] = v.EscapedFullServiceName
+		m["InterfaceIndex"] = v.InterfaceIndex
+		m["NetworkAddress"] = v.NetworkAddress
+	}
+
+	return m
+}
+
+type serverConn struct {
+	server *Server
+	conn   net.Conn
+	/* guards writes to conn and binary */
+	mutex  sync.Mutex
+	events chan map[string]interface{}
+	// the client spoke binary, so replies and notifications are binary too
+	binary bool
+}
+
+func (this *serverConn) isBinary() bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.binary
+}
+
+func (this *serverConn) write(tag uint32, body interface{}) error {
+	pkg := &frames.Package{
+		Version: 1,
+		Type:    8,
+		Tag:     tag,
+	}
+
+	buf, err := pkg.Pack(body)
+	if err != nil {
+		return err
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	_, err = this.conn.Write(buf)
+	return err
+}
+
+func (this *serverConn) writeBinary(tag uint32, message uint32, body []byte) error {
+	pkg := &frames.Package{
+		Version: frames.BinaryVersion,
+		Type:    message,
+		Tag:     tag,
+	}
+
+	var buf bytes.Buffer
+	pkg.PackBinaryTo(&buf, body)
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	_, err := this.conn.Write(buf.Bytes())
+	return err
+}
+
+func (this *serverConn) result(tag uint32, number int) error {
+	if this.isBinary() {
+		return this.writeBinary(tag, frames.BinaryResult, frames.PackBinaryResult(number))
+	}
+	return this.write(tag, map[string]interface{}{
+		"MessageType": "Result",
+		"Number":      number,
+	})
+}
+
+/* called with server mutex held, keeps notifications in order */
+func (this *serverConn) notify(msg map[string]interface{}) {
+	select {
+	case this.events <- msg:
+	default:
+		/* client is not reading, drop it like usbmuxd does */
+		_ = this.conn.Close()
+	}
+}
+
+func (this *serverConn) relay(events <-chan map[string]interface{}) {
+	for msg := range events {
+		var err error
+		if !this.isBinary() {
+			err = this.write(0, msg)
+		} else if message, body := binaryMessage(msg); body != nil {
+			err = this.writeBinary(0, message, body)
+		}
+		if err != nil {
+			_ = this.conn.Close()
+		}
+	}
+}
+
+// binaryMessage converts a notification, the binary protocol knows
+// neither network devices nor pairing so those give a nil body
+func binaryMessage(msg map[string]interface{}) (uint32, []byte) {
+	id, _ := msg["DeviceID"].(int)
+
+	switch msg["MessageType"] {
+	case "Attached":
+		properties, _ := msg["Properties"].(map[string]interface{})
+		if properties["ConnectionType"] != "USB" {
+			return 0, nil
+		}
+		device := &frames.USBDevice{DeviceModel: frames.DeviceModel{DeviceID: id}}
+		device.SerialNumber, _ = properties["SerialNumber"].(string)
+		device.ProductID, _ = properties["ProductID"].(int)
+		device.LocationID, _ = properties["LocationID"].(int)
+		return frames.BinaryDeviceAdd, frames.PackBinaryDevice(device)
+	case "Detached":
+		return frames.BinaryDeviceRemove, frames.PackBinaryDeviceRemove(id)
+	}
+
+	return 0, nil
+}
+
+func (this *serverConn) read() (*frames.Package, error) {
+	l := make([]byte, 4)
+	if _, err := io.ReadFull(this.conn, l); err != nil {
+		return nil, err
+	}
+
+	pkgLen := binary.LittleEndian.Uint32(l)
+	if pkgLen < 16 || pkgLen > 1<<20 {
+		return nil, errors.New("bad package length")
+	}
+
+	buf := make([]byte, pkgLen)
+	copy(buf, l)
+	if _, err := io.ReadFull(this.conn, buf[4:]); err != nil {
+		return nil, err
+	}
+
+	return frames.Unpack(buf)
+}
+
+// serve answers requests until the client hangs up, returning the port
+// handler when the connection was switched over to a device
+func (this *serverConn) serve() Handler {
+	defer func() {
+		this.server.mutex.Lock()
+		if this.events != nil {
+			delete(this.server.listeners, this)
+			close(this.events)
+		}
+		this.server.mutex.Unlock()
+	}()
+
+	var inspect func(body []byte) bool
+	this.server.mutex.Lock()
+	if this.server.inspect != nil {
+		inspect = this.server.inspect()
+	}
+	this.server.mutex.Unlock()
+
+	for {
+		pkg, err := this.read()
+		if err != nil {
+			return nil
+		}
+
+		if pkg.IsBinary() {
+			/* the relay reads it concurrently */
+			this.mutex.Lock()
+			this.binary = true
+			this.mutex.Unlock()
+			var handler Handler
+			if handler, err = this.serveBinary(pkg); handler != nil {
+				return handler
+			} else if err != nil {
+				return nil
+			}
+			continue
+		}
+
+		if this.server.Legacy {
+			if err := this.writeBinary(pkg.Tag, frames.BinaryResult, frames.PackBinaryResult(resultBadVersion)); err != nil {
+				return nil
+			}
+			continue
+		}
+
+		var m map[string]interface{}
+		if err := pkg.UnmarshalBody(&m); err != nil {
+			_ = this.result(pkg.Tag, resultBadCommand)
+			continue
+		}
+
+		if inspect != nil && !inspect(pkg.Body) {
+			return nil
+		}
+
+		mt, _ := m["MessageType"].(string)
+
+		switch mt {
+		case frames.ListDevices:
+			err = this.write(pkg.Tag, map[string]interface{}{
+				"DeviceList": this.server.deviceProperties(),
+			})
+		case frames.Listen:
+			err = this.listen(pkg.Tag)
+		case frames.Connect:
+			var handler Handler
+			if handler, err = this.connect(pkg.Tag, m); handler != nil {
+				return handler
+			}
+		case "ReadBUID":
+			err = this.write(pkg.Tag, map[string]interface{}{
+				"BUID": this.server.BUID,
+			})
+		case "ReadPairRecord":
+			err = this.readPairRecord(pkg.Tag, m)
+		case "SavePairRecord":
+			err = this.savePairRecord(pkg.Tag, m)
+		case "DeletePairRecord":
+			id, _ := m["PairRecordID"].(string)
+			this.server.mutex.Lock()
+			delete(this.server.pairRecords, id)
+			this.server.mutex.Unlock()
+			err = this.result(pkg.Tag, resultOk)
+		default:
+			err = this.result(pkg.Tag, resultBadCommand)
+		}
+
+		if err != nil {
+			return nil
+		}
+	}
+}
+
+func (this *serverConn) serveBinary(pkg *frames.Package) (Handler, error) {
+	switch pkg.Type {
+	case frames.BinaryListen:
+		return nil, this.listen(pkg.Tag)
+	case frames.BinaryConnect:
+		id, port, err := frames.UnpackBinaryConnect(pkg.Body)
+		if err != nil {
+			return nil, this.result(pkg.Tag, resultBadCommand)
+		}
+		return this.connectPort(pkg.Tag, id, port)
+	}
+	return nil, this.result(pkg.Tag, resultBadCommand)
+}
+
+func (this *serverConn) listen(tag uint32) error {
+	/* only this goroutine sets events */
+	if this.events != nil {
+		return this.result(tag, resultBadCommand)
+	}
+
+	/* result goes out before the relay starts, so before any notification */
+	if err := this.result(tag, resultOk); err != nil {
+		return err
+	}
+
+	events := make(chan map[string]interface{}, 64)
+	go this.relay(events)
+
+	/* devices plugged in meanwhile are in the snapshot or notified later */
+	this.server.mutex.Lock()
+	this.events = events
+	for _, id := range this.server.order {
+		this.notify(attachedMessage(this.server.devices[id].device))
+	}
+	this.server.listeners[this] = true
+	this.server.mutex.Unlock()
+
+	return nil
+}
+
+func (this *serverConn) connect(tag uint32, m map[string]interface{}) (Handler, error) {
+	id, _ := m["DeviceID"].(uint64)
+	p, _ := m["PortNumber"].(uint64)
+	port := int(((p << 8) & 0xFF00) | (p >> 8))
+
+	return this.connectPort(tag, int(id), port)
+}
+
+func (this *serverConn) connectPort(tag uint32, id int, port int) (Handler, error) {
+	this.server.mutex.Lock()
+	d, ok := this.server.devices[id]
+	var handler Handler
+	if ok {
+		handler = d.ports[port]
+	}
+	this.server.mutex.Unlock()
+
+	if !ok {
+		return nil, this.result(tag, resultBadDev)
+	} else if handler == nil {
+		return nil, this.result(tag, resultCommRefused)
+	}
+
+	if err := this.result(tag, resultOk); err != nil {
+		return nil, err
+	}
+
+	return handler, nil
+}
+
+func (this *serverConn) readPairRecord(tag uint32, m map[string]interface{}) error {
+	id, _ := m["PairRecordID"].(string)
+
+	this.server.mutex.Lock()
+	data, ok := this.server.pairRecords[id]
+	this.server.mutex.Unlock()
+
+	if !ok {
+		return this.result(tag, resultBadDev)
+	}
+
+	return this.write(tag, map[string]interface{}{
+		"PairRecordData": data,
+	})
+}
+
+func (this *serverConn) savePairRecord(tag uint32, m map[string]interface{}) error {
+	id, _ := m["PairRecordID"].(string)
+	data, ok := m["PairRecordData"].([]byte)
+	if id == "" || !ok {
+		return this.result(tag, resultBadCommand)
+	}
+
+	this.server.mutex.Lock()
+	this.server.pairRecords[id] = data
+	for _, d := range this.server.devices {
+		if d.device.GetSerialNumber() == id {
+			msg := map[string]interface{}{
+				"MessageType": "Paired",
+				"DeviceID":    d.device.GetDeviceID(),
+			}
+			for c := range this.server.listeners {
+				c.notify(msg)
+			}
+		}
+	}
+	this.server.mutex.Unlock()
+
+	return this.result(tag, resultOk)
+}
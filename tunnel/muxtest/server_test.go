@@ -0,0 +1,155 @@
+package muxtest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"iconsole/frames"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func readFrame(t *testing.T, conn net.Conn) *frames.Package {
+	t.Helper()
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	l := make([]byte, 4)
+	if _, err := io.ReadFull(conn, l); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, binary.LittleEndian.Uint32(l))
+	copy(buf, l)
+	if _, err := io.ReadFull(conn, buf[4:]); err != nil {
+		t.Fatal(err)
+	}
+	pkg, err := frames.Unpack(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pkg
+}
+
+func usbDevice(id int, serial string) *frames.USBDevice {
+	return &frames.USBDevice{
+		DeviceModel: frames.DeviceModel{ConnectionType: "USB", DeviceID: id, SerialNumber: serial},
+		ProductID:   0x12a8,
+	}
+}
+
+func writeBinary(t *testing.T, conn net.Conn, message uint32, tag uint32) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	pkg := &frames.Package{Version: frames.BinaryVersion, Type: message, Tag: tag}
+	pkg.PackBinaryTo(&buf, nil)
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBinaryListenNotifications(t *testing.T) {
+	server, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	server.Attach(usbDevice(1, "first"))
+
+	conn, err := net.Dial("unix", server.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	writeBinary(t, conn, frames.BinaryListen, 7)
+
+	reply := readFrame(t, conn)
+	if !reply.IsBinary() || reply.Type != frames.BinaryResult || reply.Tag != 7 {
+		t.Fatalf("first frame %+v, want the binary result", reply)
+	}
+	if n, err := frames.UnpackBinaryResult(reply.Body); err != nil || n != 0 {
+		t.Fatalf("result %d, %v", n, err)
+	}
+
+	go func() {
+		server.Attach(usbDevice(2, "second"))
+		server.Detach(1)
+	}()
+
+	want := []struct {
+		message uint32
+		id      int
+	}{
+		{frames.BinaryDeviceAdd, 1},
+		{frames.BinaryDeviceAdd, 2},
+		{frames.BinaryDeviceRemove, 1},
+	}
+	for _, w := range want {
+		pkg := readFrame(t, conn)
+		if !pkg.IsBinary() || pkg.Tag != 0 || pkg.Type != w.message {
+			t.Fatalf("notification %+v, want message %d", pkg, w.message)
+		}
+		var id int
+		if w.message == frames.BinaryDeviceAdd {
+			device, err := frames.UnpackBinaryDevice(pkg.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			id = device.DeviceID
+		} else if id, err = frames.UnpackBinaryDeviceRemove(pkg.Body); err != nil {
+			t.Fatal(err)
+		}
+		if id != w.id {
+			t.Errorf("message %d for device %d, want %d", w.message, id, w.id)
+		}
+	}
+}
+
+/* run with -race, a binary frame after a plist Listen flips the flag the relay reads */
+func TestProtocolSwitchWhileListening(t *testing.T) {
+	server, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	conn, err := net.Dial("unix", server.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	c := &serverConn{conn: conn}
+	if err := c.write(1, map[string]interface{}{"MessageType": frames.Listen}); err != nil {
+		t.Fatal(err)
+	}
+	if reply := readFrame(t, conn); reply.IsBinary() || reply.Tag != 1 {
+		t.Fatalf("listen reply %+v", reply)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i <= 20; i++ {
+			server.Attach(usbDevice(i, "device"))
+		}
+	}()
+	writeBinary(t, conn, frames.BinaryListen, 2)
+
+	/* plist notifications until the switch, a binary BadCommand for the second listen */
+	for {
+		pkg := readFrame(t, conn)
+		if pkg.IsBinary() && pkg.Type == frames.BinaryResult {
+			if pkg.Tag != 2 {
+				t.Fatalf("result tag %d", pkg.Tag)
+			}
+			if n, _ := frames.UnpackBinaryResult(pkg.Body); n != resultBadCommand {
+				t.Errorf("second listen answered %d", n)
+			}
+			break
+		}
+	}
+	<-done
+}
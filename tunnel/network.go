@@ -0,0 +1,99 @@
+package tunnel
+
+import (
+	"errors"
+	"iconsole/frames"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"howett.net/plist"
+)
+
+// ReadPairRecordFile loads a pair record plist as written by usbmuxd
+// into `/var/lib/lockdown/<UDID>.plist`
+func ReadPairRecordFile(filename string) (*frames.PairRecord, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var record frames.PairRecord
+	if _, err := plist.Unmarshal(data, &record); err != nil {
+		return nil, err
+	}
+
+	if record.HostID == "" || record.RootCertificate == nil || record.RootPrivateKey == nil {
+		return nil, errors.New("pair record incomplete")
+	}
+
+	return &record, nil
+}
+
+// NetworkDialTimeout bounds every TCP dial to a network device made by
+// `LockdownDialNetwork` and the services started from it
+var NetworkDialTimeout = 30 * time.Second
+
+func networkDialer(device *frames.NetworkDevice) (func(port int) (net.Conn, error), error) {
+	ip, err := device.IP()
+	if err != nil {
+		return nil, err
+	}
+
+	zone := ""
+	if ip.IsLinkLocalUnicast() && device.InterfaceIndex > 0 {
+		if iface, err := net.InterfaceByIndex(device.InterfaceIndex); err == nil {
+			zone = iface.Name
+		}
+	}
+
+	return func(port int) (net.Conn, error) {
+		dialer := net.Dialer{
+			Timeout: NetworkDialTimeout,
+		}
+		addr := &net.TCPAddr{IP: ip, Port: port, Zone: zone}
+		return dialer.Dial("tcp", addr.String())
+	}, nil
+}
+
+// LockdownDialNetwork connects to lockdown straight over TCP on the
+// device's network address, usbmuxd is not involved at all. Services
+// started from this connection are dialed the same way.
+func LockdownDialNetwork(device *frames.NetworkDevice, record *frames.PairRecord) (*LockdownConnection, error) {
+	if record == nil {
+		return nil, errors.New("record nil")
+	}
+
+	dial, err := networkDialer(device)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := dial(LockdownPort)
+	if err != nil {
+		return nil, err
+	}
+
+	s := NewService(MixConnectionClient(conn), device, LockdownServiceName)
+
+	return &LockdownConnection{conn: s, device: device, pairRecord: record, dial: dial}, nil
+}
+
+// NetworkLockdownDialer returns a `LockdownDial` for
+// `services.SessionPool` that reaches network devices with
+// `LockdownDialNetwork` and their record in store, other devices still
+// go through usbmuxd
+func NetworkLockdownDialer(store PairRecordStore) func(device frames.Device) (*LockdownConnection, error) {
+	return func(device frames.Device) (*LockdownConnection, error) {
+		d, ok := device.(*frames.NetworkDevice)
+		if !ok {
+			return LockdownDial(device)
+		}
+
+		record, err := pairRecordStore(store).ReadPairRecord(device)
+		if err != nil {
+			return nil, err
+		}
+		return LockdownDialNetwork(d, record)
+	}
+}
@@ -0,0 +1,220 @@
+package tunnel
+
+import (
+	"errors"
+	"iconsole/frames"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"howett.net/plist"
+)
+
+var (
+	ErrPairRecordNotFound = errors.New("pair record not found")
+)
+
+// PairRecordStore keeps host pair records keyed by device UDID
+type PairRecordStore interface {
+	ReadPairRecord(device frames.Device) (*frames.PairRecord, error)
+	SavePairRecord(device frames.Device, record *frames.PairRecord) error
+	DeletePairRecord(device frames.Device) error
+}
+
+// PairRecordLister is a store that can name the devices it holds
+// records of, connected or not
+type PairRecordLister interface {
+	PairRecordUDIDs() ([]string, error)
+}
+
+// DefaultPairRecordStore is used whenever a nil store is passed,
+// replace it before opening any connection
+var DefaultPairRecordStore PairRecordStore = UsbmuxdPairRecordStore{}
+
+func pairRecordStore(store PairRecordStore) PairRecordStore {
+	if store == nil {
+		return DefaultPairRecordStore
+	}
+	return store
+}
+
+// UsbmuxdPairRecordStore asks usbmuxd, which owns the system records
+type UsbmuxdPairRecordStore struct{}
+
+func (UsbmuxdPairRecordStore) ReadPairRecord(device frames.Device) (*frames.PairRecord, error) {
+	record, err := ReadPairRecord(device)
+	/* usbmuxd answers BadDev for a device it has no record of */
+	if errors.Is(err, ErrDeviceNotFound) {
+		return nil, ErrPairRecordNotFound
+	}
+	return record, err
+}
+
+func (UsbmuxdPairRecordStore) SavePairRecord(device frames.Device, record *frames.PairRecord) error {
+	return SavePairRecord(device, record)
+}
+
+func (UsbmuxdPairRecordStore) DeletePairRecord(device frames.Device) error {
+	return DeletePairRecord(device)
+}
+
+// DirectoryPairRecordStore keeps one `<UDID>.plist` per device the
+// way usbmuxd lays out `/var/lib/lockdown`
+type DirectoryPairRecordStore struct {
+	Dir string
+}
+
+func NewDirectoryPairRecordStore(dir string) *DirectoryPairRecordStore {
+	return &DirectoryPairRecordStore{Dir: dir}
+}
+
+func (this *DirectoryPairRecordStore) path(device frames.Device) (string, error) {
+	udid := device.GetSerialNumber()
+	if udid == "" || filepath.Base(udid) != udid {
+		return "", errors.New("invalid device udid")
+	}
+	return filepath.Join(this.Dir, udid+".plist"), nil
+}
+
+func (this *DirectoryPairRecordStore) ReadPairRecord(device frames.Device) (*frames.PairRecord, error) {
+	p, err := this.path(device)
+	if err != nil {
+		return nil, err
+	}
+
+	record, err := ReadPairRecordFile(p)
+	if os.IsNotExist(err) {
+		return nil, ErrPairRecordNotFound
+	}
+	return record, err
+}
+
+func (this *DirectoryPairRecordStore) SavePairRecord(device frames.Device, record *frames.PairRecord) error {
+	p, err := this.path(device)
+	if err != nil {
+		return err
+	}
+
+	data, err := plist.MarshalIndent(record, plist.XMLFormat, "\t")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(this.Dir, 0700); err != nil {
+		return err
+	}
+
+	/* records hold private keys, never leave a half written one behind */
+	f, err := ioutil.TempFile(this.Dir, ".pairrecord")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+
+	if err := os.Rename(f.Name(), p); err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+
+	return nil
+}
+
+func (this *DirectoryPairRecordStore) DeletePairRecord(device frames.Device) error {
+	p, err := this.path(device)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(p); os.IsNotExist(err) {
+		return ErrPairRecordNotFound
+	} else {
+		return err
+	}
+}
+
+// PairRecordUDIDs lists the records in the directory, usbmuxd's own
+// `SystemConfiguration.plist` left out
+func (this *DirectoryPairRecordStore) PairRecordUDIDs() ([]string, error) {
+	infos, err := ioutil.ReadDir(this.Dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var udids []string
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasSuffix(name, ".plist") || strings.HasPrefix(name, ".") || name == "SystemConfiguration.plist" {
+			continue
+		}
+		udids = append(udids, strings.TrimSuffix(name, ".plist"))
+	}
+	return udids, nil
+}
+
+// MemoryPairRecordStore keeps records in process, handy for tests
+type MemoryPairRecordStore struct {
+	mutex   sync.Mutex
+	records map[string]frames.PairRecord
+}
+
+func NewMemoryPairRecordStore() *MemoryPairRecordStore {
+	return &MemoryPairRecordStore{records: make(map[string]frames.PairRecord)}
+}
+
+func (this *MemoryPairRecordStore) ReadPairRecord(device frames.Device) (*frames.PairRecord, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	record, ok := this.records[device.GetSerialNumber()]
+	if !ok {
+		return nil, ErrPairRecordNotFound
+	}
+	return &record, nil
+}
+
+func (this *MemoryPairRecordStore) SavePairRecord(device frames.Device, record *frames.PairRecord) error {
+	if record == nil {
+		return errors.New("record nil")
+	}
+
+	this.mutex.Lock()
+	this.records[device.GetSerialNumber()] = *record
+	this.mutex.Unlock()
+	return nil
+}
+
+func (this *MemoryPairRecordStore) DeletePairRecord(device frames.Device) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if _, ok := this.records[device.GetSerialNumber()]; !ok {
+		return ErrPairRecordNotFound
+	}
+	delete(this.records, device.GetSerialNumber())
+	return nil
+}
+
+func (this *MemoryPairRecordStore) PairRecordUDIDs() ([]string, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	udids := make([]string, 0, len(this.records))
+	for udid := range this.records {
+		udids = append(udids, udid)
+	}
+	sort.Strings(udids)
+	return udids, nil
+}
@@ -0,0 +1,160 @@
+package tunnel_test
+
+import (
+	"bytes"
+	"iconsole/frames"
+	"iconsole/tunnel"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestUsbmuxdPairRecordStore(t *testing.T) {
+	server, device, done := startMux(t)
+	defer done()
+
+	store := tunnel.UsbmuxdPairRecordStore{}
+
+	if _, err := store.ReadPairRecord(device); err != tunnel.ErrPairRecordNotFound {
+		t.Fatalf("ReadPairRecord without a record = %v, want ErrPairRecordNotFound", err)
+	}
+
+	record := &frames.PairRecord{HostID: "HOST", SystemBUID: "BUID"}
+	if err := store.SavePairRecord(device, record); err != nil {
+		t.Fatal(err)
+	}
+	if saved, err := server.PairRecord(device.SerialNumber); err != nil {
+		t.Fatal(err)
+	} else if saved.HostID != "HOST" {
+		t.Errorf("saved HostID = %q", saved.HostID)
+	}
+
+	got, err := store.ReadPairRecord(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.HostID != "HOST" || got.SystemBUID != "BUID" {
+		t.Errorf("ReadPairRecord = %+v", got)
+	}
+
+	if err := store.DeletePairRecord(device); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.ReadPairRecord(device); err != tunnel.ErrPairRecordNotFound {
+		t.Fatalf("ReadPairRecord after delete = %v, want ErrPairRecordNotFound", err)
+	}
+}
+
+func testRecord() *frames.PairRecord {
+	return &frames.PairRecord{
+		HostID:          "HOST",
+		SystemBUID:      "BUID",
+		RootCertificate: []byte("root certificate"),
+		RootPrivateKey:  []byte("root private key"),
+		EscrowBag:       []byte{1, 2, 3},
+	}
+}
+
+// testStore runs a record of device through store and back
+func testStore(t *testing.T, store tunnel.PairRecordStore, device frames.Device) {
+	t.Helper()
+
+	if _, err := store.ReadPairRecord(device); err != tunnel.ErrPairRecordNotFound {
+		t.Fatalf("ReadPairRecord without a record = %v, want ErrPairRecordNotFound", err)
+	}
+	if err := store.DeletePairRecord(device); err != tunnel.ErrPairRecordNotFound {
+		t.Fatalf("DeletePairRecord without a record = %v, want ErrPairRecordNotFound", err)
+	}
+
+	record := testRecord()
+	if err := store.SavePairRecord(device, record); err != nil {
+		t.Fatal(err)
+	}
+	/* the store keeps its own copy */
+	record.HostID = "CHANGED"
+
+	got, err := store.ReadPairRecord(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := testRecord()
+	if got.HostID != want.HostID || got.SystemBUID != want.SystemBUID || !bytes.Equal(got.RootPrivateKey, want.RootPrivateKey) ||
+		!bytes.Equal(got.EscrowBag, want.EscrowBag) {
+		t.Errorf("ReadPairRecord = %+v, want %+v", got, want)
+	}
+
+	other := &frames.USBDevice{DeviceModel: frames.DeviceModel{ConnectionType: "USB", DeviceID: 2, SerialNumber: "other"}}
+	if _, err := store.ReadPairRecord(other); err != tunnel.ErrPairRecordNotFound {
+		t.Errorf("ReadPairRecord of another device = %v, want ErrPairRecordNotFound", err)
+	}
+
+	if err := store.DeletePairRecord(device); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.ReadPairRecord(device); err != tunnel.ErrPairRecordNotFound {
+		t.Errorf("ReadPairRecord after delete = %v, want ErrPairRecordNotFound", err)
+	}
+}
+
+func TestDirectoryPairRecordStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pairrecords")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	device := &frames.USBDevice{DeviceModel: frames.DeviceModel{ConnectionType: "USB", DeviceID: 1, SerialNumber: "0123456789abcdef"}}
+	/* created on the first save */
+	store := tunnel.NewDirectoryPairRecordStore(filepath.Join(dir, "lockdown"))
+	testStore(t, store, device)
+
+	if err := store.SavePairRecord(device, testRecord()); err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(dir, "lockdown", "0123456789abcdef.plist")
+	if record, err := tunnel.ReadPairRecordFile(p); err != nil || record.HostID != "HOST" {
+		t.Errorf("record file %+v, %v", record, err)
+	}
+	if info, err := os.Stat(p); err != nil {
+		t.Fatal(err)
+	} else if runtime.GOOS != "windows" && info.Mode().Perm() != 0600 {
+		t.Errorf("record file mode %v, want 0600", info.Mode().Perm())
+	}
+	if files, _ := ioutil.ReadDir(filepath.Join(dir, "lockdown")); len(files) != 1 {
+		t.Errorf("%d files in the store, want the record only", len(files))
+	}
+
+	/* usbmuxd keeps its own settings next to the records */
+	if err := ioutil.WriteFile(filepath.Join(dir, "lockdown", "SystemConfiguration.plist"), []byte("<plist/>"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if udids, err := store.PairRecordUDIDs(); err != nil || len(udids) != 1 || udids[0] != "0123456789abcdef" {
+		t.Errorf("PairRecordUDIDs = %v, %v", udids, err)
+	}
+
+	escape := &frames.USBDevice{DeviceModel: frames.DeviceModel{ConnectionType: "USB", DeviceID: 3, SerialNumber: "../escape"}}
+	if err := store.SavePairRecord(escape, testRecord()); err == nil {
+		t.Error("record saved for a UDID with a path in it")
+	}
+}
+
+func TestMemoryPairRecordStore(t *testing.T) {
+	device := &frames.USBDevice{DeviceModel: frames.DeviceModel{ConnectionType: "USB", DeviceID: 1, SerialNumber: "0123456789abcdef"}}
+	store := tunnel.NewMemoryPairRecordStore()
+	testStore(t, store, device)
+
+	if err := store.SavePairRecord(device, nil); err == nil {
+		t.Error("nil record saved")
+	}
+
+	/* records are keyed by UDID, not by how the device is connected */
+	if err := store.SavePairRecord(device, testRecord()); err != nil {
+		t.Fatal(err)
+	}
+	network := frames.NewNetworkDevice("0123456789abcdef", nil)
+	if record, err := store.ReadPairRecord(network); err != nil || record.HostID != "HOST" {
+		t.Errorf("record over the network %+v, %v", record, err)
+	}
+}
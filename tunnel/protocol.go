@@ -0,0 +1,199 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"iconsole/frames"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// LegacyDevicesTimeout is how long `Devices` waits for one more device
+// from a binary usbmuxd, which has no way to list devices but `Listen`
+var LegacyDevicesTimeout = 500 * time.Millisecond
+
+/* set once the daemon answered a plist request with BadVersion */
+var legacyProtocol int32
+
+func isLegacyProtocol() bool {
+	return atomic.LoadInt32(&legacyProtocol) != 0
+}
+
+func setLegacyProtocol(legacy bool) {
+	var v int32
+	if legacy {
+		v = 1
+	}
+	atomic.StoreInt32(&legacyProtocol, v)
+}
+
+// SendBinary sends a message of the binary protocol, the body is raw
+func (this *PlistConnection) SendBinary(message uint32, body []byte, tag uint32) error {
+	if this.RawConn == nil {
+		return ErrNoConnection
+	}
+
+	pkg := &frames.Package{
+		Version: frames.BinaryVersion,
+		Type:    message,
+		Tag:     tag,
+	}
+
+	if err := this.RawConn.SetWriteDeadline(this.deadline()); err != nil {
+		return err
+	}
+
+	return writeFrame(this.RawConn, func(buf *bytes.Buffer) error {
+		pkg.PackBinaryTo(buf, body)
+		this.trace.tracePlist(TraceSend, pkg.Tag, body)
+		return nil
+	})
+}
+
+// decodePackage turns a reply or notification of either protocol into its frames type
+func decodePackage(pkg *frames.Package) (frames.Response, error) {
+	if !pkg.IsBinary() {
+		var m map[string]interface{}
+		if err := pkg.UnmarshalBody(&m); err != nil {
+			return nil, err
+		}
+		return decodeMessage(m)
+	}
+
+	switch pkg.Type {
+	case frames.BinaryResult:
+		number, err := frames.UnpackBinaryResult(pkg.Body)
+		if err != nil {
+			return nil, err
+		}
+		return &frames.Result{
+			BaseResponse: frames.BaseResponse{MessageType: "Result"},
+			Number:       number,
+		}, nil
+	case frames.BinaryDeviceAdd:
+		device, err := frames.UnpackBinaryDevice(pkg.Body)
+		if err != nil {
+			return nil, err
+		}
+		return &frames.DeviceAttached{
+			BaseResponse: frames.BaseResponse{MessageType: "Attached"},
+			DeviceID:     device.DeviceID,
+			Properties:   device,
+		}, nil
+	case frames.BinaryDeviceRemove:
+		deviceId, err := frames.UnpackBinaryDeviceRemove(pkg.Body)
+		if err != nil {
+			return nil, err
+		}
+		return &frames.DeviceDetached{
+			BaseResponse: frames.BaseResponse{MessageType: "Detached"},
+			DeviceID:     deviceId,
+		}, nil
+	}
+
+	return nil, &PropertyError{Key: "MessageType", Value: pkg.Type}
+}
+
+// packageResult returns the error of a result reply of either protocol
+func packageResult(pkg *frames.Package, device string) error {
+	msg, err := decodePackage(pkg)
+	if err != nil {
+		return err
+	}
+	result, ok := msg.(*frames.Result)
+	if !ok {
+		return usbmuxdError(ResultUnknown, device)
+	}
+	return usbmuxdError(uint64(result.Number), device)
+}
+
+// dialRequest opens a usbmuxd connection for a request answered by a
+// result, `Listen` or `Connect`, the connection is handed over on
+// success. The plist frame is tried first, a daemon answering BadVersion
+// gets the binary message on a new connection, as libusbmuxd does.
+func dialRequest(ctx context.Context, device string, frame interface{}, message uint32, body []byte) (*PlistConnection, error) {
+	for {
+		legacy := isLegacyProtocol()
+
+		conn := NewPlistConnection()
+		conn.trace.device = device
+
+		if err := conn.DialContext(ctx); err != nil {
+			return nil, err
+		}
+
+		err := withContext(ctx, conn.RawConn, func() error {
+			var err error
+			if legacy {
+				err = conn.SendBinary(message, body, 0)
+			} else {
+				err = conn.Send(frame)
+			}
+			if err != nil {
+				return err
+			}
+
+			pkg, err := conn.Sync()
+			if err != nil {
+				return err
+			}
+
+			return packageResult(pkg, device)
+		})
+
+		if err == nil {
+			return conn, nil
+		}
+
+		conn.Close()
+
+		if !errors.Is(err, ErrBadVersion) || legacy {
+			debugf(UsbmuxdServiceName, "request failed: %s", err)
+			return nil, err
+		}
+		Logf(LogInfo, UsbmuxdServiceName, "daemon answered BadVersion, switching to the binary protocol")
+		setLegacyProtocol(true)
+	}
+}
+
+// listenDevices collects the devices a binary usbmuxd reports right after `Listen`
+func listenDevices() ([]frames.Device, error) {
+	frame := frames.CreateBaseRequest(frames.Listen)
+	conn, err := dialRequest(context.Background(), "", frame, frames.BinaryListen, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	/* the initial device list has no end marker, stop once the daemon is quiet */
+	conn.Timeout = LegacyDevicesTimeout
+
+	var devices []frames.Device
+	for {
+		pkg, err := conn.Sync()
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			return devices, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		msg, err := decodePackage(pkg)
+		if err != nil {
+			continue
+		}
+
+		switch v := msg.(type) {
+		case *frames.DeviceAttached:
+			devices = append(devices, v.Properties)
+		case *frames.DeviceDetached:
+			for i, d := range devices {
+				if d.GetDeviceID() == v.DeviceID {
+					devices = append(devices[:i], devices[i+1:]...)
+					break
+				}
+			}
+		}
+	}
+}
@@ -2,39 +2,106 @@ package tunnel
 
 import (
 	"bytes"
-	"encoding/binary"
+	"context"
+	"errors"
 	"iconsole/frames"
 	"net"
+	"sync"
+	"sync/atomic"
 
 	"howett.net/plist"
 )
 
+var (
+	ErrServiceClosed = errors.New("service closed")
+)
+
+// Service is safe for concurrent use. `Send` and `Sync` move whole
+// frames, `Request` keeps a request and its reply together, and `Close`
+// may be called any time, failing pending calls with `ErrServiceClosed`.
+// Raw traffic through `GetConnection` must be serialized by the caller.
 type Service struct {
 	conn *MixConnection
+	// largest plist `Sync` accepts, `frames.MaxServicePackageSize` when zero
+	MaxMessageSize uint32
+	trace          traceInfo
+
+	writeMutex sync.Mutex
+	/* held across a whole `Request`, so no other reader takes its reply */
+	readMutex sync.Mutex
+	closeOnce sync.Once
+	closed    int32
+}
+
+// NewService wraps a service connection, device and name label its trace
+func NewService(c *MixConnection, device frames.Device, name string) *Service {
+	udid := ""
+	if device != nil {
+		udid = device.GetSerialNumber()
+	}
+	return &Service{conn: c, trace: newTraceInfo(udid, name)}
+}
+
+// Name is the service name it was started with
+func (this *Service) Name() string {
+	return this.trace.service
+}
+
+// UDID is the serial number of the device the service runs on
+func (this *Service) UDID() string {
+	return this.trace.device
+}
+
+// SetTracer records the traffic of this service to tracer, nil stops
+func (this *Service) SetTracer(tracer Tracer) {
+	this.trace.tracer = tracer
+	if tracer != nil && this.trace.id == 0 {
+		this.trace.id = nextTraceConnId()
+	}
 }
 
 func (this *Service) DismissSSL() error {
 	return this.conn.DismissSSL()
 }
 
+// DismissSSLBypass drops TLS without shutting it down
+func (this *Service) DismissSSLBypass() error {
+	return this.conn.DismissSSLBypass()
+}
+
+// GetConnection is the raw connection, traffic through it is not traced,
+// callers report their frames with `TraceFrame`
 func (this *Service) GetConnection() net.Conn {
 	return this.conn
 }
 
+// TraceFrame records one binary frame sent or received on the raw
+// connection, parts are joined into a single record
+func (this *Service) TraceFrame(direction string, parts ...[]byte) {
+	this.trace.traceFrame(direction, parts...)
+}
+
 func (this *Service) Send(frame interface{}, format int) error {
 	if this.conn == nil {
 		return ErrNoConnection
+	} else if this.Closed() {
+		return ErrServiceClosed
 	}
 
 	pkg := &frames.ServicePackage{}
 
-	packageBuf, err := pkg.Pack(frame, format)
-	if err != nil {
-		return err
-	}
+	this.writeMutex.Lock()
+	defer this.writeMutex.Unlock()
 
-	_, err = this.conn.Write(packageBuf)
-	return err
+	err := writeFrame(this.conn, func(buf *bytes.Buffer) error {
+		if err := pkg.PackTo(buf, frame, format); err != nil {
+			return err
+		}
+		this.trace.tracePlist(TraceSend, 0, buf.Bytes()[frames.ServicePackageHeaderSize:])
+		debugf(this.component(), "send %d bytes", buf.Len()-frames.ServicePackageHeaderSize)
+		return nil
+	})
+	return this.closedError(err)
 }
 
 func (this *Service) SendXML(frame interface{}) error {
@@ -45,46 +112,96 @@ func (this *Service) SendBinary(frame interface{}) error {
 	return this.Send(frame, plist.BinaryFormat)
 }
 
-func (this *Service) Sync() (*frames.ServicePackage, error) {
+// WithContext runs fn until ctx is done. Ending ctx, by cancel or
+// deadline, closes the service for every caller, pending calls fail with
+// `ErrServiceClosed` and fn returns the ctx error.
+func (this *Service) WithContext(ctx context.Context, fn func() error) error {
 	if this.conn == nil {
-		return nil, ErrNoConnection
+		return ErrNoConnection
 	}
+	return withContext(ctx, this, fn)
+}
 
-	buf := bytes.NewBuffer([]byte{})
+// SyncContext is `Sync` that gives up when ctx is done
+func (this *Service) SyncContext(ctx context.Context) (pkg *frames.ServicePackage, err error) {
+	err = this.WithContext(ctx, func() error {
+		pkg, err = this.Sync()
+		return err
+	})
+	return
+}
 
-	var err error
-	var n int
-	var pkg *frames.ServicePackage
+func (this *Service) Sync() (*frames.ServicePackage, error) {
+	this.readMutex.Lock()
+	defer this.readMutex.Unlock()
+	return this.sync()
+}
 
-	offset := 0
-	pkgLen := 0
+// Request sends frame and reads its reply, no other reply gets in between
+func (this *Service) Request(frame interface{}, format int) (*frames.ServicePackage, error) {
+	this.readMutex.Lock()
+	defer this.readMutex.Unlock()
 
-	pkgBuf := make([]byte, 0x4)
-	for {
-		n, err = this.conn.Read(pkgBuf)
+	if err := this.Send(frame, format); err != nil {
+		return nil, err
+	}
+	return this.sync()
+}
 
-		if err != nil && n == 0 {
-			return nil, err
-		}
+func (this *Service) RequestXML(frame interface{}) (*frames.ServicePackage, error) {
+	return this.Request(frame, plist.XMLFormat)
+}
 
-		buf.Write(pkgBuf[:n])
+func (this *Service) sync() (*frames.ServicePackage, error) {
+	if this.conn == nil {
+		return nil, ErrNoConnection
+	} else if this.Closed() {
+		return nil, ErrServiceClosed
+	}
 
-		offset += n
+	pkg, err := readServicePackage(this.conn, this.MaxMessageSize)
+	if err != nil {
+		debugf(this.component(), "recv: %s", err)
+		return nil, this.closedError(err)
+	}
+	debugf(this.component(), "recv %d bytes", len(pkg.Body))
 
-		if pkgLen == 0 {
-			pkgLen = int(binary.BigEndian.Uint32(pkgBuf[:4])) + 4
-			pkgBuf = make([]byte, pkgLen-4)
-		}
+	this.trace.tracePlist(TraceRecv, 0, pkg.Body)
+	return pkg, nil
+}
 
-		if offset >= pkgLen {
-			break
-		}
+// Close closes the connection once, later calls return nil
+func (this *Service) Close() error {
+	if this.conn == nil {
+		return ErrNoConnection
 	}
 
-	pkg, err = frames.UnpackLockdown(buf.Bytes())
-	if err != nil {
-		return nil, err
+	var err error
+	this.closeOnce.Do(func() {
+		atomic.StoreInt32(&this.closed, 1)
+		/* the raw socket, TLS state may still be in use by a pending call */
+		err = this.conn.conn.Close()
+	})
+	return err
+}
+
+// component labels the log messages of this service
+func (this *Service) component() string {
+	if this.trace.service == "" {
+		return "service"
 	}
+	return this.trace.service
+}
 
-	return pkg, nil
+// Closed reports whether `Close` was called
+func (this *Service) Closed() bool {
+	return atomic.LoadInt32(&this.closed) != 0
+}
+
+// closedError reports errors of a call cut off by `Close` as `ErrServiceClosed`
+func (this *Service) closedError(err error) error {
+	if err != nil && this.Closed() {
+		return ErrServiceClosed
+	}
+	return err
 }
@@ -0,0 +1,107 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SocketAddressEnv = "USBMUXD_SOCKET_ADDRESS"
+)
+
+var (
+	socketMutex   sync.RWMutex
+	socketNetwork = defaultSocketNetwork
+	socketAddress = defaultSocketAddress
+	socketErr     error
+)
+
+func init() {
+	if s := os.Getenv(SocketAddressEnv); s != "" {
+		if err := SetSocketAddress(s); err != nil {
+			socketErr = fmt.Errorf("%s: %s", SocketAddressEnv, err)
+		}
+	}
+}
+
+// ParseSocketAddress accepts the `USBMUXD_SOCKET_ADDRESS` forms
+// `UNIX:/path/to/socket` and `host:port`
+func ParseSocketAddress(s string) (network string, address string, err error) {
+	if len(s) > 5 && strings.EqualFold(s[:5], "UNIX:") {
+		return "unix", s[5:], nil
+	}
+
+	if strings.HasPrefix(s, "/") {
+		return "unix", s, nil
+	}
+
+	if _, _, err := net.SplitHostPort(s); err != nil {
+		return "", "", errors.New("usbmuxd address must be `UNIX:/path` or `host:port`")
+	}
+
+	return "tcp", s, nil
+}
+
+// SetSocketAddress points every following usbmuxd dial at `s`
+func SetSocketAddress(s string) error {
+	network, address, err := ParseSocketAddress(s)
+	if err != nil {
+		return err
+	}
+
+	socketMutex.Lock()
+	socketNetwork = network
+	socketAddress = address
+	socketErr = nil
+	socketMutex.Unlock()
+
+	/* the control connection and protocol belong to the old daemon */
+	setLegacyProtocol(false)
+	_ = DefaultMuxClient.Close()
+
+	return nil
+}
+
+// SocketAddress returns the current usbmuxd endpoint in `USBMUXD_SOCKET_ADDRESS` form
+func SocketAddress() string {
+	socketMutex.RLock()
+	defer socketMutex.RUnlock()
+
+	if socketNetwork == "unix" {
+		return "UNIX:" + socketAddress
+	}
+	return socketAddress
+}
+
+func RawDial(timeout time.Duration) (net.Conn, error) {
+	return RawDialContext(context.Background(), timeout)
+}
+
+// RawDialContext dials usbmuxd, giving up when ctx is done
+func RawDialContext(ctx context.Context, timeout time.Duration) (net.Conn, error) {
+	socketMutex.RLock()
+	network, address, err := socketNetwork, socketAddress, socketErr
+	socketMutex.RUnlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := net.Dialer{
+		Timeout: timeout,
+	}
+
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		debugf(UsbmuxdServiceName, "dial %s %s: %s", network, address, err)
+		return nil, err
+	}
+	debugf(UsbmuxdServiceName, "dialed %s %s", network, address)
+	return conn, nil
+}
@@ -0,0 +1,166 @@
+package tunnel
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"howett.net/plist"
+)
+
+const (
+	TraceSend = "send"
+	TraceRecv = "recv"
+
+	UsbmuxdServiceName  = "usbmuxd"
+	LockdownServiceName = "com.apple.mobile.lockdown"
+)
+
+// TraceRecord is one frame on the wire, `Plist` holds the body as XML
+// for plist traffic and `Hex` the bytes of a binary frame, a whole AFC
+// packet or DTX message fragment with its header
+type TraceRecord struct {
+	Conn      uint64    `json:"conn"`
+	Direction string    `json:"dir"`
+	Time      time.Time `json:"time"`
+	Device    string    `json:"device,omitempty"`
+	Service   string    `json:"service,omitempty"`
+	Tag       uint32    `json:"tag,omitempty"`
+	Plist     string    `json:"plist,omitempty"`
+	Hex       string    `json:"hex,omitempty"`
+}
+
+// Tracer receives every frame of the connections it is set on
+type Tracer interface {
+	Trace(record *TraceRecord)
+}
+
+// DefaultTracer is picked up by connections opened afterwards, nil disables tracing
+var DefaultTracer Tracer
+
+// JSONTracer writes one record per line
+type JSONTracer struct {
+	mutex   sync.Mutex
+	encoder *json.Encoder
+}
+
+func NewJSONTracer(w io.Writer) *JSONTracer {
+	encoder := json.NewEncoder(w)
+	/* keep the XML bodies readable */
+	encoder.SetEscapeHTML(false)
+	return &JSONTracer{encoder: encoder}
+}
+
+func (this *JSONTracer) Trace(record *TraceRecord) {
+	this.mutex.Lock()
+	_ = this.encoder.Encode(record)
+	this.mutex.Unlock()
+}
+
+var (
+	traceConnId uint64
+
+	/* never write private keys or escrow bags to a trace */
+	redactedKeys = map[string]bool{
+		"HostPrivateKey": true,
+		"RootPrivateKey": true,
+		"PairRecordData": true,
+		"EscrowBag":      true,
+	}
+)
+
+func nextTraceConnId() uint64 {
+	return atomic.AddUint64(&traceConnId, 1)
+}
+
+func redact(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for k, item := range value {
+			if redactedKeys[k] {
+				value[k] = "<redacted>"
+			} else {
+				value[k] = redact(item)
+			}
+		}
+	case []interface{}:
+		for i, item := range value {
+			value[i] = redact(item)
+		}
+	}
+	return v
+}
+
+// TracePlist converts a plist body of any format into the redacted XML
+// of a trace record, the same body always gives the same text
+func TracePlist(body []byte) string {
+	var v interface{}
+	if _, err := plist.Unmarshal(body, &v); err != nil {
+		return ""
+	}
+	data, err := plist.MarshalIndent(redact(v), plist.XMLFormat, "\t")
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// traceInfo is what a traced connection knows about itself
+type traceInfo struct {
+	tracer  Tracer
+	id      uint64
+	device  string
+	service string
+}
+
+func newTraceInfo(device, service string) traceInfo {
+	info := traceInfo{tracer: DefaultTracer, device: device, service: service}
+	if info.tracer != nil {
+		info.id = nextTraceConnId()
+	}
+	return info
+}
+
+func (this *traceInfo) record(direction string) *TraceRecord {
+	return &TraceRecord{
+		Conn:      this.id,
+		Direction: direction,
+		Time:      time.Now(),
+		Device:    this.device,
+		Service:   this.service,
+	}
+}
+
+func (this *traceInfo) tracePlist(direction string, tag uint32, body []byte) {
+	if this.tracer == nil {
+		return
+	}
+	record := this.record(direction)
+	record.Tag = tag
+	record.Plist = TracePlist(body)
+	if record.Plist == "" {
+		record.Hex = hex.EncodeToString(body)
+	}
+	this.tracer.Trace(record)
+}
+
+// traceFrame records the parts of one binary frame as a single record
+func (this *traceInfo) traceFrame(direction string, parts ...[]byte) {
+	if this.tracer == nil {
+		return
+	}
+	var text strings.Builder
+	for _, b := range parts {
+		text.WriteString(hex.EncodeToString(b))
+	}
+	if text.Len() == 0 {
+		return
+	}
+	record := this.record(direction)
+	record.Hex = text.String()
+	this.tracer.Trace(record)
+}
@@ -0,0 +1,128 @@
+package tunnel_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"iconsole/tunnel"
+	"iconsole/tunnel/muxtest"
+	"strings"
+	"testing"
+
+	"howett.net/plist"
+)
+
+var secretKeys = []string{"HostPrivateKey", "RootPrivateKey", "PairRecordData", "EscrowBag"}
+
+// traceValues collects the values of the secret keys anywhere in v
+func traceValues(v interface{}, found map[string][]interface{}) {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for k, item := range value {
+			for _, key := range secretKeys {
+				if k == key {
+					found[k] = append(found[k], item)
+				}
+			}
+			traceValues(item, found)
+		}
+	case []interface{}:
+		for _, item := range value {
+			traceValues(item, found)
+		}
+	}
+}
+
+func TestTraceRedactsPairRecord(t *testing.T) {
+	var buf bytes.Buffer
+	tunnel.DefaultTracer = tunnel.NewJSONTracer(&buf)
+	defer func() { tunnel.DefaultTracer = nil }()
+
+	server, usb, done := startMux(t)
+	defer done()
+	lockdown := muxtest.NewLockdown()
+	if err := server.Handle(usb.DeviceID, tunnel.LockdownPort, lockdown.Serve); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := tunnel.LockdownDial(usb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	/* the escrow bag comes back from the device, the keys go to usbmuxd
+	   inside the record data and back */
+	record, err := conn.Pair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tunnel.SavePairRecord(usb, record); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tunnel.ReadPairRecord(usb); err != nil {
+		t.Fatal(err)
+	}
+
+	trace := buf.String()
+	found := make(map[string][]interface{})
+	scanner := bufio.NewScanner(strings.NewReader(trace))
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var r tunnel.TraceRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		if r.Plist == "" {
+			continue
+		}
+		var v interface{}
+		if _, err := plist.Unmarshal([]byte(r.Plist), &v); err != nil {
+			t.Fatalf("record %s: %v", r.Plist, err)
+		}
+		traceValues(v, found)
+	}
+
+	/* the keys only travel inside the record data */
+	for _, key := range secretKeys {
+		if len(found[key]) == 0 && (key == "PairRecordData" || key == "EscrowBag") {
+			t.Errorf("%s never traced", key)
+		}
+		for _, value := range found[key] {
+			if value != "<redacted>" {
+				t.Errorf("%s traced unredacted, %T", key, value)
+			}
+		}
+	}
+
+	/* neither in any other shape, a line of the base64 the plist would hold */
+	for name, secret := range map[string][]byte{
+		"host key": record.HostPrivateKey,
+		"root key": record.RootPrivateKey,
+	} {
+		if encoded := base64.StdEncoding.EncodeToString(secret); strings.Contains(trace, encoded[40:72]) {
+			t.Errorf("%s in the trace", name)
+		}
+	}
+	if strings.Contains(trace, "ZXNjcm93IGJhZw") {
+		t.Error("escrow bag in the trace")
+	}
+
+	/* a record traced on its own */
+	body, err := plist.Marshal(record, plist.BinaryFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found = make(map[string][]interface{})
+	var v interface{}
+	if _, err := plist.Unmarshal([]byte(tunnel.TracePlist(body)), &v); err != nil {
+		t.Fatal(err)
+	}
+	traceValues(v, found)
+	for _, key := range []string{"HostPrivateKey", "RootPrivateKey", "EscrowBag"} {
+		if len(found[key]) != 1 || found[key][0] != "<redacted>" {
+			t.Errorf("%s of the record traced as %v", key, found[key])
+		}
+	}
+}
@@ -1,19 +1,19 @@
 package tunnel
 
 import (
+	"bytes"
 	"context"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"iconsole/frames"
 	"net"
 	"time"
-
-	"howett.net/plist"
 )
 
 var (
 	ErrNoConnection = errors.New("not connection")
+
+	errUnknownConnectionType = errors.New("unknown connection type")
 )
 
 const (
@@ -27,34 +27,29 @@ const (
 	ResultUnknown    = 100
 )
 
-func getError(num uint64) error {
-	switch num {
-	case ResultOk:
-		return nil
-	case ResultBadCommand:
-		return errors.New("BadCommand")
-	case ResultBadDev:
-		return errors.New("BadDev")
-	case ResultCommRefused:
-		return errors.New("CommRefused")
-	case ResultBadVersion:
-		return errors.New("BadVersion")
-	default:
-		return fmt.Errorf("ErrorCode %d", num)
-	}
-}
-
 type PlistConnection struct {
 	RawConn net.Conn
 	version uint32
 	Timeout time.Duration
+	trace   traceInfo
 }
 
+/* socket deadline of a new connection, shortened by tests */
+var plistTimeout = 30 * time.Second
+
 func NewPlistConnection() *PlistConnection {
-	/* socket deadline 30 seconds */
 	return &PlistConnection{
 		version: 1,
-		Timeout: 30 * time.Second,
+		Timeout: plistTimeout,
+		trace:   newTraceInfo("", UsbmuxdServiceName),
+	}
+}
+
+// SetTracer records the frames of this connection to tracer, nil stops
+func (this *PlistConnection) SetTracer(tracer Tracer) {
+	this.trace.tracer = tracer
+	if tracer != nil && this.trace.id == 0 {
+		this.trace.id = nextTraceConnId()
 	}
 }
 
@@ -65,427 +60,275 @@ func (this *PlistConnection) Close() {
 	}
 }
 
-func (this *PlistConnection) Sync() (*frames.Package, error) {
-	var err error
-	var n int
-	var pkg *frames.Package
-
-	var pkgLen uint32
-	if err = binary.Read(this.RawConn, binary.LittleEndian, &pkgLen); err != nil {
-		return nil, err
+// deadline for the next request, none when `Timeout` is zero
+func (this *PlistConnection) deadline() time.Time {
+	if this.Timeout <= 0 {
+		return time.Time{}
 	}
+	return time.Now().Add(this.Timeout)
+}
 
-	pkgBuf := make([]byte, pkgLen)
-	binary.LittleEndian.PutUint32(pkgBuf, pkgLen)
-
-	offset := 4
-
-	if err := this.RawConn.SetDeadline(time.Now().Add(this.Timeout)); err != nil {
-		return nil, err
+func (this *PlistConnection) Sync() (*frames.Package, error) {
+	if this.RawConn == nil {
+		return nil, ErrNoConnection
 	}
 
-	for {
-		n, err = this.RawConn.Read(pkgBuf[offset:])
-		if err != nil {
-			return nil, err
-		}
-		if offset+n >= len(pkgBuf) {
-			break
-		}
-		offset += n
+	if err := this.RawConn.SetReadDeadline(this.deadline()); err != nil {
+		return nil, err
 	}
 
-	pkg, err = frames.Unpack(pkgBuf)
+	pkg, err := readPackage(this.RawConn)
 	if err != nil {
 		return nil, err
 	}
 
+	this.trace.tracePlist(TraceRecv, pkg.Tag, pkg.Body)
 	return pkg, nil
 }
 
 func (this *PlistConnection) Dial() error {
-	if conn, err := RawDial(this.Timeout); err != nil {
+	return this.DialContext(context.Background())
+}
+
+func (this *PlistConnection) DialContext(ctx context.Context) error {
+	if conn, err := RawDialContext(ctx, this.Timeout); err != nil {
 		return err
 	} else {
-		this.RawConn = conn
+		this.RawConn = newBufferedConn(conn)
 	}
 	return nil
 }
 
 func (this *PlistConnection) Send(frame interface{}) error {
+	return this.SendTag(frame, 0)
+}
+
+// SendTag sends frame with a tag, usbmuxd answers with the same tag
+func (this *PlistConnection) SendTag(frame interface{}, tag uint32) error {
 	if this.RawConn == nil {
 		return ErrNoConnection
 	}
 
 	pkg := &frames.Package{
 		Version: this.version,
-		Type:    8,
-		Tag:     0,
-	}
-
-	packageBuf, err := pkg.Pack(frame)
-	if err != nil {
-		return err
-	}
-
-	if err := this.RawConn.SetDeadline(time.Now().Add(this.Timeout)); err != nil {
-		return err
+		Type:    frames.PlistMessage,
+		Tag:     tag,
 	}
 
-	if _, err := this.RawConn.Write(packageBuf); err != nil {
+	if err := this.RawConn.SetWriteDeadline(this.deadline()); err != nil {
 		return err
 	}
 
-	return nil
+	return writeFrame(this.RawConn, func(buf *bytes.Buffer) error {
+		if err := pkg.PackTo(buf, frame); err != nil {
+			return err
+		}
+		this.trace.tracePlist(TraceSend, pkg.Tag, buf.Bytes()[frames.PackageHeaderSize:])
+		return nil
+	})
 }
 
-func analyzeDevice(properties map[string]interface{}) (frames.Device, error) {
-	ct := properties["ConnectionType"].(string)
-
-	var device frames.Device
-
-	model := frames.DeviceModel{
-		ConnectionType: ct,
-		DeviceID:       int(properties["DeviceID"].(uint64)),
-		SerialNumber:   properties["SerialNumber"].(string),
-	}
-
-	serialNumber := ""
-	if sn, ok := properties["USBSerialNumber"].(string); ok {
-		serialNumber = sn
-	} else if sn, ok := properties["SerialNumber"].(string); ok {
-		serialNumber = sn
-	}
+// PropertyError reports a usbmuxd or lockdown property that is missing or of an
+// unexpected type, `Value` is nil when missing
+type PropertyError struct {
+	Key   string
+	Value interface{}
+}
 
-	udid := ""
-	if u, ok := properties["UDID"].(string); ok {
-		udid = u
+func (this *PropertyError) Error() string {
+	if this.Value == nil {
+		return fmt.Sprintf("property `%s` missing", this.Key)
 	}
+	return fmt.Sprintf("property `%s` unexpected type %T", this.Key, this.Value)
+}
 
-	switch ct {
-	case "USB":
-		device = &frames.USBDevice{
-			DeviceModel:     model,
-			ConnectionSpeed: int(properties["ConnectionSpeed"].(uint64)),
-			LocationID:      int(properties["LocationID"].(uint64)),
-			ProductID:       int(properties["ProductID"].(uint64)),
-			UDID:            udid,
-			USBSerialNumber: serialNumber,
-		}
-	case "Network":
-		device = &frames.NetworkDevice{
-			DeviceModel:            model,
-			EscapedFullServiceName: properties["EscapedFullServiceName"].(string),
-			InterfaceIndex:         int(properties["InterfaceIndex"].(uint64)),
-			NetworkAddress:         properties["NetworkAddress"].([]uint8),
+func propertyInt(properties map[string]interface{}, key string, required bool) (int, error) {
+	switch v := properties[key].(type) {
+	case uint64:
+		return int(v), nil
+	case int64:
+		return int(v), nil
+	case nil:
+		if !required {
+			return 0, nil
 		}
+		return 0, &PropertyError{Key: key}
+	default:
+		return 0, &PropertyError{Key: key, Value: v}
 	}
+}
 
-	return device, nil
+func propertyString(properties map[string]interface{}, key string) (string, error) {
+	switch v := properties[key].(type) {
+	case string:
+		return v, nil
+	case nil:
+		return "", nil
+	default:
+		return "", &PropertyError{Key: key, Value: v}
+	}
 }
 
-// just for once call
-func Devices() ([]frames.Device, error) {
-	conn := NewPlistConnection()
-	if err := conn.Dial(); err != nil {
+func analyzeDevice(properties map[string]interface{}) (frames.Device, error) {
+	ct, err := propertyString(properties, "ConnectionType")
+	if err != nil {
 		return nil, err
 	}
-	defer conn.Close()
-
-	frame := frames.CreateBaseRequest(frames.ListDevices)
 
-	if err := conn.Send(frame); err != nil {
+	deviceId, err := propertyInt(properties, "DeviceID", true)
+	if err != nil {
 		return nil, err
 	}
 
-	var devices []frames.Device
-	var m map[string]interface{}
-
-	respPkg, err := conn.Sync()
+	sn, err := propertyString(properties, "SerialNumber")
 	if err != nil {
 		return nil, err
 	}
-	if err := respPkg.UnmarshalBody(&m); err != nil {
-		return nil, err
+
+	model := frames.DeviceModel{
+		ConnectionType: ct,
+		DeviceID:       deviceId,
+		SerialNumber:   sn,
 	}
 
-	deviceList, ok := m["DeviceList"].([]interface{})
-	if ok {
-		for _, v := range deviceList {
-			item := v.(map[string]interface{})
-			properties := item["Properties"].(map[string]interface{})
-			device, err := analyzeDevice(properties)
-			if err != nil {
-				return nil, err
-			}
-			devices = append(devices, device)
+	switch ct {
+	case "USB":
+		device := &frames.USBDevice{DeviceModel: model}
+		if device.ConnectionSpeed, err = propertyInt(properties, "ConnectionSpeed", false); err != nil {
+			return nil, err
+		} else if device.LocationID, err = propertyInt(properties, "LocationID", false); err != nil {
+			return nil, err
+		} else if device.ProductID, err = propertyInt(properties, "ProductID", false); err != nil {
+			return nil, err
+		} else if device.UDID, err = propertyString(properties, "UDID"); err != nil {
+			return nil, err
+		} else if device.USBSerialNumber, err = propertyString(properties, "USBSerialNumber"); err != nil {
+			return nil, err
 		}
-	} else if n, ok := m["Number"].(uint64); ok {
-		return nil, getError(n)
-	} else {
-		return nil, getError(ResultUnknown)
+		if device.USBSerialNumber == "" {
+			device.USBSerialNumber = sn
+		}
+		return device, nil
+	case "Network":
+		device := &frames.NetworkDevice{DeviceModel: model}
+		if device.EscapedFullServiceName, err = propertyString(properties, "EscapedFullServiceName"); err != nil {
+			return nil, err
+		} else if device.InterfaceIndex, err = propertyInt(properties, "InterfaceIndex", false); err != nil {
+			return nil, err
+		}
+		switch v := properties["NetworkAddress"].(type) {
+		case []byte:
+			device.NetworkAddress = v
+		case nil:
+		default:
+			return nil, &PropertyError{Key: "NetworkAddress", Value: v}
+		}
+		return device, nil
 	}
 
-	return devices, nil
+	return nil, errUnknownConnectionType
 }
 
-func ReadBUID() (string, error) {
-	conn := NewPlistConnection()
-	if err := conn.Dial(); err != nil {
-		return "", err
-	}
-	defer conn.Close()
-
-	frame := frames.CreateBaseRequest("ReadBUID")
-
-	if err := conn.Send(frame); err != nil {
-		return "", err
-	}
-
-	pkg, err := conn.Sync()
-	if err != nil {
-		return "", err
+// decodeMessage turns a usbmuxd notification into its frames type
+func decodeMessage(m map[string]interface{}) (frames.Response, error) {
+	mt, _ := m["MessageType"].(string)
+	switch mt {
+	case "Attached":
+		deviceId, err := propertyInt(m, "DeviceID", true)
+		if err != nil {
+			return nil, err
+		}
+		properties, ok := m["Properties"].(map[string]interface{})
+		if !ok {
+			return nil, &PropertyError{Key: "Properties", Value: m["Properties"]}
+		}
+		device, err := analyzeDevice(properties)
+		if err != nil {
+			return nil, err
+		}
+		return &frames.DeviceAttached{
+			BaseResponse: frames.BaseResponse{MessageType: mt},
+			DeviceID:     deviceId,
+			Properties:   device,
+		}, nil
+	case "Detached":
+		deviceId, err := propertyInt(m, "DeviceID", true)
+		if err != nil {
+			return nil, err
+		}
+		return &frames.DeviceDetached{
+			BaseResponse: frames.BaseResponse{MessageType: mt},
+			DeviceID:     deviceId,
+		}, nil
+	case "Paired":
+		deviceId, err := propertyInt(m, "DeviceID", true)
+		if err != nil {
+			return nil, err
+		}
+		return &frames.DevicePaired{
+			BaseResponse: frames.BaseResponse{MessageType: mt},
+			DeviceID:     deviceId,
+		}, nil
+	case "Result":
+		number, err := propertyInt(m, "Number", true)
+		if err != nil {
+			return nil, err
+		}
+		return &frames.Result{
+			BaseResponse: frames.BaseResponse{MessageType: mt},
+			Number:       number,
+		}, nil
 	}
 
-	var m map[string]interface{}
-	if err := pkg.UnmarshalBody(&m); err != nil {
-		return "", err
-	}
+	return nil, fmt.Errorf("unknown message type `%s`", mt)
+}
 
-	if buid, ok := m["BUID"].(string); ok {
-		return buid, nil
-	} else if n, ok := m["Number"].(uint64); ok {
-		return "", getError(n)
-	}
+// Devices lists the attached devices through `DefaultMuxClient`
+func Devices() ([]frames.Device, error) {
+	return DefaultMuxClient.Devices()
+}
 
-	return "", getError(ResultUnknown)
+// ReadBUID returns the host BUID, asked once per `DefaultMuxClient` connection
+func ReadBUID() (string, error) {
+	return DefaultMuxClient.ReadBUID()
 }
 
+// Listen subscribes to the notifications of `DefaultMuxClient`
 func Listen(msgNotifyer chan frames.Response) (context.CancelFunc, error) {
-	conn := NewPlistConnection()
-	if err := conn.Dial(); err != nil {
-		return nil, err
-	}
-
-	frame := frames.CreateBaseRequest(frames.Listen)
-	frame.LibUSBMuxVersion = frames.LibUSBMuxVersion
-
-	if err := conn.Send(frame); err != nil {
-		return nil, err
-	}
-
-	ctx, cancelFunc := context.WithCancel(context.Background())
-
-	go func() {
-		defer conn.Close()
-		defer close(msgNotifyer)
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			default:
-				pkg, err := conn.Sync()
-				if err != nil {
-					return
-				}
-
-				var m map[string]interface{}
-				if err := pkg.UnmarshalBody(&m); err != nil {
-					return
-				}
-
-				if mt, ok := m["MessageType"].(string); ok {
-					switch mt {
-					case "Attached":
-						device, err := analyzeDevice(m["Properties"].(map[string]interface{}))
-						if err != nil {
-							return
-						}
-						msgNotifyer <- &frames.DeviceAttached{
-							BaseResponse: frames.BaseResponse{MessageType: mt},
-							DeviceID:     int(m["DeviceID"].(uint64)),
-							Properties:   device,
-						}
-					case "Detached":
-						msgNotifyer <- &frames.DeviceDetached{
-							BaseResponse: frames.BaseResponse{MessageType: mt},
-							DeviceID:     int(m["DeviceID"].(uint64)),
-						}
-					case "Result":
-						msgNotifyer <- &frames.Result{
-							BaseResponse: frames.BaseResponse{MessageType: mt},
-							Number:       int(m["Number"].(uint64)),
-						}
-					}
-				}
-			}
-		}
-	}()
-
-	return cancelFunc, nil
+	return DefaultMuxClient.Listen(msgNotifyer)
 }
 
-func connectRaw(deviceId int, port int) (conn *PlistConnection, err error) {
-	conn = NewPlistConnection()
-
-	if err = conn.Dial(); err != nil {
-		return
-	}
-
-	defer func() {
-		if err != nil {
-			if conn != nil {
-				conn.Close()
-				conn = nil
-			}
-		}
-	}()
-
+func connectRaw(ctx context.Context, device frames.Device, port int) (*PlistConnection, error) {
 	connRequest := &frames.ConnectRequest{
 		BaseRequest: *frames.CreateBaseRequest(frames.Connect),
-		DeviceID:    deviceId,
+		DeviceID:    device.GetDeviceID(),
 		PortNumber:  ((port << 8) & 0xFF00) | (port >> 8),
 	}
 
-	if err = conn.Send(connRequest); err != nil {
-		return
-	}
-
-	var pkg *frames.Package
-	pkg, err = conn.Sync()
-	if err != nil {
-		return
-	}
-
-	var result frames.Result
-
-	if err = pkg.UnmarshalBody(&result); err != nil {
-		return
-	}
+	body := frames.PackBinaryConnect(device.GetDeviceID(), port)
 
-	if result.Number == ResultOk {
-		return
-	}
+	debugf(UsbmuxdServiceName, "connect %s port %d", device.GetSerialNumber(), port)
 
-	return nil, getError(uint64(result.Number))
+	return dialRequest(ctx, device.GetSerialNumber(), connRequest, frames.BinaryConnect, body)
 }
 
 func Connect(device frames.Device, port int) (*PlistConnection, error) {
-	return connectRaw(device.GetDeviceID(), port)
+	return ConnectContext(context.Background(), device, port)
 }
 
-func readPairRecordRaw(udid string) (*frames.PairRecord, error) {
-	conn := NewPlistConnection()
-	if err := conn.Dial(); err != nil {
-		return nil, err
-	}
-	defer conn.Close()
-
-	req := &frames.PairRecordRequest{
-		BaseRequest:  *frames.CreateBaseRequest("ReadPairRecord"),
-		PairRecordID: udid,
-	}
-	if err := conn.Send(req); err != nil {
-		return nil, err
-	}
-
-	pkg, err := conn.Sync()
-	if err != nil {
-		return nil, err
-	}
-
-	var m frames.PairRecordResponse
-	if err := pkg.UnmarshalBody(&m); err != nil {
-		return nil, err
-	}
-
-	if m.Number != 0 {
-		return nil, getError(uint64(m.Number))
-	}
-
-	var resp frames.PairRecord
-	if _, err := plist.Unmarshal(m.PairRecordData, &resp); err != nil {
-		return nil, err
-	}
-
-	return &resp, nil
+// ConnectContext is `Connect` that gives up when ctx is done
+func ConnectContext(ctx context.Context, device frames.Device, port int) (*PlistConnection, error) {
+	return connectRaw(ctx, device, port)
 }
 
 func ReadPairRecord(device frames.Device) (*frames.PairRecord, error) {
-	return readPairRecordRaw(device.GetSerialNumber())
+	return DefaultMuxClient.ReadPairRecord(device.GetSerialNumber())
 }
 
 func SavePairRecord(device frames.Device, record *frames.PairRecord) error {
-	conn := NewPlistConnection()
-	if err := conn.Dial(); err != nil {
-		return err
-	}
-	defer conn.Close()
-
-	data, err := plist.Marshal(record, plist.XMLFormat)
-	if err != nil {
-		return err
-	}
-
-	req := &frames.SavePairRecordRequest{
-		BaseRequest:    *frames.CreateBaseRequest("SavePairRecord"),
-		PairRecordID:   device.GetSerialNumber(),
-		PairRecordData: data,
-		DeviceID:       device.GetDeviceID(),
-	}
-
-	var resp frames.Result
-
-	if err := conn.Send(req); err != nil {
-		return err
-	}
-
-	pkg, err := conn.Sync()
-	if err != nil {
-		return err
-	}
-
-	if err := pkg.UnmarshalBody(&resp); err != nil {
-		return err
-	}
-
-	if resp.Number != 0 {
-		return getError(uint64(resp.Number))
-	}
-
-	return nil
+	return DefaultMuxClient.SavePairRecord(device, record)
 }
 
 func DeletePairRecord(device frames.Device) error {
-	conn := NewPlistConnection()
-	if err := conn.Dial(); err != nil {
-		return err
-	}
-	defer conn.Close()
-
-	req := &frames.DeletePairRecordRequest{
-		BaseRequest:  *frames.CreateBaseRequest("DeletePairRecord"),
-		PairRecordID: device.GetSerialNumber(),
-	}
-
-	var resp frames.Result
-
-	if err := conn.Send(req); err != nil {
-		return err
-	}
-
-	pkg, err := conn.Sync()
-	if err != nil {
-		return err
-	}
-
-	if err := pkg.UnmarshalBody(&resp); err != nil {
-		return err
-	}
-
-	if resp.Number != 0 {
-		return getError(uint64(resp.Number))
-	}
-
-	return nil
+	return DefaultMuxClient.DeletePairRecord(device.GetSerialNumber())
 }
@@ -0,0 +1,331 @@
+package tunnel_test
+
+import (
+	"bytes"
+	"errors"
+	"iconsole/frames"
+	"iconsole/tunnel"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func networkDevice(id int) *frames.NetworkDevice {
+	d := frames.NewNetworkDevice("fedcba9876543210", net.IPv4(192, 168, 1, 20))
+	d.DeviceID = id
+	d.EscapedFullServiceName = "00:11:22:33:44:55@fe80::1._apple-mobdev2._tcp.local."
+	d.InterfaceIndex = 4
+	return d
+}
+
+func TestDevices(t *testing.T) {
+	server, usb, done := startMux(t)
+	defer done()
+
+	server.Attach(networkDevice(2))
+
+	devices, err := tunnel.Devices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 2 {
+		t.Fatalf("%d devices, want 2", len(devices))
+	}
+
+	if d, ok := devices[0].(*frames.USBDevice); !ok {
+		t.Errorf("first device %T, want USB", devices[0])
+	} else if d.SerialNumber != usb.SerialNumber || d.ProductID != usb.ProductID || d.LocationID != usb.LocationID {
+		t.Errorf("USB device %+v, want %+v", d, usb)
+	}
+
+	if d, ok := devices[1].(*frames.NetworkDevice); !ok {
+		t.Errorf("second device %T, want network", devices[1])
+	} else if ip, err := d.IP(); err != nil || !ip.Equal(net.IPv4(192, 168, 1, 20)) {
+		t.Errorf("network device IP %v, %v", ip, err)
+	} else if d.InterfaceIndex != 4 || d.DeviceID != 2 {
+		t.Errorf("network device %+v", d)
+	}
+}
+
+func TestDevicesLegacy(t *testing.T) {
+	server, usb, done := startMux(t)
+	defer done()
+
+	server.Legacy = true
+	/* the binary protocol knows no network devices */
+	server.Attach(networkDevice(2))
+
+	devices, err := tunnel.Devices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 1 || devices[0].GetSerialNumber() != usb.SerialNumber {
+		t.Fatalf("devices %v, want the USB device only", devices)
+	}
+
+	if _, err := tunnel.ReadBUID(); !errors.Is(err, tunnel.ErrBadVersion) {
+		t.Errorf("ReadBUID on a binary daemon = %v, want ErrBadVersion", err)
+	}
+}
+
+func TestReadBUID(t *testing.T) {
+	server, _, done := startMux(t)
+	defer done()
+
+	buid, err := tunnel.ReadBUID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buid != server.BUID {
+		t.Errorf("BUID %q, want %q", buid, server.BUID)
+	}
+}
+
+// next waits for one notification of a `Listen` channel
+func next(t *testing.T, ch chan frames.Response) frames.Response {
+	t.Helper()
+
+	select {
+	case msg, ok := <-ch:
+		if !ok {
+			t.Fatal("listen channel closed")
+		}
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notification")
+	}
+	return nil
+}
+
+func TestListen(t *testing.T) {
+	server, usb, done := startMux(t)
+	defer done()
+
+	ch := make(chan frames.Response, 1)
+	cancel, err := tunnel.Listen(ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg, ok := next(t, ch).(*frames.DeviceAttached); !ok {
+		t.Fatalf("first notification %#v, want attached", msg)
+	} else if msg.DeviceID != usb.DeviceID || msg.Properties.GetSerialNumber() != usb.SerialNumber {
+		t.Errorf("attached %+v", msg)
+	}
+
+	server.Attach(networkDevice(2))
+	if msg, ok := next(t, ch).(*frames.DeviceAttached); !ok || msg.DeviceID != 2 {
+		t.Fatalf("notification %#v, want device 2 attached", msg)
+	} else if _, ok := msg.Properties.(*frames.NetworkDevice); !ok {
+		t.Errorf("attached %T, want network", msg.Properties)
+	}
+
+	if err := tunnel.SavePairRecord(usb, &frames.PairRecord{HostID: "HOST"}); err != nil {
+		t.Fatal(err)
+	}
+	if msg, ok := next(t, ch).(*frames.DevicePaired); !ok || msg.DeviceID != usb.DeviceID {
+		t.Fatalf("notification %#v, want paired", msg)
+	}
+
+	server.Detach(usb.DeviceID)
+	if msg, ok := next(t, ch).(*frames.DeviceDetached); !ok || msg.DeviceID != usb.DeviceID {
+		t.Fatalf("notification %#v, want detached", msg)
+	}
+
+	cancel()
+	for range ch {
+	}
+}
+
+func TestListenLegacy(t *testing.T) {
+	server, usb, done := startMux(t)
+	defer done()
+
+	server.Legacy = true
+
+	ch := make(chan frames.Response, 1)
+	cancel, err := tunnel.Listen(ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+
+	if msg, ok := next(t, ch).(*frames.DeviceAttached); !ok || msg.DeviceID != usb.DeviceID {
+		t.Fatalf("notification %#v, want attached", msg)
+	}
+	server.Detach(usb.DeviceID)
+	if msg, ok := next(t, ch).(*frames.DeviceDetached); !ok || msg.DeviceID != usb.DeviceID {
+		t.Fatalf("notification %#v, want detached", msg)
+	}
+}
+
+func echo(conn net.Conn) {
+	defer conn.Close()
+	_, _ = io.Copy(conn, conn)
+}
+
+func TestConnect(t *testing.T) {
+	for _, legacy := range []bool{false, true} {
+		server, usb, done := startMux(t)
+		server.Legacy = legacy
+		if err := server.Handle(usb.DeviceID, 1234, echo); err != nil {
+			t.Fatal(err)
+		}
+
+		conn, err := tunnel.Connect(usb, 1234)
+		if err != nil {
+			t.Fatalf("legacy %v: %v", legacy, err)
+		}
+		msg := []byte("hello device")
+		if _, err := conn.RawConn.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(msg))
+		if _, err := io.ReadFull(conn.RawConn, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Errorf("legacy %v: echoed %q", legacy, got)
+		}
+		conn.Close()
+
+		if _, err := tunnel.Connect(usb, 4321); !errors.Is(err, tunnel.ErrConnectionRefused) {
+			t.Errorf("legacy %v: closed port = %v, want ErrConnectionRefused", legacy, err)
+		}
+
+		gone := &frames.USBDevice{DeviceModel: frames.DeviceModel{ConnectionType: "USB", DeviceID: 9, SerialNumber: "gone"}}
+		if _, err := tunnel.Connect(gone, 1234); !errors.Is(err, tunnel.ErrDeviceNotFound) {
+			t.Errorf("legacy %v: unknown device = %v, want ErrDeviceNotFound", legacy, err)
+		} else {
+			var muxErr *tunnel.UsbmuxdError
+			if !errors.As(err, &muxErr) || muxErr.Device != "gone" {
+				t.Errorf("legacy %v: error %#v does not name the device", legacy, err)
+			}
+		}
+
+		done()
+	}
+}
+
+func TestPairRecords(t *testing.T) {
+	_, usb, done := startMux(t)
+	defer done()
+
+	if _, err := tunnel.ReadPairRecord(usb); !errors.Is(err, tunnel.ErrDeviceNotFound) {
+		t.Fatalf("ReadPairRecord without a record = %v, want ErrDeviceNotFound", err)
+	}
+
+	record := &frames.PairRecord{HostID: "HOST", SystemBUID: "BUID", EscrowBag: []byte{1, 2, 3}}
+	if err := tunnel.SavePairRecord(usb, record); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := tunnel.ReadPairRecord(usb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.HostID != record.HostID || got.SystemBUID != record.SystemBUID || !bytes.Equal(got.EscrowBag, record.EscrowBag) {
+		t.Errorf("ReadPairRecord = %+v, want %+v", got, record)
+	}
+
+	if err := tunnel.DeletePairRecord(usb); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tunnel.ReadPairRecord(usb); !errors.Is(err, tunnel.ErrDeviceNotFound) {
+		t.Errorf("ReadPairRecord after delete = %v, want ErrDeviceNotFound", err)
+	}
+}
+
+func TestListenSubscribers(t *testing.T) {
+	server, usb, done := startMux(t)
+	defer done()
+
+	client := tunnel.NewMuxClient()
+	defer client.Close()
+
+	first := make(chan frames.Response)
+	cancelFirst, err := client.Listen(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg, ok := next(t, first).(*frames.DeviceAttached); !ok || msg.DeviceID != usb.DeviceID {
+		t.Fatalf("notification %#v, want attached", msg)
+	}
+
+	server.Attach(networkDevice(2))
+	if msg, ok := next(t, first).(*frames.DeviceAttached); !ok || msg.DeviceID != 2 {
+		t.Fatalf("notification %#v, want device 2 attached", msg)
+	}
+
+	/* a late subscriber hears of the devices plugged in before it */
+	second := make(chan frames.Response)
+	cancelSecond, err := client.Listen(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancelSecond()
+	for _, id := range []int{usb.DeviceID, 2} {
+		if msg, ok := next(t, second).(*frames.DeviceAttached); !ok || msg.DeviceID != id {
+			t.Fatalf("replayed %#v, want device %d attached", msg, id)
+		}
+	}
+
+	/* requests keep working next to the listeners */
+	if _, err := client.Devices(); err != nil {
+		t.Fatal(err)
+	}
+
+	cancelFirst()
+	for range first {
+	}
+
+	server.Detach(usb.DeviceID)
+	if msg, ok := next(t, second).(*frames.DeviceDetached); !ok || msg.DeviceID != usb.DeviceID {
+		t.Fatalf("notification %#v, want detached", msg)
+	}
+}
+
+func TestListenDaemonGone(t *testing.T) {
+	server, _, done := startMux(t)
+	defer done()
+
+	client := tunnel.NewMuxClient()
+	ch := make(chan frames.Response, 16)
+	cancel, err := client.Listen(ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+
+	_ = server.Close()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("channel not closed after usbmuxd went away")
+		}
+	}
+}
+
+func TestMuxClientNoTimeout(t *testing.T) {
+	server, _, done := startMux(t)
+	defer done()
+
+	client := tunnel.NewMuxClient()
+	client.Timeout = 0
+	defer client.Close()
+
+	buid, err := client.ReadBUID()
+	if err != nil {
+		t.Fatalf("ReadBUID without a timeout: %v", err)
+	}
+	if buid != server.BUID {
+		t.Errorf("BUID %q", buid)
+	}
+}
@@ -0,0 +1,53 @@
+package tunnel
+
+import (
+	"fmt"
+)
+
+// UsbmuxdError is a result code usbmuxd answered with, `Device` is the
+// serial number of the device the request was about, if any. Compare
+// against the sentinels below with `errors.Is`
+type UsbmuxdError struct {
+	Code   int
+	Device string
+}
+
+var usbmuxdResultNames = map[int]string{
+	ResultBadCommand:  "bad command",
+	ResultBadDev:      "device not found",
+	ResultCommRefused: "connection refused",
+	ResultBadVersion:  "protocol version not supported",
+}
+
+func (this *UsbmuxdError) Error() string {
+	msg, ok := usbmuxdResultNames[this.Code]
+	if !ok {
+		msg = fmt.Sprintf("result code %d", this.Code)
+	}
+	if this.Device != "" {
+		return fmt.Sprintf("usbmuxd: %s (%s)", msg, this.Device)
+	}
+	return "usbmuxd: " + msg
+}
+
+func (this *UsbmuxdError) Is(target error) bool {
+	t, ok := target.(*UsbmuxdError)
+	return ok && t.Code == this.Code && (t.Device == "" || t.Device == this.Device)
+}
+
+var (
+	ErrBadCommand = &UsbmuxdError{Code: ResultBadCommand}
+	// the device is gone or never was attached
+	ErrDeviceNotFound = &UsbmuxdError{Code: ResultBadDev}
+	// nothing listens on the device port
+	ErrConnectionRefused = &UsbmuxdError{Code: ResultCommRefused}
+	// the daemon only speaks the binary protocol, or the request has no binary form
+	ErrBadVersion = &UsbmuxdError{Code: ResultBadVersion}
+)
+
+func usbmuxdError(num uint64, device string) error {
+	if num == ResultOk {
+		return nil
+	}
+	return &UsbmuxdError{Code: int(num), Device: device}
+}